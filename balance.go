@@ -0,0 +1,199 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package goledger
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Residual is the sum of the postings of a transaction in a currency.
+type Residual struct {
+	Value    decimal.Decimal
+	Currency string
+}
+
+// ImbalanceError is returned if the postings of a transaction do not sum up
+// to zero in every currency.
+type ImbalanceError struct {
+	Date        time.Time
+	Description string
+	// Type is the type of the postings that do not balance, either
+	// RegularPosting or BalancedVirtualPosting
+	Type PostingType
+	// Residuals are the sums that are not zero, sorted by currency
+	Residuals []Residual
+}
+
+func (e *ImbalanceError) Error() string {
+	var residuals []string
+	for _, r := range e.Residuals {
+		residuals = append(residuals, CommodityStyles(nil).Format(r.Value, r.Currency))
+	}
+	what := "transaction does"
+	if e.Type == BalancedVirtualPosting {
+		what = "balanced virtual postings do"
+	}
+	return fmt.Sprintf("%s %s: %s not balance, off by %s", renderDate(e.Date), e.Description, what, strings.Join(residuals, ", "))
+}
+
+// weight returns the value of the posting that counts towards balancing
+// the transaction, which is the converted value if it has a cost or a
+// price. For total prices, it is the total price.
+func (p *Posting) weight() (decimal.Decimal, string) {
+	if !p.Cost.IsZero() {
+		return p.Value.Mul(p.Cost), p.CostCurrency
+	}
+	if total, ok := p.totalPrice(); ok {
+		if p.Value.IsNegative() {
+			total = total.Neg()
+		}
+		return total, p.AtCurrency
+	}
+	if !p.AtValue.IsZero() {
+		return p.Value.Mul(p.AtValue), p.AtCurrency
+	}
+	return p.Value, p.Currency
+}
+
+// residuals returns the sums of the postings of the given type per
+// currency that are not zero, ignoring elided postings. The sums are
+// rounded to the largest precision the unconverted amounts in the currency
+// are written with, but at least to the precision of DefaultCommodityStyle,
+// so for example converted amounts balance as far as they are shown.
+func (l *Transaction) residuals(typ PostingType) []Residual {
+	sums := make(map[string]decimal.Decimal)
+	precisions := make(map[string]int32)
+	for i := range l.Postings {
+		p := &l.Postings[i]
+		if p.Elided || p.Type != typ {
+			continue
+		}
+		value, currency := p.weight()
+		if _, ok := precisions[currency]; !ok {
+			precisions[currency] = DefaultCommodityStyle.Precision
+		}
+		if precision := -p.Value.Exponent(); currency == p.Currency && precision > precisions[currency] {
+			precisions[currency] = precision
+		}
+		sums[currency] = sums[currency].Add(value)
+	}
+
+	var residuals []Residual
+	for currency, sum := range sums {
+		sum = sum.Round(precisions[currency])
+		if !sum.IsZero() {
+			residuals = append(residuals, Residual{Value: sum, Currency: currency})
+		}
+	}
+	sort.Slice(residuals, func(i, j int) bool {
+		return residuals[i].Currency < residuals[j].Currency
+	})
+	return residuals
+}
+
+// Balance infers the amount of the elided posting, if any, and checks that
+// the postings sum up to zero per currency, taking costs and prices into
+// account.
+// Regular and balanced virtual postings have to balance separately, and
+// may have one elided posting each; virtual postings do not have to
+// balance, and elided ones are zero.
+//
+// If an elided posting has to balance several currencies, it gets the
+// first one, and further postings to the same account are inserted after
+// it for the others. An unbalanced transaction yields an *ImbalanceError.
+func (l *Transaction) Balance() error {
+	for _, typ := range []PostingType{RegularPosting, BalancedVirtualPosting} {
+		if err := l.balance(typ); err != nil {
+			return err
+		}
+	}
+	for i := range l.Postings {
+		if p := &l.Postings[i]; p.Elided && p.Type == VirtualPosting {
+			p.Value, p.Currency = decimal.Zero, ""
+			p.AtValue, p.AtCurrency = decimal.Zero, ""
+			p.Cost, p.CostCurrency = decimal.Zero, ""
+		}
+	}
+	return nil
+}
+
+// balance balances the postings of the given type, see Balance.
+func (l *Transaction) balance(typ PostingType) error {
+	elided := -1
+	for i := range l.Postings {
+		if !l.Postings[i].Elided || l.Postings[i].Type != typ {
+			continue
+		}
+		if elided != -1 {
+			return fmt.Errorf("%s %s: more than one %s without an amount", renderDate(l.Date), l.Description, typ)
+		}
+		elided = i
+	}
+
+	residuals := l.residuals(typ)
+	if elided == -1 {
+		if len(residuals) != 0 {
+			return &ImbalanceError{Date: l.Date, Description: l.Description, Type: typ, Residuals: residuals}
+		}
+		return nil
+	}
+
+	p := &l.Postings[elided]
+	p.Value, p.Currency = decimal.Zero, ""
+	p.AtValue, p.AtCurrency = decimal.Zero, ""
+	p.Cost, p.CostCurrency = decimal.Zero, ""
+	if len(residuals) == 0 {
+		return nil
+	}
+	p.Value, p.Currency = residuals[0].Value.Neg(), residuals[0].Currency
+
+	var extra []Posting
+	for _, r := range residuals[1:] {
+		extra = append(extra, Posting{Account: p.Account, Type: p.Type, Value: r.Value.Neg(), Currency: r.Currency, Status: p.Status, Date: p.Date, ValutaDate: p.ValutaDate})
+	}
+	if len(extra) != 0 {
+		postings := append([]Posting{}, l.Postings[:elided+1]...)
+		postings = append(postings, extra...)
+		l.Postings = append(postings, l.Postings[elided+1:]...)
+	}
+	return nil
+}
+
+// Validate checks that the transaction balances like Balance, but without
+// modifying it.
+func (l *Transaction) Validate() error {
+	c := *l
+	c.Postings = append([]Posting(nil), l.Postings...)
+	return c.Balance()
+}
+
+// Balance balances all transactions in the journal, see
+// Transaction.Balance. It stops at the first error.
+func (j Journal) Balance() error {
+	for i := range j {
+		if err := j[i].Balance(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
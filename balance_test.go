@@ -0,0 +1,117 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package goledger
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestBalanceInfersElided(t *testing.T) {
+	j, err := ParseJournal(strings.NewReader(`2017/01/02 Exchange
+    assets:cash  -10.00 USD @ 0.8696 EUR
+    assets:bank  5.00 GBP
+    expenses:misc
+    [budget:food]  5 EUR
+    [budget:free]
+    (tracking)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Balance(); err != nil {
+		t.Fatal(err)
+	}
+	// The elided posting gets the first currency, and another posting is
+	// inserted for the second one
+	var got []string
+	for _, p := range j[0].Postings {
+		got = append(got, p.Account+" "+p.Value.String()+" "+p.Currency)
+	}
+	want := []string{
+		"assets:cash -10 USD",
+		"assets:bank 5 GBP",
+		"expenses:misc 8.7 EUR",
+		"expenses:misc -5 GBP",
+		"budget:food 5 EUR",
+		"budget:free -5 EUR",
+		"tracking 0 ",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got postings:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestBalanceErrors(t *testing.T) {
+	for _, test := range []struct {
+		journal   string
+		residuals string
+	}{
+		{"2017/01/02 Unbalanced\n    a  1.00 EUR\n    b  -2.00 EUR\n", "-1 EUR"},
+		// Converted amounts balance as far as the other amounts are shown
+		{"2017/01/02 Rounded\n    a  -10.00 USD @ 0.8696 EUR\n    b  8.70 EUR\n", ""},
+		{"2017/01/02 Not rounded\n    a  -10.00 USD @ 0.8696 EUR\n    b  8.71 EUR\n", "0.01 EUR"},
+		{"2017/01/02 Cost\n    a  10 AAPL {12.34 EUR} @ 13 EUR\n    b  -123.40 EUR\n", ""},
+		{"2017/01/02 Virtual\n    a  1 EUR\n    b  -1 EUR\n    [c]  1 EUR\n", "1 EUR"},
+	} {
+		j, err := ParseJournal(strings.NewReader(test.journal))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = j[0].Validate()
+		var imbalance *ImbalanceError
+		switch {
+		case test.residuals == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", j[0].Description, err)
+		case test.residuals == "":
+		case !errors.As(err, &imbalance):
+			t.Errorf("%s: got %v, want an imbalance of %s", j[0].Description, err, test.residuals)
+		case residualsString(imbalance.Residuals) != test.residuals:
+			t.Errorf("%s: got residuals %s, want %s", j[0].Description, residualsString(imbalance.Residuals), test.residuals)
+		}
+	}
+}
+
+// TestBalancePrecision checks that amounts without decimal places, like
+// those created by decimal.NewFromFloat, do not round the residuals away,
+// and that converted amounts do not determine the precision.
+func TestBalancePrecision(t *testing.T) {
+	l := Transaction{Description: "Buy", Postings: []Posting{
+		{Account: "assets:depot", Value: decimal.New(10, 0), Currency: "AAPL", AtValue: decimal.RequireFromString("12.34"), AtCurrency: "EUR"},
+		{Account: "assets:bank", Value: decimal.NewFromFloat(-100), Currency: "EUR"},
+	}}
+	var imbalance *ImbalanceError
+	if err := l.Validate(); !errors.As(err, &imbalance) {
+		t.Fatalf("got %v, want an imbalance", err)
+	}
+	if got := residualsString(imbalance.Residuals); got != "23.4 EUR" {
+		t.Errorf("got residuals %s, want 23.4 EUR", got)
+	}
+}
+
+// residualsString describes the residuals, like "1 EUR, -2 USD".
+func residualsString(residuals []Residual) string {
+	var parts []string
+	for _, r := range residuals {
+		parts = append(parts, r.Value.String()+" "+r.Currency)
+	}
+	return strings.Join(parts, ", ")
+}
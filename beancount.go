@@ -0,0 +1,288 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package goledger
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+
+	"github.com/shopspring/decimal"
+)
+
+// BeancountRenderer renders transactions in Beancount syntax.
+//
+// Account names are converted to Beancount's naming rules by capitalizing
+// each component and replacing unsupported characters, commodities are
+// upper-cased, and the valuta date, the code, and the ID are rendered as
+// the metadata keys "valuta", "code", and "import-id". Tags with values
+// become metadata, tags without values Beancount tags. Unmarked
+// transactions use the txn flag.
+//
+// Beancount has no virtual postings, so virtual postings are left out, and
+// balanced virtual postings are rendered as regular ones. Posting dates
+// are rendered as the metadata keys "date" and "valuta".
+//
+// Balance assertions are rendered as balance directives on the day after
+// the transaction, as Beancount checks balances at the start of the day.
+// Beancount balances always include sub-accounts and only check a single
+// commodity, regardless of the kind of the assertion.
+type BeancountRenderer struct {
+	// AtAsCost renders AtValue/AtCurrency as a cost {} instead of a
+	// price @, so the postings are held at cost. Postings that have a
+	// Cost are always rendered with it.
+	AtAsCost bool
+	// AllowUnbalanced renders transactions that do not balance instead
+	// of returning an error.
+	AllowUnbalanced bool
+	// Styles are the styles of amounts. Only their precision is used, as
+	// Beancount only supports one way of writing numbers.
+	Styles CommodityStyles
+	// AmountColumn is the column amounts are right-aligned to, see
+	// HledgerRenderer.
+	AmountColumn int
+}
+
+// number formats a value with the precision of the commodity.
+func (r BeancountRenderer) number(value decimal.Decimal, commodity string) string {
+	style := CommodityStyle{DecimalMark: '.', Precision: r.Styles.Style(commodity).Precision}
+	if value.IsNegative() {
+		return "-" + style.formatNumber(value.Abs())
+	}
+	return style.formatNumber(value)
+}
+
+// beancountCommodities maps common currency symbols to their ISO codes
+var beancountCommodities = map[string]string{
+	"€": "EUR",
+	"$": "USD",
+	"£": "GBP",
+	"¥": "JPY",
+}
+
+// beancountAccount converts an account name to a valid Beancount account
+// name, for example "expenses:food" becomes "Expenses:Food".
+func beancountAccount(account string) string {
+	components := strings.Split(account, ":")
+	for i, c := range components {
+		var b strings.Builder
+		for _, r := range c {
+			switch {
+			case unicode.IsLetter(r) || unicode.IsDigit(r):
+				b.WriteRune(r)
+			case b.Len() > 0 && !strings.HasSuffix(b.String(), "-"):
+				b.WriteRune('-')
+			}
+		}
+		c = strings.TrimRight(b.String(), "-")
+		if c == "" {
+			c = "X"
+		}
+		runes := []rune(c)
+		runes[0] = unicode.ToUpper(runes[0])
+		components[i] = string(runes)
+	}
+	return strings.Join(components, ":")
+}
+
+// beancountCommodity converts a commodity to a valid Beancount commodity
+func beancountCommodity(commodity string) string {
+	if c, ok := beancountCommodities[commodity]; ok {
+		return c
+	}
+	var b strings.Builder
+	for _, r := range strings.ToUpper(commodity) {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', b.Len() > 0 && strings.ContainsRune("'._-", r):
+			b.WriteRune(r)
+		}
+	}
+	if b.Len() == 0 {
+		return "UNKNOWN"
+	}
+	return b.String()
+}
+
+// beancountName converts a tag name into a valid metadata key or, if tag
+// is set, into a valid tag name.
+func beancountName(name string, tag bool) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r < 128 && (unicode.IsLetter(r) || unicode.IsDigit(r)), r == '-', r == '_':
+			b.WriteRune(r)
+		case tag && (r == '/' || r == '.'):
+			b.WriteRune(r)
+		default:
+			b.WriteRune('-')
+		}
+	}
+	key := b.String()
+	if tag {
+		return key
+	}
+	if key == "" || key[0] < 'a' || key[0] > 'z' {
+		key = "x" + key
+	}
+	return key
+}
+
+// renderBeancountMetadata renders the comment lines and the tags with values
+// with the given indentation.
+func renderBeancountMetadata(b *strings.Builder, indent string, comment string, tags []Tag) {
+	if comment != "" {
+		for _, line := range strings.Split(comment, "\n") {
+			fmt.Fprintf(b, "%s; %s\n", indent, line)
+		}
+	}
+	for _, tag := range tags {
+		if tag.Value != "" {
+			fmt.Fprintf(b, "%s%s: %s\n", indent, beancountName(tag.Name, false), beancountString(tag.Value))
+		}
+	}
+}
+
+func beancountDate(l *Transaction) (string, string) {
+	date, valutaDate := l.dates()
+	var valuta string
+	if !valutaDate.IsZero() {
+		valuta = valutaDate.Format("2006-01-02")
+	}
+	return date.Format("2006-01-02"), valuta
+}
+
+// beancountInferVirtual returns a copy of the transaction where the amounts
+// of elided balanced virtual postings are written out, as Beancount only
+// allows one elided posting per transaction. If the transaction cannot be
+// balanced, the error of Transaction.Balance is returned.
+func beancountInferVirtual(l *Transaction) (*Transaction, error) {
+	elided := false
+	for _, p := range l.Postings {
+		elided = elided || (p.Elided && p.Type == BalancedVirtualPosting)
+	}
+	if !elided {
+		return l, nil
+	}
+	c := *l
+	c.Postings = append([]Posting(nil), l.Postings...)
+	if err := c.Balance(); err != nil {
+		return nil, err
+	}
+	for i := range c.Postings {
+		if c.Postings[i].Type == BalancedVirtualPosting {
+			c.Postings[i].Elided = false
+		}
+	}
+	return &c, nil
+}
+
+// beancountString quotes a string. Beancount strings only escape quotes and
+// backslashes.
+func beancountString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// RenderTransaction renders the transaction in Beancount syntax. Elided
+// balanced virtual postings have to balance even if AllowUnbalanced is set,
+// as their amounts have to be written out.
+func (r BeancountRenderer) RenderTransaction(w io.Writer, l *Transaction) error {
+	if !r.AllowUnbalanced {
+		if err := l.Validate(); err != nil {
+			return err
+		}
+	}
+	l, err := beancountInferVirtual(l)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	date, valuta := beancountDate(l)
+	flag := l.Status.String()
+	if flag == "" {
+		flag = "txn"
+	}
+	fmt.Fprintf(&b, "%s %s %s", date, flag, beancountString(l.Description))
+	for _, tag := range l.Tags {
+		if tag.Value == "" {
+			fmt.Fprintf(&b, " #%s", beancountName(tag.Name, true))
+		}
+	}
+	b.WriteString("\n")
+	if valuta != "" {
+		fmt.Fprintf(&b, "  valuta: %s\n", valuta)
+	}
+	if l.Code != "" {
+		fmt.Fprintf(&b, "  code: %s\n", beancountString(l.Code))
+	}
+	if l.ID != "" {
+		fmt.Fprintf(&b, "  import-id: %s\n", beancountString(l.ID))
+	}
+	renderBeancountMetadata(&b, "  ", l.Comment, l.Tags)
+	var lines []postingLine
+	for _, p := range l.Postings {
+		if p.Type == VirtualPosting {
+			continue
+		}
+		var line postingLine
+		line.prefix = "  " + beancountAccount(p.Account)
+		if p.Status != Unmarked {
+			line.prefix = "  " + p.Status.String() + " " + beancountAccount(p.Account)
+		}
+		if !p.Elided {
+			line.amount = r.number(p.Value, p.Currency) + " " + beancountCommodity(p.Currency)
+			total, isTotal := p.totalPrice()
+			switch {
+			case !p.Cost.IsZero():
+				line.suffix = fmt.Sprintf(" {%s %s}", r.number(p.Cost, p.CostCurrency), beancountCommodity(p.CostCurrency))
+				if !p.AtValue.IsZero() {
+					line.suffix += fmt.Sprintf(" @ %s %s", r.number(p.AtValue, p.AtCurrency), beancountCommodity(p.AtCurrency))
+				}
+			case isTotal && r.AtAsCost:
+				line.suffix = fmt.Sprintf(" {{%s %s}}", r.number(total, p.AtCurrency), beancountCommodity(p.AtCurrency))
+			case isTotal:
+				line.suffix = fmt.Sprintf(" @@ %s %s", r.number(total, p.AtCurrency), beancountCommodity(p.AtCurrency))
+			case p.AtValue.IsZero():
+			case r.AtAsCost:
+				line.suffix = fmt.Sprintf(" {%s %s}", r.number(p.AtValue, p.AtCurrency), beancountCommodity(p.AtCurrency))
+			default:
+				line.suffix = fmt.Sprintf(" @ %s %s", r.number(p.AtValue, p.AtCurrency), beancountCommodity(p.AtCurrency))
+			}
+		}
+		var after strings.Builder
+		if !p.Date.IsZero() {
+			fmt.Fprintf(&after, "    date: %s\n", p.Date.Format("2006-01-02"))
+		}
+		if !p.ValutaDate.IsZero() {
+			fmt.Fprintf(&after, "    valuta: %s\n", p.ValutaDate.Format("2006-01-02"))
+		}
+		renderBeancountMetadata(&after, "    ", p.Comment, p.Tags)
+		line.after = after.String()
+		lines = append(lines, line)
+	}
+	writePostingLines(&b, lines, r.AmountColumn)
+	b.WriteString("\n")
+	for _, p := range l.Postings {
+		if p.Assertion != NoAssertion && p.Type != VirtualPosting {
+			date, _ := l.dates()
+			fmt.Fprintf(&b, "%s balance %s  %s %s\n\n", date.AddDate(0, 0, 1).Format("2006-01-02"), beancountAccount(p.Account), r.number(p.AssertionValue, p.AssertionCurrency), beancountCommodity(p.AssertionCurrency))
+		}
+	}
+	_, err = io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,89 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package goledger
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBeancountRenderer(t *testing.T) {
+	got := renderJournal(t, `2017/01/02=2017/01/03 * (42) Größe "groß" \ klein
+    ; id: 123
+    ; note: ä
+    assets:cash  -10.00 USD @ 0.87 EUR
+    assets:bank  5.00 AAPL {1.00 EUR} = 5.00 AAPL
+    expenses:misc
+    [budget:misc]  -3.70 EUR
+    [budget:free]
+    (tracking)  1 EUR
+`, BeancountRenderer{})
+	want := `2017-01-02 * "Größe \"groß\" \\ klein"
+  valuta: 2017-01-03
+  code: "42"
+  import-id: "123"
+  note: "ä"
+  Assets:Cash  -10.00 USD @ 0.87 EUR
+  Assets:Bank  5.00 AAPL {1.00 EUR}
+  Expenses:Misc
+  Budget:Misc  -3.70 EUR
+  Budget:Free  3.70 EUR
+
+2017-01-03 balance Assets:Bank  5.00 AAPL
+
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestBeancountRendererUnbalancedVirtual(t *testing.T) {
+	j, err := ParseJournal(strings.NewReader("2017/01/02 Unbalanced\n    a  1.00 EUR\n    b\n    [c]  1.00 EUR\n    [d]  1.00 EUR\n    [e]\n    [f]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Beancount does not allow several elided postings, so this cannot be
+	// rendered even if unbalanced transactions are allowed.
+	var b strings.Builder
+	if err := (BeancountRenderer{AllowUnbalanced: true}).RenderTransaction(&b, &j[0]); err == nil {
+		t.Errorf("expected an error, got:\n%s", b.String())
+	}
+}
+
+func TestBeancountRendererPostingDates(t *testing.T) {
+	got := renderJournal(t, `2017/01/02 Transfer
+    assets:bank  -5.00 EUR
+    assets:savings  5.00 EUR  ; [2017/01/04=2017/01/05]
+    [budget:savings]  5.00 EUR  ; date: 2017/01/04
+    [budget:free]
+    (tracking)  1.00 EUR
+`, BeancountRenderer{})
+	want := `2017-01-02 txn "Transfer"
+  Assets:Bank  -5.00 EUR
+  Assets:Savings  5.00 EUR
+    date: 2017-01-04
+    valuta: 2017-01-05
+  Budget:Savings  5.00 EUR
+    date: 2017-01-04
+  Budget:Free  -5.00 EUR
+
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,185 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/julian-klode/goledger"
+	"github.com/julian-klode/goledger/rules"
+)
+
+// config is the configuration file of the goledger tool, a JSON file like
+//
+//	{
+//		"journal": "main.journal",
+//		"state": "import.state",
+//		"rules": "import.rules",
+//		"syntax": "hledger",
+//		"amount-column": 52,
+//		"transfer-days": 3,
+//		"commodities": {
+//			"EUR": "1.000,00 €"
+//		},
+//		"accounts": {
+//			"DE89370400440532013000": "assets:bank:giro",
+//			"1234": "liabilities:lbb"
+//		}
+//	}
+//
+// Relative paths are relative to the directory of the configuration file.
+type config struct {
+	// Journal is the journal that import appends to
+	Journal string `json:"journal"`
+	// State records the imported transactions. It defaults to the path
+	// of the journal with a .state suffix.
+	State string `json:"state"`
+	// Rules is a rules file as understood by the rules package
+	Rules string `json:"rules"`
+	// Syntax is the syntax of the journal: hledger (the default), ledger
+	// or beancount
+	Syntax string `json:"syntax"`
+	// AmountColumn is the column amounts are right-aligned to. If zero,
+	// amounts are not aligned.
+	AmountColumn int `json:"amount-column"`
+	// Commodities maps commodities to sample amounts describing their
+	// style, like in a commodity directive. If the sample uses another
+	// commodity, like € for EUR, it is written instead. Styles declared
+	// in the journal are used for other commodities.
+	Commodities map[string]string `json:"commodities"`
+	// Accounts maps local accounts (IBANs, card numbers, N26 account IDs)
+	// to ledger accounts. It takes precedence over local-account rules.
+	Accounts map[string]string `json:"accounts"`
+	// TransferDays is the maximum number of days between the two sides of
+	// a transfer between local accounts, which are merged into one
+	// transaction if both are imported. It defaults to
+	// defaultTransferDays if unset; if negative, transfers are not merged.
+	TransferDays *int `json:"transfer-days"`
+}
+
+// defaultTransferDays is the default of config.TransferDays
+const defaultTransferDays = 3
+
+// transferDays returns TransferDays, or its default if it is unset.
+func (c *config) transferDays() int {
+	if c.TransferDays == nil {
+		return defaultTransferDays
+	}
+	return *c.TransferDays
+}
+
+// defaultConfigPath returns the path of the configuration file used if
+// none is given on the command line.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "goledger.json"
+	}
+	return filepath.Join(dir, "goledger", "config.json")
+}
+
+// readConfig reads the configuration file at path. If the file does not
+// exist and required is false, an empty configuration is returned.
+func readConfig(path string, required bool) (*config, error) {
+	var c config
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return &c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, &os.PathError{Op: "parse", Path: path, Err: err}
+	}
+
+	dir := filepath.Dir(path)
+	for _, p := range []*string{&c.Journal, &c.State, &c.Rules} {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+	if c.State == "" && c.Journal != "" {
+		c.State = c.Journal + ".state"
+	}
+	return &c, nil
+}
+
+// rules returns the rules of the configuration, with the accounts added.
+func (c *config) rules() (*rules.Rules, error) {
+	r := &rules.Rules{}
+	if c.Rules != "" {
+		var err error
+		if r, err = rules.ParseFile(c.Rules); err != nil {
+			return nil, err
+		}
+	}
+	if r.LocalAccounts == nil {
+		r.LocalAccounts = make(map[string]string)
+	}
+	for id, account := range c.Accounts {
+		r.LocalAccounts[id] = account
+	}
+	return r, nil
+}
+
+// styles returns the commodity styles declared in the journal, if it is
+// not a Beancount journal, and the configuration.
+func (c *config) styles() (goledger.CommodityStyles, error) {
+	styles := make(goledger.CommodityStyles)
+	if c.Journal != "" && c.Syntax != "beancount" {
+		journalStyles, err := goledger.ParseCommodityStylesFile(c.Journal)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for commodity, style := range journalStyles {
+			styles[commodity] = style
+		}
+	}
+	for commodity, sample := range c.Commodities {
+		symbol, style, err := goledger.ParseCommodityStyle(sample)
+		if err != nil {
+			return nil, fmt.Errorf("commodity %s: %v", commodity, err)
+		}
+		if symbol != commodity {
+			style.Symbol = symbol
+		}
+		styles[commodity] = style
+	}
+	return styles, nil
+}
+
+// renderer returns the renderer for the configured journal syntax
+func (c *config) renderer() (goledger.Renderer, error) {
+	styles, err := c.styles()
+	if err != nil {
+		return nil, err
+	}
+	switch c.Syntax {
+	case "", "hledger":
+		return goledger.HledgerRenderer{Styles: styles, AmountColumn: c.AmountColumn}, nil
+	case "ledger":
+		return goledger.LedgerRenderer{Styles: styles, AmountColumn: c.AmountColumn}, nil
+	case "beancount":
+		return goledger.BeancountRenderer{Styles: styles, AmountColumn: c.AmountColumn}, nil
+	}
+	return nil, fmt.Errorf("unknown syntax %q, expected hledger, ledger or beancount", c.Syntax)
+}
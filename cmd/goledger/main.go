@@ -0,0 +1,463 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Command goledger imports bank statements into hledger, ledger, or
+// Beancount journals.
+//
+// Usage:
+//
+//	goledger [-config FILE] [-lenient] COMMAND ARGS...
+//
+// Commands:
+//
+//	import [-n] FORMAT FILE...   append new transactions to the journal
+//	detect FILE...               print the formats of the files
+//	convert [-syntax SYNTAX] FORMAT FILE...
+//	                             print the transactions in the files, in
+//	                             hledger, ledger, or beancount syntax
+//	dedupe [-mark] FORMAT FILE...
+//	                             print the transactions in the files that
+//	                             have not been imported yet, and with -mark,
+//	                             record them as imported
+//	fmt [FILE...]                reformat the journal files, by default the
+//	                             configured journal, in place
+//	portfolio [-syntax SYNTAX] [-prices] FILE...
+//	                             print the transactions of the Portfolio
+//	                             Performance files, with the cost of lots,
+//	                             or with -prices, the prices of securities
+//
+// FORMAT is the name of a format like hbci, lbb, or n26, or auto to detect
+// the format of each file.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/julian-klode/goledger"
+	"github.com/julian-klode/goledger/importer"
+	"github.com/julian-klode/goledger/rules"
+)
+
+// tool holds the global options of the command line tool.
+type tool struct {
+	configPath string
+	lenient    bool
+	stdout     io.Writer
+	stderr     io.Writer
+}
+
+func main() {
+	t := tool{stdout: os.Stdout, stderr: os.Stderr}
+	if err := t.run(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "goledger: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+var errUsage = errors.New("usage: goledger [-config FILE] [-lenient] import|detect|convert|dedupe|fmt|portfolio ARGS...")
+
+func (t *tool) run(args []string) error {
+	flags := flag.NewFlagSet("goledger", flag.ContinueOnError)
+	flags.SetOutput(t.stderr)
+	flags.StringVar(&t.configPath, "config", "", "configuration file (default "+defaultConfigPath()+")")
+	flags.BoolVar(&t.lenient, "lenient", false, "skip records that cannot be parsed")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errUsage
+	}
+
+	args = flags.Args()[1:]
+	switch flags.Arg(0) {
+	case "import":
+		return t.importCommand(args)
+	case "detect":
+		return t.detectCommand(args)
+	case "convert":
+		return t.convertCommand(args)
+	case "dedupe":
+		return t.dedupeCommand(args)
+	case "fmt":
+		return t.fmtCommand(args)
+	case "portfolio":
+		return t.portfolioCommand(args)
+	default:
+		return errUsage
+	}
+}
+
+// config reads the configuration file. It is only required to exist if it
+// was given on the command line.
+func (t *tool) config() (*config, error) {
+	if t.configPath != "" {
+		return readConfig(t.configPath, true)
+	}
+	return readConfig(defaultConfigPath(), false)
+}
+
+// parse parses the files in the given format into statements. Files in
+// formats without statements become a single statement without balances.
+func (t *tool) parse(format string, paths []string) ([]importer.Statement, error) {
+	var f importer.Format
+	if format != "auto" {
+		var ok bool
+		if f, ok = importer.Lookup(format); !ok {
+			var names []string
+			for _, f := range importer.Formats() {
+				names = append(names, f.Name)
+			}
+			return nil, fmt.Errorf("unknown format %q, expected auto or one of %s", format, strings.Join(names, ", "))
+		}
+	}
+
+	var statements []importer.Statement
+	for _, path := range paths {
+		ss, err := parseFile(path, f)
+		if err != nil && t.lenient {
+			var errs importer.ParseErrors
+			if errs, err = importer.Lenient(err); err == nil {
+				for _, e := range errs {
+					fmt.Fprintf(t.stderr, "goledger: %s: skipping: %v\n", path, e)
+				}
+				// The balances do not match with skipped records
+				for i := range ss {
+					ss[i].Opening, ss[i].Closing, ss[i].Available = nil, nil, nil
+				}
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		statements = append(statements, ss...)
+	}
+	return statements, nil
+}
+
+// parseFile parses the file at path in the format f, or, if f has no name,
+// in the detected format.
+func parseFile(path string, f importer.Format) ([]importer.Statement, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if f.Name == "" {
+		var ok bool
+		if f, ok = importer.Detect(data); !ok {
+			return nil, importer.ErrUnknownFormat
+		}
+	}
+	if f.ParseStatements != nil {
+		return f.ParseStatements(bytes.NewReader(data))
+	}
+	transactions, err := f.Parse(bytes.NewReader(data))
+	return []importer.Statement{{Transactions: transactions}}, err
+}
+
+// convert converts the transactions in the statements using the rules in
+// the configuration, and sorts them by date. If state is not nil, only the
+// transactions that have not been imported yet are converted, and they are
+// marked as imported. The two sides of transfers between local accounts
+// are merged, see rules.TransferMatcher.
+func convert(c *config, statements []importer.Statement, state *importer.State) (goledger.Journal, error) {
+	r, err := c.rules()
+	if err != nil {
+		return nil, err
+	}
+	var lists [][]importer.Transaction
+	var converted [][]goledger.Transaction
+	for _, s := range statements {
+		all := r.ConvertStatement(s)
+		var list []importer.Transaction
+		var conv []goledger.Transaction
+		for i, t := range s.Transactions {
+			if state != nil && state.Imported(t) {
+				continue
+			}
+			list = append(list, t)
+			conv = append(conv, all[i])
+		}
+		// Like State.Filter, transactions of a statement are only compared
+		// to those of other statements
+		if state != nil {
+			for _, t := range list {
+				state.Mark(t)
+			}
+		}
+		lists = append(lists, list)
+		converted = append(converted, conv)
+	}
+	var transfers []rules.Transfer
+	if days := c.transferDays(); days >= 0 {
+		matcher := rules.TransferMatcher{Rules: r, Days: days}
+		transfers = matcher.Match(lists...)
+	}
+	journal := goledger.Journal(rules.MergeTransfers(transfers, converted...))
+	journal.Sort()
+	return journal, nil
+}
+
+// openState opens the state file configured in c.
+func openState(c *config) (*importer.State, error) {
+	if c.State == "" {
+		return nil, fmt.Errorf("no journal or state file configured")
+	}
+	return importer.OpenState(c.State)
+}
+
+func (t *tool) importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.SetOutput(t.stderr)
+	dryRun := flags.Bool("n", false, "print the new transactions instead of importing them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 2 {
+		return fmt.Errorf("usage: goledger import [-n] FORMAT FILE...")
+	}
+
+	c, err := t.config()
+	if err != nil {
+		return err
+	}
+	if c.Journal == "" {
+		return fmt.Errorf("no journal configured")
+	}
+	statements, err := t.parse(flags.Arg(0), flags.Args()[1:])
+	if err != nil {
+		return err
+	}
+	state, err := openState(c)
+	if err != nil {
+		return err
+	}
+	renderer, err := c.renderer()
+	if err != nil {
+		return err
+	}
+	journal, err := convert(c, statements, state)
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		return journal.Render(t.stdout, renderer)
+	}
+	if len(journal) == 0 {
+		return nil
+	}
+	if err := journal.AppendFile(c.Journal, renderer); err != nil {
+		state.Rollback()
+		return err
+	}
+	if err := state.Commit(); err != nil {
+		return fmt.Errorf("appended %d transactions to %s, but could not record them as imported: %v", len(journal), c.Journal, err)
+	}
+	fmt.Fprintf(t.stderr, "goledger: imported %d transactions into %s\n", len(journal), c.Journal)
+	return nil
+}
+
+func (t *tool) detectCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: goledger detect FILE...")
+	}
+	for _, path := range args {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		name := "unknown"
+		if f, ok := importer.Detect(data); ok {
+			name = f.Name
+		}
+		fmt.Fprintf(t.stdout, "%s: %s\n", path, name)
+	}
+	return nil
+}
+
+func (t *tool) convertCommand(args []string) error {
+	flags := flag.NewFlagSet("convert", flag.ContinueOnError)
+	flags.SetOutput(t.stderr)
+	syntax := flags.String("syntax", "", "output syntax: hledger, ledger or beancount (default from configuration)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 2 {
+		return fmt.Errorf("usage: goledger convert [-syntax SYNTAX] FORMAT FILE...")
+	}
+	c, err := t.config()
+	if err != nil {
+		return err
+	}
+	if *syntax != "" {
+		c.Syntax = *syntax
+	}
+	renderer, err := c.renderer()
+	if err != nil {
+		return err
+	}
+	statements, err := t.parse(flags.Arg(0), flags.Args()[1:])
+	if err != nil {
+		return err
+	}
+	journal, err := convert(c, statements, nil)
+	if err != nil {
+		return err
+	}
+	return journal.Render(t.stdout, renderer)
+}
+
+func (t *tool) dedupeCommand(args []string) error {
+	flags := flag.NewFlagSet("dedupe", flag.ContinueOnError)
+	flags.SetOutput(t.stderr)
+	mark := flags.Bool("mark", false, "record the new transactions as imported")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 2 {
+		return fmt.Errorf("usage: goledger dedupe [-mark] FORMAT FILE...")
+	}
+
+	c, err := t.config()
+	if err != nil {
+		return err
+	}
+	statements, err := t.parse(flags.Arg(0), flags.Args()[1:])
+	if err != nil {
+		return err
+	}
+	renderer, err := c.renderer()
+	if err != nil {
+		return err
+	}
+	state, err := openState(c)
+	if err != nil {
+		return err
+	}
+	journal, err := convert(c, statements, state)
+	if err != nil {
+		return err
+	}
+	if err := journal.Render(t.stdout, renderer); err != nil {
+		return err
+	}
+	if *mark {
+		return state.Commit()
+	}
+	return nil
+}
+
+func (t *tool) fmtCommand(args []string) error {
+	c, err := t.config()
+	if err != nil {
+		return err
+	}
+	if c.Syntax == "beancount" {
+		return fmt.Errorf("cannot format beancount journals")
+	}
+	if len(args) == 0 && c.Journal == "" {
+		return fmt.Errorf("usage: goledger fmt [FILE...]")
+	}
+	if len(args) == 0 {
+		args = []string{c.Journal}
+	}
+	renderer, err := c.renderer()
+	if err != nil {
+		return err
+	}
+	for _, path := range args {
+		if err := goledger.FormatJournalFile(path, renderer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *tool) portfolioCommand(args []string) error {
+	flags := flag.NewFlagSet("portfolio", flag.ContinueOnError)
+	flags.SetOutput(t.stderr)
+	syntax := flags.String("syntax", "", "output syntax: hledger, ledger or beancount (default from configuration)")
+	prices := flags.Bool("prices", false, "print the prices of the securities instead of the transactions")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: goledger portfolio [-syntax SYNTAX] [-prices] FILE...")
+	}
+	c, err := t.config()
+	if err != nil {
+		return err
+	}
+	if *syntax != "" {
+		c.Syntax = *syntax
+	}
+	renderer, err := c.renderer()
+	if err != nil {
+		return err
+	}
+	r, err := c.rules()
+	if err != nil {
+		return err
+	}
+	var journal goledger.Journal
+	var securityPrices []goledger.Price
+	for _, path := range flags.Args() {
+		client, err := importer.PortfolioParse(path)
+		if err != nil {
+			return err
+		}
+		if *prices {
+			securityPrices = append(securityPrices, rules.ConvertPortfolioPrices(client)...)
+			continue
+		}
+		transactions, err := r.ConvertPortfolio(client, rules.DefaultPortfolioAccounts)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		journal = append(journal, transactions...)
+	}
+	if *prices {
+		return renderPrices(t.stdout, securityPrices, renderer)
+	}
+	journal.Sort()
+	return journal.Render(t.stdout, renderer)
+}
+
+// renderPrices sorts the prices by date and renders them, if the renderer
+// supports prices.
+func renderPrices(w io.Writer, prices []goledger.Price, r goledger.Renderer) error {
+	pr, ok := r.(goledger.PriceRenderer)
+	if !ok {
+		return fmt.Errorf("cannot render prices in this syntax")
+	}
+	sort.SliceStable(prices, func(i, j int) bool {
+		return prices[i].Date.Before(prices[j].Date)
+	})
+	for i := range prices {
+		if err := prices[i].Render(w, pr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
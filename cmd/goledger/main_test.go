@@ -0,0 +1,158 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testTool runs the tool with the arguments, and returns its output.
+func testTool(args ...string) (stdout string, stderr string, err error) {
+	var out, errOut bytes.Buffer
+	t := tool{stdout: &out, stderr: &errOut}
+	err = t.run(args)
+	return out.String(), errOut.String(), err
+}
+
+// testConfig writes a configuration and a journal to a temporary directory,
+// and returns the path of the configuration.
+func testConfig(t *testing.T, config string, journal string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range map[string]string{"config.json": config, "main.journal": journal} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "config.json")
+}
+
+const testCAMT = "../../importer/testdata/camt053.xml"
+
+func TestImport(t *testing.T) {
+	// The journal uses constructs the parser does not support, which do not
+	// matter for the commodity styles
+	journal := "commodity 1.000,00 EUR\n\n2017/01/01 Buy\n    assets:depot  10 AAPL {{100 EUR}}\n    assets:bank:giro\n"
+	config := testConfig(t, `{"journal": "main.journal", "accounts": {"DE89370400440532013000": "assets:bank:giro"}}`, journal)
+	path := filepath.Join(filepath.Dir(config), "main.journal")
+
+	stdout, stderr, err := testTool("-config", config, "import", "-n", "camt", testCAMT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stdout, "2017/01/02=2017/01/03 * REWE Markt\n    ; id: REF1\n    assets:bank:giro  -12,50 EUR\n") {
+		t.Errorf("unexpected output of import -n:\n%s", stdout)
+	}
+	if data, _ := os.ReadFile(path); string(data) != journal || stderr != "" {
+		t.Errorf("import -n changed the journal, or wrote %q", stderr)
+	}
+
+	if _, stderr, err = testTool("-config", config, "import", "camt", testCAMT); err != nil {
+		t.Fatal(err)
+	}
+	if stderr != "goledger: imported 8 transactions into "+path+"\n" {
+		t.Errorf("got %q", stderr)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), journal+"\n2017/01/02=2017/01/03 * REWE Markt\n") || strings.Count(string(data), "; id: ") != 8 {
+		t.Errorf("unexpected journal:\n%s", data)
+	}
+
+	// Nothing is imported twice
+	if _, stderr, err = testTool("-config", config, "import", "auto", testCAMT); err != nil || stderr != "" {
+		t.Errorf("imported again: %q, %v", stderr, err)
+	}
+	if again, _ := os.ReadFile(path); !bytes.Equal(again, data) {
+		t.Errorf("journal changed when importing again:\n%s", again)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	config := testConfig(t, `{"journal": "main.journal", "syntax": "beancount"}`, "")
+	stdout, _, err := testTool("-config", config, "convert", "camt", testCAMT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stdout, "2017-01-02 * \"REWE Markt\"\n  valuta: 2017-01-03\n  import-id: \"REF1\"\n  Assets:Unknown  -12.50 EUR\n") {
+		t.Errorf("unexpected output:\n%s", stdout)
+	}
+
+	// Files with skipped records are only converted with -lenient
+	if _, _, err := testTool("-config", config, "convert", "mt940", "../../importer/testdata/mt940.sta"); err == nil || !strings.Contains(err.Error(), "record 22") {
+		t.Errorf("got error %v, want one about record 22", err)
+	}
+	stdout, stderr, err := testTool("-config", config, "-lenient", "convert", "-syntax", "ledger", "mt940", "../../importer/testdata/mt940.sta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stderr, "skipping: record 22") || strings.Count(stdout, "; id: ") != 3 {
+		t.Errorf("unexpected output:\n%s\nand errors:\n%s", stdout, stderr)
+	}
+}
+
+func TestDetect(t *testing.T) {
+	stdout, _, err := testTool("-config", testConfig(t, "{}", ""), "detect", testCAMT, "main_test.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := testCAMT + ": camt\nmain_test.go: unknown\n"; stdout != want {
+		t.Errorf("got %q, want %q", stdout, want)
+	}
+}
+
+func TestFmt(t *testing.T) {
+	config := testConfig(t, `{"journal": "main.journal", "amount-column": 30}`, "2017/01/02 Test\n  a   1 EUR\n  b\n")
+	if _, _, err := testTool("-config", config, "fmt"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(config), "main.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "2017/01/02 Test\n    a                 1.00 EUR\n    b\n"; string(data) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", data, want)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	config := testConfig(t, `{"journal": "main.journal"}`, "")
+	for _, test := range []struct {
+		args []string
+		err  string
+	}{
+		{nil, errUsage.Error()},
+		{[]string{"-config", config, "unknown"}, errUsage.Error()},
+		{[]string{"-config", config, "import", "camt"}, "usage: goledger import"},
+		{[]string{"-config", config, "import", "unknown", testCAMT}, `unknown format "unknown"`},
+		{[]string{"-config", config, "convert", "camt", "main_test.go"}, "main_test.go"},
+		{[]string{"-config", filepath.Join(filepath.Dir(config), "missing.json"), "convert", "camt", testCAMT}, "missing.json"},
+		{[]string{"-config", testConfig(t, `{"syntax": "gnucash"}`, ""), "convert", "camt", testCAMT}, `unknown syntax "gnucash"`},
+	} {
+		_, _, err := testTool(test.args...)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: got error %v, want %q", test.args, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package goledger
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Sort sorts the journal by date, keeping the order of transactions on the
+// same day.
+func (j Journal) Sort() {
+	sort.SliceStable(j, func(a, b int) bool {
+		dateA, _ := j[a].dates()
+		dateB, _ := j[b].dates()
+		return dateA.Before(dateB)
+	})
+}
+
+// FormatJournal reformats the journal read from r and writes it to w. The
+// transactions are rendered by renderer, while everything else, like
+// directives and comments between transactions, is copied verbatim.
+// Included files are not formatted.
+//
+// Transactions are not balanced, so elided amounts stay elided, but the
+// renderer refuses to render unbalanced transactions unless configured to.
+func FormatJournal(r io.Reader, w io.Writer, renderer Renderer) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return formatJournal("", data, w, renderer)
+}
+
+// formatJournal formats the journal data read from path, see FormatJournal.
+func formatJournal(path string, data []byte, w io.Writer, renderer Renderer) error {
+	p := newParser()
+	p.path = path
+	p.skipIncludes = true
+	if err := p.parse(bytes.NewReader(data)); err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1024*1024)
+	next := 0
+	for line := 1; scanner.Scan(); line++ {
+		switch {
+		case next < len(p.spans) && line == p.spans[next].first:
+			var b strings.Builder
+			if err := renderer.RenderTransaction(&b, &p.journal[next]); err != nil {
+				return err
+			}
+			// The renderer separates transactions by an empty line, but
+			// the separators are copied verbatim.
+			if _, err := bw.WriteString(strings.TrimSuffix(b.String(), "\n")); err != nil {
+				return err
+			}
+		case next < len(p.spans) && line > p.spans[next].first && line <= p.spans[next].last:
+		default:
+			if _, err := bw.WriteString(strings.TrimRight(scanner.Text(), "\r") + "\n"); err != nil {
+				return err
+			}
+		}
+		if next < len(p.spans) && line == p.spans[next].last {
+			next++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// FormatJournalFile reformats the journal file at path in place, see
+// FormatJournal. The file is replaced atomically.
+func FormatJournalFile(path string, renderer Renderer) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, func(w io.Writer) error {
+		return formatJournal(path, data, w, renderer)
+	})
+}
@@ -0,0 +1,114 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package goledger
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFormatJournal(t *testing.T) {
+	journal := `; A comment
+commodity 1.000,00 EUR
+
+2017/01/02 * Buy   ; note
+  assets:depot   10 AAPL {12,34 EUR} @ 13 EUR
+  assets:bank
+
+; Between transactions
+2017/01/03 Exchange
+	assets:cash  -10 USD @@ 9 EUR
+	assets:bank
+`
+	want := `; A comment
+commodity 1.000,00 EUR
+
+2017/01/02 * Buy
+    ; note
+    assets:depot  10.00 AAPL {12,34 EUR} @ 13,00 EUR
+    assets:bank
+
+; Between transactions
+2017/01/03 Exchange
+    assets:cash  -10.00 USD @@ 9,00 EUR
+    assets:bank
+`
+	styles, err := ParseCommodityStyles(strings.NewReader(journal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []Renderer{HledgerRenderer{Styles: styles}, LedgerRenderer{Styles: styles}} {
+		var b strings.Builder
+		if err := FormatJournal(strings.NewReader(journal), &b, r); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != want {
+			t.Errorf("%T: got:\n%s\nwant:\n%s", r, b.String(), want)
+		}
+	}
+}
+
+func TestFormatJournalUnbalanced(t *testing.T) {
+	journal := "2017/01/02 Unbalanced\n    a  1 EUR\n    b  -2 EUR\n"
+	var b strings.Builder
+	if err := FormatJournal(strings.NewReader(journal), &b, HledgerRenderer{}); err == nil {
+		t.Errorf("expected an error, got:\n%s", b.String())
+	}
+}
+
+func TestAmountColumn(t *testing.T) {
+	journal := `2017/01/02 Test
+    a  1 EUR
+    bb  -1000 EUR = 5 EUR
+    c
+2017/01/03 Long
+    assets:a:very:long:account:name  1 EUR @ 2 USD
+    b  -2 USD
+`
+	for _, test := range []struct {
+		column int
+		want   string
+	}{
+		{0, `2017/01/02 Test
+    a  1.00 EUR
+    bb  -1000.00 EUR = 5.00 EUR
+    c
+
+2017/01/03 Long
+    assets:a:very:long:account:name  1.00 EUR @ 2.00 USD
+    b  -2.00 USD
+
+`},
+		// Amounts end at the column, or further right if one does not fit
+		{24, `2017/01/02 Test
+    a           1.00 EUR
+    bb      -1000.00 EUR = 5.00 EUR
+    c
+
+2017/01/03 Long
+    assets:a:very:long:account:name  1.00 EUR @ 2.00 USD
+    b                               -2.00 USD
+
+`},
+	} {
+		got := renderJournal(t, journal, HledgerRenderer{AmountColumn: test.column})
+		if got != test.want {
+			t.Errorf("column %d: got:\n%s\nwant:\n%s", test.column, got, test.want)
+		}
+	}
+}
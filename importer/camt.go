@@ -0,0 +1,478 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package importer
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// camtDocument is an ISO 20022 CAMT.052 (account report) or CAMT.053
+// (statement) document. Namespaces are ignored, so all versions of the
+// messages are accepted.
+type camtDocument struct {
+	XMLName    xml.Name        `xml:"Document"`
+	Statements []camtStatement `xml:"BkToCstmrStmt>Stmt"`
+	Reports    []camtStatement `xml:"BkToCstmrAcctRpt>Rpt"`
+}
+
+type camtStatement struct {
+	IBAN     string        `xml:"Acct>Id>IBAN"`
+	Other    string        `xml:"Acct>Id>Othr>Id"`
+	Balances []camtBalance `xml:"Bal"`
+	Entries  []camtEntry   `xml:"Ntry"`
+}
+
+type camtBalance struct {
+	Code        string     `xml:"Tp>CdOrPrtry>Cd"`
+	Amount      camtAmount `xml:"Amt"`
+	CreditDebit string     `xml:"CdtDbtInd"`
+	Date        camtDate   `xml:"Dt"`
+}
+
+type camtAmount struct {
+	Value    string `xml:",chardata"`
+	Currency string `xml:"Ccy,attr"`
+}
+
+type camtDate struct {
+	Date     string `xml:"Dt"`
+	DateTime string `xml:"DtTm"`
+}
+
+// camtStatus is the status of an entry, which is either a plain code, or
+// a code in a Cd element in newer versions.
+type camtStatus struct {
+	Text string `xml:",chardata"`
+	Code string `xml:"Cd"`
+}
+
+type camtParty struct {
+	Name      string `xml:"Nm"`
+	PartyName string `xml:"Pty>Nm"`
+}
+
+type camtEntry struct {
+	Amount             camtAmount        `xml:"Amt"`
+	CreditDebit        string            `xml:"CdtDbtInd"`
+	Status             camtStatus        `xml:"Sts"`
+	BookingDate        camtDate          `xml:"BookgDt"`
+	ValueDate          camtDate          `xml:"ValDt"`
+	AccountServicerRef string            `xml:"AcctSvcrRef"`
+	AdditionalInfo     string            `xml:"AddtlNtryInf"`
+	Details            []camtEntryDetail `xml:"NtryDtls>TxDtls"`
+}
+
+type camtEntryDetail struct {
+	AccountServicerRef string     `xml:"Refs>AcctSvcrRef"`
+	Amount             camtAmount `xml:"Amt"`
+	TransactionAmount  camtAmount `xml:"AmtDtls>TxAmt>Amt"`
+	Debtor             camtParty  `xml:"RltdPties>Dbtr"`
+	DebtorIBAN         string     `xml:"RltdPties>DbtrAcct>Id>IBAN"`
+	UltimateDebtor     camtParty  `xml:"RltdPties>UltmtDbtr"`
+	Creditor           camtParty  `xml:"RltdPties>Cdtr"`
+	CreditorIBAN       string     `xml:"RltdPties>CdtrAcct>Id>IBAN"`
+	UltimateCreditor   camtParty  `xml:"RltdPties>UltmtCdtr"`
+	Unstructured       []string   `xml:"RmtInf>Ustrd"`
+	StructuredRef      string     `xml:"RmtInf>Strd>CdtrRefInf>Ref"`
+	AdditionalInfo     string     `xml:"AddtlTxInf"`
+}
+
+// camtTransaction is a transaction in a CAMT document.
+type camtTransaction struct {
+	// id is the reference of the bank, if any, see ID
+	id string
+	// detail is the position of the transaction in a batch entry, counting
+	// from 1, or 0 if the transaction is not part of one
+	detail        int
+	occurrence    int
+	localAccount  string
+	remoteAccount string
+	remoteName    []string
+	purposes      []string
+	amount        decimal.Decimal
+	currency      string
+	date          time.Time
+	valutaDate    time.Time
+	pending       bool
+}
+
+// ID returns the reference the bank assigned to the transaction
+// (AcctSvcrRef), or a hash of the transaction. The end-to-end ID is not
+// used, as payers reuse it, for example for all payments of a standing
+// order. Transactions of batch entries without a reference of their own
+// get the reference or hash followed by their position in the batch.
+func (t camtTransaction) ID() string {
+	id := t.id
+	if id == "" {
+		id = hashID(t, t.occurrence)
+	}
+	if t.detail != 0 {
+		id += "-" + strconv.Itoa(t.detail)
+	}
+	return id
+}
+
+func (t *camtTransaction) setOccurrence(n int) {
+	t.occurrence = n
+}
+
+func (t camtTransaction) Category() Category {
+	return CategoryMisc
+}
+
+// LocalAccount returns an ID of the local account.
+func (t camtTransaction) LocalAccount() string {
+	return t.localAccount
+}
+
+// RemoteAccount returns an ID of the remote account (IBAN).
+func (t camtTransaction) RemoteAccount() string {
+	return t.remoteAccount
+}
+
+// RemoteName returns a name of the other account.
+func (t camtTransaction) RemoteName() string {
+	return strings.Join(t.remoteName, "")
+}
+
+// ReferenceText returns a description of the transaction.
+func (t camtTransaction) ReferenceText() string {
+	return strings.Join(t.purposes, "")
+}
+
+// Amount returns the amount of the transaction.
+func (t camtTransaction) Amount() decimal.Decimal {
+	return t.amount
+}
+
+// Date returns the booking date of the transaction.
+func (t camtTransaction) Date() time.Time {
+	return t.date
+}
+
+// ValutaDate returns the value date of the transaction.
+func (t camtTransaction) ValutaDate() time.Time {
+	return t.valutaDate
+}
+
+// Currency returns a currency code for the account.
+func (t camtTransaction) Currency() string {
+	return t.currency
+}
+
+// RemoteNames is like RemoteName() but exposes the slice
+func (t camtTransaction) RemoteNames() []string {
+	return t.remoteName
+}
+
+// Purposes is like Purpose() but exposes the slice
+func (t camtTransaction) Purposes() []string {
+	return t.purposes
+}
+
+// Pending returns true for entries with the status PDNG.
+func (t camtTransaction) Pending() bool {
+	return t.pending
+}
+
+func (p camtParty) name() string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return p.PartyName
+}
+
+func (s camtStatus) code() string {
+	if s.Code != "" {
+		return strings.TrimSpace(s.Code)
+	}
+	return strings.TrimSpace(s.Text)
+}
+
+func (d camtDate) parse() (time.Time, error) {
+	switch {
+	case d.Date != "":
+		return time.Parse("2006-01-02", strings.TrimSpace(d.Date))
+	case d.DateTime != "":
+		value := strings.TrimSpace(d.DateTime)
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999"} {
+			if date, err := time.Parse(layout, value); err == nil {
+				return date, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("could not parse date time")
+	default:
+		return time.Time{}, nil
+	}
+}
+
+func (a camtAmount) parse() (decimal.Decimal, error) {
+	return decimal.NewFromString(strings.TrimSpace(a.Value))
+}
+
+func (b camtBalance) parse() (*Balance, *ParseError) {
+	var balance Balance
+	var err error
+	if balance.Amount, err = b.Amount.parse(); err != nil {
+		return nil, &ParseError{Column: "Bal/Amt", Value: b.Amount.Value, Err: err}
+	}
+	if strings.TrimSpace(b.CreditDebit) == "DBIT" {
+		balance.Amount = balance.Amount.Neg()
+	}
+	if balance.Date, err = b.Date.parse(); err != nil {
+		return nil, &ParseError{Column: "Bal/Dt", Value: b.Date.Date + b.Date.DateTime, Err: err}
+	}
+	balance.Currency = b.Amount.Currency
+	return &balance, nil
+}
+
+// camtStatementBalances fills in the balances of the statement. The opening
+// balance is the opening booked (OPBD) or previously closed booked (PRCD)
+// balance, the closing balance the closing booked (CLBD) or, in reports,
+// the interim booked (ITBD) balance, and the available balance the closing
+// (CLAV) or interim (ITAV) available one.
+func camtStatementBalances(statement *Statement, s *camtStatement) ParseErrors {
+	var errs ParseErrors
+	for _, b := range s.Balances {
+		var target **Balance
+		code := strings.TrimSpace(b.Code)
+		switch code {
+		case "OPBD", "PRCD":
+			target = &statement.Opening
+		case "CLBD", "ITBD":
+			target = &statement.Closing
+		case "CLAV", "ITAV":
+			target = &statement.Available
+		default:
+			continue
+		}
+		balance, perr := b.parse()
+		if perr != nil {
+			errs = append(errs, perr)
+			continue
+		}
+		// Prefer the final balances over the interim ones
+		interim := code == "ITBD" || code == "ITAV"
+		if *target == nil || !interim {
+			*target = balance
+		}
+	}
+	return errs
+}
+
+// camtReference returns the reference ref, or "" if it is empty or NONREF.
+func camtReference(ref string) string {
+	if ref = strings.TrimSpace(ref); ref == "NONREF" {
+		return ""
+	}
+	return ref
+}
+
+// camtEntryTransactions converts an entry into transactions. Batch entries
+// with multiple details are split up into one transaction per detail.
+func camtEntryTransactions(s *camtStatement, e *camtEntry) ([]Transaction, *ParseError) {
+	var err error
+	var base camtTransaction
+
+	base.localAccount = s.IBAN
+	if base.localAccount == "" {
+		base.localAccount = s.Other
+	}
+	base.id = camtReference(e.AccountServicerRef)
+	base.pending = e.Status.code() == "PDNG"
+	base.currency = e.Amount.Currency
+	if base.amount, err = e.Amount.parse(); err != nil {
+		return nil, &ParseError{Column: "Amt", Value: e.Amount.Value, Err: err}
+	}
+	if base.date, err = e.BookingDate.parse(); err != nil {
+		return nil, &ParseError{Column: "BookgDt", Value: e.BookingDate.Date + e.BookingDate.DateTime, Err: err}
+	}
+	if base.valutaDate, err = e.ValueDate.parse(); err != nil {
+		return nil, &ParseError{Column: "ValDt", Value: e.ValueDate.Date + e.ValueDate.DateTime, Err: err}
+	}
+	if base.date.IsZero() {
+		base.date = base.valutaDate
+	}
+	if base.valutaDate.IsZero() {
+		base.valutaDate = base.date
+	}
+	debit := strings.TrimSpace(e.CreditDebit) == "DBIT"
+	if debit {
+		base.amount = base.amount.Neg()
+	}
+
+	if len(e.Details) == 0 {
+		if e.AdditionalInfo != "" {
+			base.purposes = []string{e.AdditionalInfo}
+		}
+		return []Transaction{&base}, nil
+	}
+
+	// References of details are only used if they are unique in the entry
+	references := make(map[string]int)
+	for i := range e.Details {
+		references[camtReference(e.Details[i].AccountServicerRef)]++
+	}
+
+	var transactions []Transaction
+	for i := range e.Details {
+		d := &e.Details[i]
+		t := base
+		switch ref := camtReference(d.AccountServicerRef); {
+		case ref != "" && references[ref] == 1 && (ref != base.id || len(e.Details) == 1):
+			t.id = ref
+		case len(e.Details) > 1:
+			t.detail = i + 1
+		}
+
+		amount := d.TransactionAmount
+		if amount.Value == "" {
+			amount = d.Amount
+		}
+		if amount.Value != "" && len(e.Details) > 1 {
+			if t.amount, err = amount.parse(); err != nil {
+				return nil, &ParseError{Column: "TxDtls/Amt", Value: amount.Value, Err: err}
+			}
+			if amount.Currency != "" {
+				t.currency = amount.Currency
+			}
+			if debit {
+				t.amount = t.amount.Neg()
+			}
+		}
+
+		remote, ultimate := d.Debtor, d.UltimateDebtor
+		t.remoteAccount = d.DebtorIBAN
+		if debit {
+			remote, ultimate = d.Creditor, d.UltimateCreditor
+			t.remoteAccount = d.CreditorIBAN
+		}
+		if name := ultimate.name(); name != "" {
+			t.remoteName = []string{name}
+		} else if name := remote.name(); name != "" {
+			t.remoteName = []string{name}
+		}
+
+		t.purposes = append([]string{}, d.Unstructured...)
+		if len(t.purposes) == 0 && d.StructuredRef != "" {
+			t.purposes = []string{d.StructuredRef}
+		}
+		if len(t.purposes) == 0 && d.AdditionalInfo != "" {
+			t.purposes = []string{d.AdditionalInfo}
+		}
+		if len(t.purposes) == 0 && e.AdditionalInfo != "" {
+			t.purposes = []string{e.AdditionalInfo}
+		}
+		transactions = append(transactions, &t)
+	}
+	return transactions, nil
+}
+
+func init() {
+	Register(Format{
+		Name: "camt",
+		Detect: func(data []byte) bool {
+			return detectXMLRoot(data, "Document", "camt.05")
+		},
+		Parse:           CAMTParse,
+		ParseStatements: CAMTParseStatements,
+	})
+}
+
+// CAMTParseFile parses an ISO 20022 CAMT.053 bank statement or a CAMT.052
+// account report file, see CAMTParse.
+func CAMTParseFile(path string) (transactions []Transaction, err error) {
+	err = withFile(path, func(r io.Reader) error {
+		transactions, err = CAMTParse(r)
+		return err
+	})
+	return transactions, err
+}
+
+// CAMTParseStatementsFile parses an ISO 20022 CAMT.053 bank statement or a
+// CAMT.052 account report file, see CAMTParseStatements.
+func CAMTParseStatementsFile(path string) (statements []Statement, err error) {
+	err = withFile(path, func(r io.Reader) error {
+		statements, err = CAMTParseStatements(r)
+		return err
+	})
+	return statements, err
+}
+
+// CAMTParseStatements parses the statements (Stmt) in an ISO 20022
+// CAMT.053 bank statement or the reports (Rpt) in a CAMT.052 account
+// report, including their balances. Entries that are not booked yet have
+// Pending() set.
+//
+// Entries and balances that cannot be parsed are skipped and reported in a
+// ParseErrors error, along with the other statements; the record number
+// of an entry is the number of the entry (Ntry) in the document.
+func CAMTParseStatements(r io.Reader) ([]Statement, error) {
+	var document camtDocument
+	if err := xml.NewDecoder(r).Decode(&document); err != nil {
+		return nil, &ParseError{Err: err}
+	}
+
+	var result []Statement
+	var errs ParseErrors
+	n := 0
+	for _, statements := range [][]camtStatement{document.Statements, document.Reports} {
+		for i := range statements {
+			statement := Statement{LocalAccount: statements[i].IBAN}
+			if statement.LocalAccount == "" {
+				statement.LocalAccount = statements[i].Other
+			}
+			errs = append(errs, camtStatementBalances(&statement, &statements[i])...)
+			for j := range statements[i].Entries {
+				n++
+				ts, perr := camtEntryTransactions(&statements[i], &statements[i].Entries[j])
+				if perr != nil {
+					perr.Record = n
+					errs = append(errs, perr)
+					continue
+				}
+				statement.Transactions = append(statement.Transactions, ts...)
+			}
+			numberOccurrences(statement.Transactions)
+			result = append(result, statement)
+		}
+	}
+	return result, errs.result()
+}
+
+// CAMTParse parses an ISO 20022 CAMT.053 bank statement or a CAMT.052
+// account report. Entries that are not booked yet have Pending() set.
+//
+// Entries that cannot be parsed are skipped and reported in a ParseErrors
+// error, along with the other transactions; their record number is the
+// number of the entry (Ntry) in the document.
+func CAMTParse(r io.Reader) ([]Transaction, error) {
+	statements, err := CAMTParseStatements(r)
+	var transactions []Transaction
+	for _, s := range statements {
+		transactions = append(transactions, s.Transactions...)
+	}
+	return transactions, err
+}
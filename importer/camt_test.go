@@ -0,0 +1,54 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package importer
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCAMTParse(t *testing.T) {
+	data, err := os.ReadFile("testdata/camt053.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, ok := Detect(data); !ok || f.Name != "camt" {
+		t.Errorf("detected %q, want camt", f.Name)
+	}
+	statements, err := CAMTParseStatementsFile("testdata/camt053.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statements) != 1 {
+		t.Fatalf("got %d statements, want 1", len(statements))
+	}
+	checkStatement(t, statements[0], "DE89370400440532013000", "2017-01-01 -10 EUR", "2017-01-04 49.5 EUR", "2017-01-04 52 EUR")
+	checkTransactions(t, statements[0].Transactions, []string{
+		"REF1|2017-01-02|2017-01-03|DE89370400440532013000|REWE Markt|DE02100100100006820101|Line 1 Line 2|-12.5|EUR",
+		// Batch entries are split into their transaction details
+		"576bbf5c35c145e87bec31eebbed4f1938ec0eb9c066430b6531ffc4d8da8546-1|2017-01-04|2017-01-04|DE89370400440532013000|Alice|||60|EUR|pending",
+		"ed14a0e95c141f32577e44a2b2b69868bdb93e778176fca49a2b7de9ea48a7e5-2|2017-01-04|2017-01-04|DE89370400440532013000|Bob|||40|EUR|pending",
+		// Details without a unique reference of their own are numbered,
+		// even if they have the same end-to-end ID
+		"TX-A|2017-01-04|2017-01-04|DE89370400440532013000|Carol|||-5|EUR",
+		"BATCH1-2|2017-01-04|2017-01-04|DE89370400440532013000|Dave|||-10|EUR",
+		"BATCH1-3|2017-01-04|2017-01-04|DE89370400440532013000|Dave|||-10|EUR",
+		"BATCH1-4|2017-01-04|2017-01-04|DE89370400440532013000|Eve|||-1|EUR",
+		"BATCH1-5|2017-01-04|2017-01-04|DE89370400440532013000|Eve|||-2|EUR",
+	})
+}
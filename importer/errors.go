@@ -0,0 +1,123 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package importer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ParseError describes an error parsing a file, or a record in it.
+type ParseError struct {
+	// Path of the file, if known
+	Path string
+	// Record is the line or record number, starting at 1, or 0 if the
+	// error is not about a specific record.
+	Record int
+	// Column is the name of the column or field, and Value its raw
+	// value, if the error is about a specific value.
+	Column string
+	Value  string
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	var parts []string
+	if e.Path != "" {
+		parts = append(parts, e.Path)
+	}
+	if e.Record != 0 {
+		parts = append(parts, fmt.Sprintf("record %d", e.Record))
+	}
+	if e.Column != "" {
+		parts = append(parts, e.Column)
+	}
+	if e.Value != "" || e.Column != "" {
+		parts = append(parts, fmt.Sprintf("invalid value %q", e.Value))
+	}
+	return strings.Join(append(parts, e.Err.Error()), ": ")
+}
+
+// Unwrap returns the underlying error.
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// ParseErrors is returned by parsers if records had to be skipped because
+// they could not be parsed. The transactions of all other records are still
+// returned along with it.
+//
+// Callers that want to fail on malformed input can treat it like any other
+// error; lenient callers can use Lenient to continue with the transactions
+// that were parsed.
+type ParseErrors []*ParseError
+
+func (e ParseErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", e[0].Error(), len(e)-1)
+}
+
+// Lenient splits an error returned by a parser into the errors about the
+// records that were skipped, and a remaining fatal error, if any. If the
+// fatal error is nil, the transactions returned by the parser can be used.
+func Lenient(err error) (ParseErrors, error) {
+	var errs ParseErrors
+	if errors.As(err, &errs) {
+		return errs, nil
+	}
+	return nil, err
+}
+
+// setPath sets the path of ParseError and ParseErrors errors.
+func setPath(err error, path string) error {
+	switch err := err.(type) {
+	case *ParseError:
+		err.Path = path
+	case ParseErrors:
+		for _, e := range err {
+			e.Path = path
+		}
+	}
+	return err
+}
+
+// withFile opens the file at path and calls parse with it. Errors returned
+// by parse get the path set.
+func withFile(path string, parse func(r io.Reader) error) error {
+	r, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		r.Close()
+	}()
+	return setPath(parse(r), path)
+}
+
+// result returns the errors as an error, or nil if there are none.
+func (e ParseErrors) result() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
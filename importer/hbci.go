@@ -19,10 +19,9 @@ package importer
 
 import (
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -41,6 +40,8 @@ type hbciTransaction struct {
 	valutaDate          time.Time
 	fiID                string
 	bankReference       string
+	noted               bool
+	occurrence          int
 }
 
 func (t hbciTransaction) ID() string {
@@ -50,7 +51,11 @@ func (t hbciTransaction) ID() string {
 	if t.bankReference != "" {
 		return t.bankReference
 	}
-	return hashTransaction(t)
+	return hashID(t, t.occurrence)
+}
+
+func (t *hbciTransaction) setOccurrence(n int) {
+	t.occurrence = n
 }
 
 func (t hbciTransaction) Category() Category {
@@ -115,119 +120,195 @@ func (t hbciTransaction) Purposes() []string {
 	return t.purposes
 }
 
-// HBCIParseFile parses a CSV file generated by acqbanking-cli listtrans.
-func HBCIParseFile(path string, parseNoted bool) ([]Transaction, error) {
-	fr, err := os.Open(path)
+// Pending returns true for noted statements, which are not booked yet.
+func (t hbciTransaction) Pending() bool {
+	return t.noted
+}
+
+// hbciParseDate parses a date in the given column.
+func hbciParseDate(record []string, columns map[string]int, column string) (time.Time, *ParseError) {
+	date, err := time.Parse("2006/01/02", record[columns[column]])
+	if err != nil {
+		return time.Time{}, &ParseError{Column: column, Value: record[columns[column]], Err: err}
+	}
+	return date, nil
+}
+
+// hbciParseValue parses the value, which is either a decimal number, or a
+// fraction like 1234/100.
+func hbciParseValue(value string) (decimal.Decimal, error) {
+	if !strings.Contains(value, "/") {
+		return decimal.NewFromString(value)
+	}
+	parts := strings.Split(value, "/")
+	if len(parts) != 2 {
+		return decimal.Zero, fmt.Errorf("expected a fraction")
+	}
+	a, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return decimal.Zero, err
+	}
+	b, err := strconv.Atoi(parts[1])
 	if err != nil {
-		return nil, err
+		return decimal.Zero, err
+	}
+	if b == 0 {
+		return decimal.Zero, fmt.Errorf("division by zero")
+	}
+	return decimal.New(int64(100)*int64(a)/int64(b), -2), nil
+}
+
+func hbciParseRecord(record []string, columns map[string]int) (*hbciTransaction, *ParseError) {
+	var t hbciTransaction
+	var err error
+	var perr *ParseError
+
+	t.fiID = record[columns["fiId"]]
+	t.noted = record[columns["type"]] == "notedStatement"
+	t.bankReference = record[columns["bankReference"]]
+	t.localAccountNumber = record[columns["localIban"]]
+	t.remoteAccountNumber = record[columns["remoteIban"]]
+
+	if t.remoteAccountNumber == "" {
+		t.remoteAccountNumber = record[columns["remoteAccountNumber"]]
+	}
+	if t.localAccountNumber == "" {
+		t.localAccountNumber = record[columns["localAccountNumber"]]
 	}
-	defer func() {
-		fr.Close()
-	}()
 
+	if t.valueValue, err = hbciParseValue(record[columns["value_value"]]); err != nil {
+		return nil, &ParseError{Column: "value_value", Value: record[columns["value_value"]], Err: err}
+	}
+	t.valueCurrency = record[columns["value_currency"]]
+	if t.valueCurrency == "" {
+		t.valueCurrency = "EUR"
+	}
+	t.remoteName = append(t.remoteName, record[columns["remoteName"]])
+	for i := 1; columns["remoteName"+strconv.Itoa(i)] != 0; i++ {
+		if record[columns["remoteName"+strconv.Itoa(i)]] != "" {
+			t.remoteName = append(t.remoteName, record[columns["remoteName"+strconv.Itoa(i)]])
+		}
+	}
+
+	if record[columns["ultimateDebtor"]] != "" {
+		t.remoteName = append([]string{}, record[columns["ultimateDebtor"]])
+	}
+	if record[columns["ultimateCreditor"]] != "" {
+		t.remoteName = append([]string{}, record[columns["ultimateCreditor"]])
+	}
+	t.purposes = append(t.purposes, record[columns["purpose"]])
+	for i := 1; columns["purpose"+strconv.Itoa(i)] != 0; i++ {
+		if record[columns["purpose"+strconv.Itoa(i)]] != "" {
+			t.purposes = append(t.purposes, record[columns["purpose"+strconv.Itoa(i)]])
+		}
+	}
+
+	if t.date, perr = hbciParseDate(record, columns, "date"); perr != nil {
+		return nil, perr
+	}
+	if record[columns["transactionText"]] == "KARTENZAHLUNG" && len(t.purposes[0]) > 10 && t.purposes[0][10] == 'T' {
+		newDate, err := time.Parse("2006-01-02", t.purposes[0][:10])
+		if err == nil {
+			t.date = newDate
+		}
+	}
+	for _, column := range []string{"valutadate", "valutaDate"} {
+		if _, ok := columns[column]; ok && record[columns[column]] != "" {
+			if t.valutaDate, perr = hbciParseDate(record, columns, column); perr != nil {
+				return nil, perr
+			}
+		}
+	}
+	return &t, nil
+}
+
+func init() {
+	Register(Format{
+		Name:   "hbci",
+		Detect: hbciDetect,
+		Parse: func(r io.Reader) ([]Transaction, error) {
+			return HBCIParse(r, false)
+		},
+	})
+}
+
+// hbciDetect checks for a header with aqbanking's column names.
+func hbciDetect(data []byte) bool {
+	lines := firstLines(data, 1)
+	if len(lines) == 0 {
+		return false
+	}
+	columns := strings.Split(lines[0], ";")
+	for _, column := range columns {
+		column = strings.Trim(column, `"`)
+		if column == "localIban" || column == "value_value" {
+			return true
+		}
+	}
+	return false
+}
+
+// HBCIParseFile parses a CSV file generated by acqbanking-cli listtrans.
+func HBCIParseFile(path string, parseNoted bool) (transactions []Transaction, err error) {
+	err = withFile(path, func(r io.Reader) error {
+		transactions, err = HBCIParse(r, parseNoted)
+		return err
+	})
+	return transactions, err
+}
+
+// HBCIParse parses CSV data generated by acqbanking-cli listtrans.
+//
+// Records that cannot be parsed are skipped and reported in a ParseErrors
+// error, along with the other transactions.
+func HBCIParse(fr io.Reader, parseNoted bool) ([]Transaction, error) {
 	var transactions []Transaction
+	var errs ParseErrors
 
 	r := csv.NewReader(fr)
 	r.Comma = ';'
+	r.FieldsPerRecord = -1
 
-	record, err := r.Read()
+	header, err := r.Read()
 	if err != nil {
-		log.Fatal(err)
+		return nil, &ParseError{Record: 1, Err: err}
 	}
 
 	columns := make(map[string]int)
-	for i, s := range record {
+	for i, s := range header {
 		columns[s] = i
 	}
 
-	for {
+	for n := 2; ; n++ {
 		record, err := r.Read()
 		if err == io.EOF {
 			break
 		}
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		if record[columns["type"]] == "notedStatement" && !parseNoted {
+		var csvErr *csv.ParseError
+		if errors.As(err, &csvErr) {
+			errs = append(errs, &ParseError{Record: n, Err: err})
 			continue
 		}
-		var t hbciTransaction
-
-		t.fiID = record[columns["fiId"]]
-		t.bankReference = record[columns["bankReference"]]
-		t.localAccountNumber = record[columns["localIban"]]
-		t.remoteAccountNumber = record[columns["remoteIban"]]
-
-		if t.remoteAccountNumber == "" {
-			t.remoteAccountNumber = record[columns["remoteAccountNumber"]]
-		}
-		if t.localAccountNumber == "" {
-			t.localAccountNumber = record[columns["localAccountNumber"]]
-		}
-
-		if strings.Contains(record[columns["value_value"]], "/") {
-			parts := strings.Split(record[columns["value_value"]], "/")
-			a, err := strconv.Atoi(parts[0])
-			if err != nil {
-				panic(err)
-			}
-			b, err := strconv.Atoi(parts[1])
-			if err != nil {
-				panic(err)
-			}
-			t.valueValue = decimal.New(int64(100)*int64(a)/int64(b), -2)
-		} else {
-			(&t.valueValue).UnmarshalJSON([]byte(record[columns["value_value"]]))
-		}
-		t.valueCurrency = record[columns["value_currency"]]
-		if t.valueCurrency == "" {
-			t.valueCurrency = "EUR"
+		if err != nil {
+			return nil, &ParseError{Record: n, Err: err}
 		}
-		t.remoteName = append(t.remoteName, record[columns["remoteName"]])
-		for i := 1; columns["remoteName"+strconv.Itoa(i)] != 0; i++ {
-			if record[columns["remoteName"+strconv.Itoa(i)]] != "" {
-				t.remoteName = append(t.remoteName, record[columns["remoteName"+strconv.Itoa(i)]])
-			}
+		if len(record) < len(header) {
+			errs = append(errs, &ParseError{Record: n, Err: fmt.Errorf("expected %d fields, got %d", len(header), len(record))})
+			continue
 		}
 
-		if record[columns["ultimateDebtor"]] != "" {
-			t.remoteName = append([]string{}, record[columns["ultimateDebtor"]])
-		}
-		if record[columns["ultimateCreditor"]] != "" {
-			t.remoteName = append([]string{}, record[columns["ultimateCreditor"]])
-		}
-		t.purposes = append(t.purposes, record[columns["purpose"]])
-		for i := 1; columns["purpose"+strconv.Itoa(i)] != 0; i++ {
-			if record[columns["purpose"+strconv.Itoa(i)]] != "" {
-				t.purposes = append(t.purposes, record[columns["purpose"+strconv.Itoa(i)]])
-			}
+		if record[columns["type"]] == "notedStatement" && !parseNoted {
+			continue
 		}
 
-		t.date, err = time.Parse("2006/01/02", record[columns["date"]])
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Could not parse %s: %s\n", record[columns["date"]], err)
-		}
-		if record[columns["transactionText"]] == "KARTENZAHLUNG" && len(t.purposes[0]) > 10 && t.purposes[0][10] == 'T' {
-			newDate, err := time.Parse("2006-01-02", t.purposes[0][:10])
-			if err == nil {
-				t.date = newDate
-			}
-		}
-		if record[columns["valutadate"]] != "" {
-			t.valutaDate, err = time.Parse("2006/01/02", record[columns["valutadate"]])
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Could not parse %s: %s\n", record[columns["date"]], err)
-			}
-		}
-		if record[columns["valutaDate"]] != "" {
-			t.valutaDate, err = time.Parse("2006/01/02", record[columns["valutaDate"]])
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Could not parse %s: %s\n", record[columns["valutaDate"]], err)
-			}
+		t, perr := hbciParseRecord(record, columns)
+		if perr != nil {
+			perr.Record = n
+			errs = append(errs, perr)
+			continue
 		}
-		transactions = append(transactions, &t)
-
+		transactions = append(transactions, t)
 	}
-	return transactions, nil
+	numberOccurrences(transactions)
+	return transactions, errs.result()
 }
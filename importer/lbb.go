@@ -19,10 +19,9 @@ package importer
 
 import (
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	"os"
 	"regexp"
 	"strings"
 	"time"
@@ -41,10 +40,15 @@ type lbbTransaction struct {
 	ExchangeRate   float64
 	amount         decimal.Decimal
 	currency       string
+	occurrence     int
 }
 
 func (t lbbTransaction) ID() string {
-	return hashTransaction(t)
+	return hashID(t, t.occurrence)
+}
+
+func (t *lbbTransaction) setOccurrence(n int) {
+	t.occurrence = n
 }
 
 func (t lbbTransaction) Category() Category {
@@ -91,8 +95,18 @@ func (t lbbTransaction) Currency() string {
 	return t.currency
 }
 
-func lbbParseTransaction(record []string, t *lbbTransaction) bool {
+// lbbParseAmount parses an amount with a decimal comma.
+func lbbParseAmount(record []string, i int) (decimal.Decimal, *ParseError) {
+	amount, err := decimal.NewFromString(strings.Replace(record[i], ",", ".", 1))
+	if err != nil {
+		return decimal.Zero, &ParseError{Column: fmt.Sprintf("column %d", i+1), Value: record[i], Err: err}
+	}
+	return amount, nil
+}
+
+func lbbParseTransaction(record []string, t *lbbTransaction) *ParseError {
 	var err error
+	var perr *ParseError
 
 	t.CardNumber = record[0]
 	if t.CardNumber == "" {
@@ -100,32 +114,33 @@ func lbbParseTransaction(record []string, t *lbbTransaction) bool {
 	}
 	t.valutaDate, err = time.Parse("02.01.2006", record[1])
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not parse %s: %s\n", record[1], err)
+		return &ParseError{Column: "column 2", Value: record[1], Err: err}
 	}
 	if record[2] != "" {
 		t.date, err = time.Parse("02.01.2006", record[2])
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Could not parse %s: %s\n", record[2], err)
+			return &ParseError{Column: "column 3", Value: record[2], Err: err}
 		}
 	}
 	if len(record) > 8 {
 		t.currency = "EUR"
 		t.Merchant = record[3]
 
-		(&t.amount).UnmarshalJSON([]byte(strings.Replace(record[8], ",", ".", 1)))
+		if t.amount, perr = lbbParseAmount(record, 8); perr != nil {
+			return perr
+		}
 		t.amount = t.amount.Neg()
 		// FIXME: We should implement points here
 	} else if matched, _ := regexp.MatchString("[+-] .* (4-fache-Punkte-Aktion|AMAZON(.DE)? PUNKTE)", record[3]); matched {
 		var sign rune
 		var value int64
 		// New format
-		n, err := fmt.Sscanf(strings.TrimSpace(record[3]), "%c %d.0 AMAZON PUNKTE", &sign, &value)
+		n, _ := fmt.Sscanf(strings.TrimSpace(record[3]), "%c %d.0 AMAZON PUNKTE", &sign, &value)
 		if n != 2 {
 			// Old format
-			n2, err2 := fmt.Sscanf(strings.TrimSpace(record[3]), "%c %d.0 AMAZON.DE PUNKTE", &sign, &value)
+			n2, _ := fmt.Sscanf(strings.TrimSpace(record[3]), "%c %d.0 AMAZON.DE PUNKTE", &sign, &value)
 			if n2 != 2 {
-				fmt.Fprintf(os.Stderr, "Error parsing '%s': %s, %s\n", record[3], err, err2)
-				return false
+				return &ParseError{Column: "column 4", Value: record[3], Err: fmt.Errorf("could not parse Amazon points")}
 			}
 		}
 		t.amount = decimal.New(value, 0)
@@ -135,30 +150,59 @@ func lbbParseTransaction(record []string, t *lbbTransaction) bool {
 		t.currency = "A"
 		t.Merchant = "AMAZON PUNKTE"
 	} else {
+		if len(record) < 7 {
+			return &ParseError{Err: fmt.Errorf("expected at least 7 fields, got %d", len(record))}
+		}
 		t.currency = "EUR"
 		t.Merchant = record[3]
 
-		(&t.amount).UnmarshalJSON([]byte(strings.Replace(record[6], ",", ".", 1)))
+		if t.amount, perr = lbbParseAmount(record, 6); perr != nil {
+			return perr
+		}
+	}
+	return nil
+}
+
+func init() {
+	Register(Format{Name: "lbb", Detect: lbbDetect, Parse: LBBParse})
+}
+
+var lbbRecordRe = regexp.MustCompile(`^"?[0-9X* ]*"?;"?[0-9]{2}\.[0-9]{2}\.[0-9]{4}"?;`)
+
+// lbbDetect checks for a record starting with a card number and a date.
+func lbbDetect(data []byte) bool {
+	for _, line := range firstLines(data, 30) {
+		if lbbRecordRe.MatchString(line) {
+			return true
+		}
 	}
-	return true
+	return false
 }
 
 // LBBParseFile parses a CSV file generated by the Landesbank Berlin for their
 // Amazon credit cards.
-func LBBParseFile(path string) ([]Transaction, error) {
-	fr, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		fr.Close()
-	}()
+func LBBParseFile(path string) (transactions []Transaction, err error) {
+	err = withFile(path, func(r io.Reader) error {
+		transactions, err = LBBParse(r)
+		return err
+	})
+	return transactions, err
+}
 
+// LBBParse parses CSV data generated by the Landesbank Berlin for their
+// Amazon credit cards.
+//
+// Lines that do not start with a card number and a date are ignored. Other
+// records that cannot be parsed are skipped and reported in a ParseErrors
+// error, along with the other transactions.
+func LBBParse(fr io.Reader) ([]Transaction, error) {
 	var transactions []Transaction
+	var errs ParseErrors
 	var newstyle = false
 	r := csv.NewReader(fr)
 	r.Comma = ';'
-	for {
+	r.FieldsPerRecord = -1
+	for n := 1; ; n++ {
 		record, err := r.Read()
 		if len(record) > 8 {
 			newstyle = true
@@ -166,17 +210,27 @@ func LBBParseFile(path string) ([]Transaction, error) {
 		if err == io.EOF {
 			break
 		}
+		var csvErr *csv.ParseError
+		if errors.As(err, &csvErr) {
+			errs = append(errs, &ParseError{Record: n, Err: err})
+			continue
+		}
 		if err != nil {
-			log.Fatal("meow", err)
+			return nil, &ParseError{Record: n, Err: err}
 		}
 
+		if len(record) < 4 {
+			continue
+		}
 		_, err = time.Parse("02.01.2006", record[1])
 		if err != nil {
 			continue
 		}
 
 		var t lbbTransaction
-		if !lbbParseTransaction(record, &t) {
+		if perr := lbbParseTransaction(record, &t); perr != nil {
+			perr.Record = n
+			errs = append(errs, perr)
 			continue
 		}
 		transactions = append(transactions, &t)
@@ -188,5 +242,6 @@ func LBBParseFile(path string) ([]Transaction, error) {
 		}
 
 	}
-	return transactions, nil
+	numberOccurrences(transactions)
+	return transactions, errs.result()
 }
@@ -0,0 +1,443 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package importer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// mt940Transaction is a transaction in a SWIFT MT940 or MT942 file, that
+// is, a :61: field and the :86: field following it.
+type mt940Transaction struct {
+	localAccount  string
+	remoteAccount string
+	remoteBank    string
+	remoteName    []string
+	purposes      []string
+	bookingText   string
+	gvc           string
+	amount        decimal.Decimal
+	currency      string
+	date          time.Time
+	valutaDate    time.Time
+	bankReference string
+	occurrence    int
+}
+
+func (t mt940Transaction) ID() string {
+	if t.bankReference != "" && t.bankReference != "NONREF" {
+		return t.bankReference
+	}
+	return hashID(t, t.occurrence)
+}
+
+func (t *mt940Transaction) setOccurrence(n int) {
+	t.occurrence = n
+}
+
+func (t mt940Transaction) Category() Category {
+	return CategoryMisc
+}
+
+// LocalAccount returns an ID of the local account.
+func (t mt940Transaction) LocalAccount() string {
+	return t.localAccount
+}
+
+// RemoteAccount returns an ID of the remote account (IBAN). Old style
+// account numbers are returned together with the bank code, as in BLZ/KTO.
+func (t mt940Transaction) RemoteAccount() string {
+	if isDigits(t.remoteAccount) && t.remoteBank != "" {
+		return t.remoteBank + "/" + t.remoteAccount
+	}
+	return t.remoteAccount
+}
+
+// RemoteName returns a name of the other account.
+func (t mt940Transaction) RemoteName() string {
+	return strings.Join(t.remoteName, "")
+}
+
+// ReferenceText returns a description of the transaction.
+func (t mt940Transaction) ReferenceText() string {
+	return strings.Join(t.purposes, "")
+}
+
+// Amount returns the amount of the transaction.
+func (t mt940Transaction) Amount() decimal.Decimal {
+	return t.amount
+}
+
+// Date returns the date of the transaction.
+func (t mt940Transaction) Date() time.Time {
+	return t.date
+}
+
+// ValutaDate returns the date of the transaction.
+func (t mt940Transaction) ValutaDate() time.Time {
+	return t.valutaDate
+}
+
+// Currency returns a currency code for the account.
+func (t mt940Transaction) Currency() string {
+	return t.currency
+}
+
+// RemoteNames is like RemoteName() but exposes the slice
+func (t mt940Transaction) RemoteNames() []string {
+	return t.remoteName
+}
+
+// Purposes is like Purpose() but exposes the slice
+func (t mt940Transaction) Purposes() []string {
+	return t.purposes
+}
+
+// Pending returns false, as MT940 statements and MT942 interim reports
+// only contain booked transactions.
+func (t mt940Transaction) Pending() bool {
+	return false
+}
+
+// mt940Field is a field of a message, like :61:, with its content.
+type mt940Field struct {
+	tag   string
+	value string
+	line  int
+}
+
+var mt940FieldRe = regexp.MustCompile(`^:([0-9]{2}[A-Z]?):`)
+
+// mt940ReadFields reads the fields of all messages in the file. Lines not
+// starting with a tag continue the previous field.
+func mt940ReadFields(r io.Reader) ([]mt940Field, error) {
+	var fields []mt940Field
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimRight(scanner.Text(), "\r")
+		// Strip SWIFT block headers like {1:...}{2:...}{4:
+		if i := strings.Index(text, "{4:"); i != -1 {
+			text = text[i+3:]
+		}
+		switch {
+		case strings.TrimSpace(text) == "":
+			continue
+		case text == "-" || strings.HasPrefix(text, "-}") || strings.HasPrefix(text, "{"):
+			continue
+		case mt940FieldRe.MatchString(text):
+			m := mt940FieldRe.FindStringSubmatch(text)
+			fields = append(fields, mt940Field{m[1], text[len(m[0]):], line})
+		case len(fields) > 0:
+			fields[len(fields)-1].value += "\n" + text
+		default:
+			return nil, &ParseError{Record: line, Value: text, Err: fmt.Errorf("expected a field tag")}
+		}
+	}
+	return fields, scanner.Err()
+}
+
+// mt940ParseDate parses a date in the YYMMDD format.
+func mt940ParseDate(s string) (time.Time, error) {
+	date, err := time.Parse("060102", s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date")
+	}
+	return date, nil
+}
+
+// mt940ParseAmount parses an amount with a decimal comma.
+func mt940ParseAmount(s string) (decimal.Decimal, error) {
+	value, err := decimal.NewFromString(strings.Replace(strings.TrimSuffix(s, ","), ",", ".", 1))
+	if err != nil {
+		return decimal.Zero, fmt.Errorf("invalid amount")
+	}
+	return value, nil
+}
+
+var mt940BalanceRe = regexp.MustCompile(`^([CD])([0-9]{6})([A-Z]{3})([0-9]+,[0-9]*)`)
+
+// mt940ParseBalance parses balance fields like :60F: and :62F:.
+func mt940ParseBalance(s string) (*Balance, error) {
+	m := mt940BalanceRe.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return nil, fmt.Errorf("invalid balance")
+	}
+	var b Balance
+	var err error
+	if b.Date, err = mt940ParseDate(m[2]); err != nil {
+		return nil, err
+	}
+	if b.Amount, err = mt940ParseAmount(m[4]); err != nil {
+		return nil, err
+	}
+	if m[1] == "D" {
+		b.Amount = b.Amount.Neg()
+	}
+	b.Currency = m[3]
+	return &b, nil
+}
+
+// The :61: field consists of a value date, an optional booking date, the
+// debit/credit mark, the third letter of the currency code, the amount,
+// the transaction type, the customer reference, an optional bank reference,
+// and supplementary details on the next line.
+var mt940StatementLineRe = regexp.MustCompile(`^([0-9]{6})([0-9]{4})?(RC|RD|C|D)([A-Z])?([0-9]+,[0-9]*)([NFS][A-Z0-9]{3})([^\n]*?)(?://([^\n]*))?(?:\n((?s:.*)))?$`)
+
+func mt940ParseStatementLine(s string, t *mt940Transaction) error {
+	var err error
+	m := mt940StatementLineRe.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return fmt.Errorf("invalid statement line")
+	}
+	if t.valutaDate, err = mt940ParseDate(m[1]); err != nil {
+		return err
+	}
+	t.date = t.valutaDate
+	if m[2] != "" {
+		month, _ := strconv.Atoi(m[2][:2])
+		day, _ := strconv.Atoi(m[2][2:])
+		year := t.valutaDate.Year()
+		switch {
+		case month == 12 && t.valutaDate.Month() == time.January:
+			year--
+		case month == 1 && t.valutaDate.Month() == time.December:
+			year++
+		}
+		t.date = time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+		if t.date.Day() != day {
+			return fmt.Errorf("invalid booking date")
+		}
+	}
+	if t.amount, err = mt940ParseAmount(m[5]); err != nil {
+		return err
+	}
+	if m[3] == "D" || m[3] == "RC" {
+		t.amount = t.amount.Neg()
+	}
+	t.bankReference = strings.TrimSpace(m[8])
+	return nil
+}
+
+var mt940SubfieldRe = regexp.MustCompile(`\?([0-9]{2})`)
+
+// mt940ParseInformation parses the :86: field. If it is structured in the
+// German format, the business transaction code (GVC) is followed by sub
+// fields like ?20 to ?29 for the purpose, ?30 and ?31 for the bank code
+// and account of the other party, and ?32 and ?33 for its name.
+func mt940ParseInformation(s string, t *mt940Transaction) {
+	joined := strings.Replace(s, "\n", "", -1)
+	if len(joined) < 4 || !isDigits(joined[:3]) || joined[3] != '?' {
+		for _, line := range strings.Split(s, "\n") {
+			if line != "" {
+				t.purposes = append(t.purposes, line)
+			}
+		}
+		return
+	}
+
+	t.gvc = joined[:3]
+	matches := mt940SubfieldRe.FindAllStringSubmatchIndex(joined, -1)
+	for i, m := range matches {
+		end := len(joined)
+		if i+1 < len(matches) {
+			end = matches[i+1][0]
+		}
+		value := joined[m[1]:end]
+		code, _ := strconv.Atoi(joined[m[2]:m[3]])
+		switch {
+		case code == 0:
+			t.bookingText = value
+		case code >= 20 && code <= 29, code >= 60 && code <= 63:
+			if value != "" {
+				t.purposes = append(t.purposes, value)
+			}
+		case code == 30:
+			t.remoteBank = value
+		case code == 31:
+			t.remoteAccount = value
+		case code == 32 || code == 33:
+			if value != "" {
+				t.remoteName = append(t.remoteName, value)
+			}
+		}
+	}
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func init() {
+	Register(Format{Name: "mt940", Detect: mt940Detect, Parse: MT940Parse, ParseStatements: MT940ParseStatements})
+}
+
+// mt940Detect checks for a :20: field, followed by an account field.
+func mt940Detect(data []byte) bool {
+	seen20 := false
+	for _, line := range firstLines(data, 30) {
+		if i := strings.Index(line, "{4:"); i != -1 {
+			line = line[i+3:]
+		}
+		switch {
+		case strings.HasPrefix(line, ":20:"):
+			seen20 = true
+		case strings.HasPrefix(line, ":25:"):
+			return seen20
+		}
+	}
+	return false
+}
+
+// MT940ParseStatementsFile parses a file with SWIFT MT940 statements or
+// MT942 interim reports, see MT940ParseStatements.
+func MT940ParseStatementsFile(path string) (statements []Statement, err error) {
+	err = withFile(path, func(r io.Reader) error {
+		statements, err = MT940ParseStatements(r)
+		return err
+	})
+	return statements, err
+}
+
+// MT940ParseStatements parses SWIFT MT940 statements or MT942 interim
+// reports, including their balances. The currency of the transactions is
+// the one of the opening balance (:60F:), or for MT942 reports the one of
+// the floor limit (:34F:).
+//
+// Fields that cannot be parsed are skipped and reported in a ParseErrors
+// error, along with the other statements; their record number is the line
+// the field starts on. Statements without a currency are skipped and
+// reported, too, with the line of their :20: field.
+func MT940ParseStatements(r io.Reader) ([]Statement, error) {
+	fields, err := mt940ReadFields(r)
+	if perr, ok := err.(*ParseError); ok {
+		return nil, perr
+	}
+	if err != nil {
+		return nil, &ParseError{Err: err}
+	}
+
+	var statements []Statement
+	var errs ParseErrors
+	var statement *Statement
+	var last *mt940Transaction
+	// start is the line of the :20: field of the statement
+	start := 0
+	currency := ""
+
+	finish := func() {
+		if statement == nil {
+			return
+		}
+		defer func() {
+			statement = nil
+		}()
+		if currency == "" && len(statement.Transactions) != 0 {
+			errs = append(errs, &ParseError{Record: start, Err: fmt.Errorf("statement without opening balance (:60F:) has no currency")})
+			return
+		}
+		for _, t := range statement.Transactions {
+			t.(*mt940Transaction).currency = currency
+		}
+		numberOccurrences(statement.Transactions)
+		statements = append(statements, *statement)
+	}
+
+	for _, f := range fields {
+		err = nil
+		if f.tag != "20" && statement == nil {
+			return nil, &ParseError{Record: f.line, Column: f.tag, Value: f.value, Err: fmt.Errorf("expected :20: at start of statement")}
+		}
+		switch f.tag {
+		case "20":
+			finish()
+			statement = &Statement{}
+			start = f.line
+			last = nil
+			currency = ""
+		case "25":
+			statement.LocalAccount = strings.TrimSpace(f.value)
+		case "60F", "60M":
+			var b *Balance
+			if b, err = mt940ParseBalance(f.value); err == nil && statement.Opening == nil {
+				statement.Opening = b
+				currency = b.Currency
+			}
+		case "62F", "62M":
+			statement.Closing, err = mt940ParseBalance(f.value)
+		case "64":
+			statement.Available, err = mt940ParseBalance(f.value)
+		case "34F":
+			if len(f.value) >= 3 && currency == "" {
+				currency = f.value[:3]
+			}
+		case "61":
+			last = &mt940Transaction{localAccount: statement.LocalAccount}
+			if err = mt940ParseStatementLine(f.value, last); err == nil {
+				statement.Transactions = append(statement.Transactions, last)
+			} else {
+				last = nil
+			}
+		case "86":
+			if last != nil {
+				mt940ParseInformation(f.value, last)
+				last = nil
+			}
+		}
+		if err != nil {
+			errs = append(errs, &ParseError{Record: f.line, Column: f.tag, Value: f.value, Err: err})
+		}
+	}
+	finish()
+	return statements, errs.result()
+}
+
+// MT940ParseFile parses a file with SWIFT MT940 statements or MT942 interim
+// reports into a slice of transactions.
+func MT940ParseFile(path string) (transactions []Transaction, err error) {
+	err = withFile(path, func(r io.Reader) error {
+		transactions, err = MT940Parse(r)
+		return err
+	})
+	return transactions, err
+}
+
+// MT940Parse parses SWIFT MT940 statements or MT942 interim reports into a
+// slice of transactions.
+func MT940Parse(r io.Reader) ([]Transaction, error) {
+	statements, err := MT940ParseStatements(r)
+	var transactions []Transaction
+	for _, s := range statements {
+		transactions = append(transactions, s.Transactions...)
+	}
+	return transactions, err
+}
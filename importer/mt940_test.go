@@ -0,0 +1,60 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package importer
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMT940Parse(t *testing.T) {
+	data, err := os.ReadFile("testdata/mt940.sta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, ok := Detect(data); !ok || f.Name != "mt940" {
+		t.Errorf("detected %q, want mt940", f.Name)
+	}
+	// Statements without an opening balance have no currency
+	statements, err := MT940ParseStatementsFile("testdata/mt940.sta")
+	errs, err := Lenient(err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 1 || errs[0].Record != 22 {
+		t.Errorf("got errors %v, want one for the statement in line 22", errs)
+	}
+	if len(statements) != 2 {
+		t.Fatalf("got %d statements, want 2", len(statements))
+	}
+
+	checkStatement(t, statements[0], "10020030/1234567", "2016-12-30 1234.56 EUR", "2017-01-04 1322.06 EUR", "2017-01-04 1322.06 EUR")
+	checkTransactions(t, statements[0].Transactions, []string{
+		// The :86: subfields ?20-?29 are the reference text, ?31 the
+		// account, and ?32-?33 the name
+		"BANKREF1|2017-01-02|2017-01-03|10020030/1234567|REWE MarktGmbH|DE02100100100006820101|EREF+123 SVWZ+REWE SAGT DANKE 1234|-12.5|EUR",
+		"afbdc07ce77cfa7c083585484d5d1d5bf7c6f407a1a6b656de08820fd46beec3|2017-01-04|2017-01-04|10020030/1234567|||Unstructured infosecond line|100|EUR",
+	})
+
+	// MT942 interim reports have no balances, and the currency of their
+	// floor limit
+	checkStatement(t, statements[1], "DE89370400440532013000", "<nil>", "<nil>", "<nil>")
+	checkTransactions(t, statements[1].Transactions, []string{
+		"1a1e321028b4468ba258a77e429d81ba768bc9cca67d3fda256ce15ea95891ef|2017-01-05|2017-01-05|DE89370400440532013000|Stadtwerke||Lastschrift|-5|EUR",
+	})
+}
@@ -18,9 +18,12 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package importer
 
 import (
+	"crypto/sha256"
 	"encoding/json"
-	"os"
-	"regexp"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/shopspring/decimal"
@@ -67,11 +70,17 @@ type n26Transaction struct {
 	PartnerBankName      string          `json:"partnerBankName,omitempty"`
 	BankTransferTypeText string          `json:"bankTransferTypeText,omitempty"`
 	PaymentScheme        string          `json:"paymentScheme,omitempty"`
+	SpaceID              string          `json:"spaceId,omitempty"`
 	// Search API
 	Title       string `json:"title"`
 	Timestamp   int64  `json:"timestamp"`
 	Currency    string `json:"currency"`
 	AmountStyle string `json:"amountStyle"`
+
+	// hashID is set if ID is a content hash, see N26CSVParse
+	hashID bool
+	// alias is the content hash with the occurrence suffix, see N26Parse
+	alias string
 }
 
 type n26Transaction2 struct{ d *n26Transaction }
@@ -80,6 +89,35 @@ func (t n26Transaction2) ID() string {
 	return t.d.ID
 }
 
+// Aliases returns the hash of the contents of the transaction, which is the
+// ID of the transaction in the CSV export, see contentHash and N26Parse.
+func (t n26Transaction2) Aliases() []string {
+	if t.d.hashID {
+		return nil
+	}
+	alias := t.d.alias
+	if alias == "" {
+		alias = t.contentHash()
+	}
+	if alias != t.d.ID {
+		return []string{alias}
+	}
+	return nil
+}
+
+// contentHash returns a hash of the values both the JSON data and the CSV
+// export contain: the day in the time zone of N26, the amount, the
+// currency, and the name of the other party.
+func (t n26Transaction2) contentHash() string {
+	hash := sha256.Sum256([]byte(strings.Join([]string{
+		t.Date().Format("2006-01-02"),
+		t.d.Amount.String(),
+		t.Currency(),
+		strings.ToLower(strings.Join(strings.Fields(t.RemoteName()), " ")),
+	}, "\x00")))
+	return fmt.Sprintf("%x", hash)
+}
+
 var categories = map[string]Category{
 	"micro-v2-atm":                   CategoryATM,
 	"micro-v2-business":              CategoryBusiness,
@@ -104,20 +142,66 @@ func (t n26Transaction2) LocalAccount() string {
 	return t.d.AccountID
 }
 
-// RemoteAccount returns an ID of the remote account (IBAN).
+// n26SpacePatterns are the words of the partner names of transfers between
+// the main account and a Space, like "Von Hauptkonto nach Urlaub", in the
+// languages of the N26 app.
+var n26SpacePatterns = []struct{ from, to, main []string }{
+	{[]string{"Von"}, []string{"nach", "zu"}, []string{"Hauptkonto"}},
+	{[]string{"From"}, []string{"to"}, []string{"Main Account", "Main"}},
+	{[]string{"De", "Du"}, []string{"vers", "à", "a"}, []string{"Compte principal", "compte principal"}},
+	{[]string{"De", "Desde"}, []string{"a", "hacia"}, []string{"Cuenta principal"}},
+	{[]string{"Da", "Dal"}, []string{"a", "al", "verso"}, []string{"Conto principale"}},
+}
+
+// n26Space returns the name of the Space the partner name of a transfer
+// between the main account and a Space refers to.
+func n26Space(partnerName string) (string, bool) {
+	hasPrefix := func(s, prefix string) bool {
+		return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+	}
+	hasSuffix := func(s, suffix string) bool {
+		return len(s) >= len(suffix) && strings.EqualFold(s[len(s)-len(suffix):], suffix)
+	}
+	name := strings.Join(strings.Fields(partnerName), " ")
+	for _, p := range n26SpacePatterns {
+		for _, from := range p.from {
+			for _, to := range p.to {
+				for _, main := range p.main {
+					// From the main account to the Space
+					if prefix := from + " " + main + " " + to + " "; hasPrefix(name, prefix) && len(name) > len(prefix) {
+						return name[len(prefix):], true
+					}
+					// From the Space to the main account
+					if suffix := " " + to + " " + main; hasPrefix(name, from+" ") && hasSuffix(name, suffix) && len(name) > len(from)+len(suffix)+1 {
+						return name[len(from)+1 : len(name)-len(suffix)], true
+					}
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// Space returns the name and, if known, the ID of the Space money is
+// transferred to or from.
+func (t n26Transaction2) Space() (string, string) {
+	if t.d.PaymentScheme != "SPACES" {
+		return "", ""
+	}
+	name, ok := n26Space(t.d.PartnerName)
+	if !ok {
+		name = t.d.PartnerName
+	}
+	return name, t.d.SpaceID
+}
+
+// RemoteAccount returns an ID of the remote account (IBAN), or space:NAME
+// for transfers to and from Spaces.
 func (t n26Transaction2) RemoteAccount() string {
-	switch {
-	case t.d.PaymentScheme == "SPACES" && t.d.Amount.IsPositive():
-		re := regexp.MustCompile("Von (.*) nach Hauptkonto")
-		matches := re.FindStringSubmatch(t.d.PartnerName)
-		return "space:" + matches[1]
-	case t.d.PaymentScheme == "SPACES" && t.d.Amount.IsNegative():
-		re := regexp.MustCompile("Von Hauptkonto nach (.*)")
-		matches := re.FindStringSubmatch(t.d.PartnerName)
-		return "space:" + matches[1]
-	default:
-		return t.d.PartnerIban
+	if name, _ := t.Space(); name != "" {
+		return "space:" + name
 	}
+	return t.d.PartnerIban
 }
 
 // RemoteName returns a name of the other account.
@@ -136,20 +220,10 @@ func (t n26Transaction2) RemoteName() string {
 
 // ReferenceText returns a description of the transaction.
 func (t n26Transaction2) ReferenceText() string {
-	switch {
-	case t.d.PaymentScheme == "SPACES" && t.d.Amount.IsPositive() && t.d.ReferenceText == "":
-		re := regexp.MustCompile("Von (.*) nach Hauptkonto")
-		matches := re.FindStringSubmatch(t.d.PartnerName)
-		return "space:" + matches[1]
-	case t.d.PaymentScheme == "SPACES" && t.d.Amount.IsNegative() && t.d.ReferenceText == "":
-		re := regexp.MustCompile("Von Hauptkonto nach (.*)")
-		matches := re.FindStringSubmatch(t.d.PartnerName)
-		return "space:" + matches[1]
-	case t.d.ReferenceText != "":
-		return t.d.ReferenceText
-	default:
-		return ""
+	if name, _ := t.Space(); name != "" && t.d.ReferenceText == "" {
+		return "space:" + name
 	}
+	return t.d.ReferenceText
 }
 
 // Amount returns the amount of the transaction.
@@ -162,23 +236,36 @@ func (t n26Transaction2) Amount() decimal.Decimal {
 	}
 }
 
+// n26Location is the time zone of N26, which determines the day of
+// transactions.
+var n26Location = func() *time.Location {
+	location, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		return time.FixedZone("CET", 60*60)
+	}
+	return location
+}()
+
 // Date returns the date of the transaction.
 func (t n26Transaction2) Date() time.Time {
 	switch {
 	case t.d.VisibleTS != 0:
-		return time.Unix(t.d.VisibleTS/1000, 0)
+		return time.Unix(t.d.VisibleTS/1000, 0).In(n26Location)
 	default:
-		return time.Unix(t.d.Timestamp/1000, 0)
+		return time.Unix(t.d.Timestamp/1000, 0).In(n26Location)
 	}
 }
 
-// ValutaDate returns the date of the transaction.
+// ValutaDate returns the date of the transaction. If N26 does not provide
+// it, it is the date of the transaction, not 1970-01-01.
 func (t n26Transaction2) ValutaDate() time.Time {
 	switch {
 	case t.d.CreatedTS != 0:
-		return time.Unix(t.d.CreatedTS/1000, 0)
+		return time.Unix(t.d.CreatedTS/1000, 0).In(n26Location)
+	case t.d.Timestamp != 0:
+		return time.Unix(t.d.Timestamp/1000, 0).In(n26Location)
 	default:
-		return time.Unix(t.d.Timestamp/1000, 0)
+		return t.Date()
 	}
 }
 
@@ -192,6 +279,11 @@ func (t n26Transaction2) Currency() string {
 	}
 }
 
+// Pending returns true if the transaction is not booked yet.
+func (t n26Transaction2) Pending() bool {
+	return t.d.Pending
+}
+
 // ForeignAmount returns the original amount of the transaction.
 func (t n26Transaction2) ForeignAmount() decimal.Decimal {
 	return t.d.OriginalAmount
@@ -202,19 +294,41 @@ func (t n26Transaction2) ForeignCurrency() string {
 	return t.d.OriginalCurrency
 }
 
+func init() {
+	Register(Format{Name: "n26", Detect: n26Detect, Parse: N26Parse})
+}
+
+// n26Detect checks for a JSON array of objects with the N26 fields.
+func n26Detect(data []byte) bool {
+	var objects []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &objects); err != nil || len(objects) == 0 {
+		return false
+	}
+	_, hasAmount := objects[0]["amount"]
+	_, hasVisibleTS := objects[0]["visibleTS"]
+	_, hasTimestamp := objects[0]["timestamp"]
+	return hasAmount && (hasVisibleTS || hasTimestamp)
+}
+
 // N26ParseFile parses a N26 JSON file into a slice of transactions.
-func N26ParseFile(path string) ([]Transaction, error) {
+func N26ParseFile(path string) (transactions []Transaction, err error) {
+	err = withFile(path, func(r io.Reader) error {
+		transactions, err = N26Parse(r)
+		return err
+	})
+	return transactions, err
+}
+
+// N26Parse parses N26 JSON data into a slice of transactions.
+//
+// The aliases of the transactions are numbered like the IDs of N26CSVParse:
+// the second of several transactions with the same content hash, in the
+// order of their timestamps, has the alias HASH-2, and so on.
+func N26Parse(r io.Reader) ([]Transaction, error) {
 	var transactions []n26Transaction
-	r, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		r.Close()
-	}()
-	err = json.NewDecoder(r).Decode(&transactions)
+	err := json.NewDecoder(r).Decode(&transactions)
 	if err != nil {
-		return nil, err
+		return nil, &ParseError{Err: err}
 	}
 	var results []Transaction
 	for l := len(transactions); l > 0; l-- {
@@ -222,5 +336,18 @@ func N26ParseFile(path string) ([]Transaction, error) {
 		// TODO: Filter out transactions that are not completed yet.
 		results = append(results, t)
 	}
+
+	sorted := append([]Transaction(nil), results...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Date().Before(sorted[j].Date())
+	})
+	seen := make(map[string]int)
+	for _, t := range sorted {
+		d := t.(n26Transaction2).d
+		d.alias = n26Transaction2{d}.contentHash()
+		if seen[d.alias]++; seen[d.alias] > 1 {
+			d.alias += fmt.Sprintf("-%d", seen[d.alias])
+		}
+	}
 	return results, nil
 }
@@ -0,0 +1,150 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package importer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestN26Parse(t *testing.T) {
+	data, err := os.ReadFile("testdata/n26.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, ok := Detect(data); !ok || f.Name != "n26" {
+		t.Errorf("detected %q, want n26", f.Name)
+	}
+	transactions, err := N26ParseFile("testdata/n26.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Dates are days in Berlin, and missing valuta dates are the date
+	checkTransactions(t, transactions, []string{
+		"abc|2017-01-03|2017-01-03|acc-1|REWE|||-5.5|EUR",
+		"def|2017-01-03|2017-01-03|acc-1|From Main Account to Holidays|space:Holidays|space:Holidays|-20|EUR",
+		"ghi|2017-01-04|2017-01-04|acc-1|Paris Cafe|||-10|EUR|-11.5|USD|pending",
+		"jkl|2017-01-04|2017-01-04|acc-1|Paris Cafe|||-10|EUR|-11.5|USD",
+	})
+	// Identical payments on one day are numbered like in the CSV export
+	const hash = "a43969f223633e3463d116d58e73b832db7513f3e9ac811fe66bdfa4dd3e0e43"
+	for i, want := range []string{hash, hash + "-2"} {
+		if got := transactions[2+i].(AliasedTransaction).Aliases(); !reflect.DeepEqual(got, []string{want}) {
+			t.Errorf("transaction %d: got aliases %v, want %s", 2+i, got, want)
+		}
+	}
+	if name, id := transactions[1].(SpaceTransaction).Space(); name != "Holidays" || id != "space-1" {
+		t.Errorf("got space %q with ID %q, want Holidays with ID space-1", name, id)
+	}
+}
+
+func TestN26Space(t *testing.T) {
+	for _, test := range []struct{ partnerName, space string }{
+		{"Von Hauptkonto nach Urlaub", "Urlaub"},
+		{"Von Rücklage Auto nach Hauptkonto", "Rücklage Auto"},
+		{"From Main Account to Holidays", "Holidays"},
+		{"From Holidays to Main Account", "Holidays"},
+		{"De Compte principal vers Vacances", "Vacances"},
+		{"De Cuenta principal a Casa a Playa", "Casa a Playa"},
+		{"Da Conto principale a Vacanze", "Vacanze"},
+		{"Von Hauptkonto nach", ""},
+		{"REWE", ""},
+	} {
+		space, ok := n26Space(test.partnerName)
+		if space != test.space || ok != (test.space != "") {
+			t.Errorf("%q: got %q, %v, want %q", test.partnerName, space, ok, test.space)
+		}
+	}
+}
+
+func TestN26CSVParse(t *testing.T) {
+	for _, file := range []string{"testdata/n26.csv", "testdata/n26-new.csv"} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f, ok := Detect(data); !ok || f.Name != "n26-csv" {
+			t.Errorf("%s: detected %q, want n26-csv", file, f.Name)
+		}
+	}
+
+	transactions, err := N26CSVParseFile("testdata/n26.csv")
+	errs, err := Lenient(err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 1 || errs[0].Record != 6 || errs[0].Column != "Amount (EUR)" {
+		t.Errorf("got errors %v, want one about record 6", errs)
+	}
+	// The IDs are the aliases of the JSON transactions
+	checkTransactions(t, transactions, []string{
+		"afb1d058a83511cbe0b655ec4a77dcdaf185ae89d0ff783c3c8b5c784f4debcc|2017-01-03|2017-01-03||REWE|||-5.5|EUR",
+		"efb5bbcd81efd097f1964965215c1cc7c2b9e7f60b6a74b1103295773200837f|2017-01-03|2017-01-03||From Main Account to Holidays|space:Holidays|space:Holidays|-20|EUR",
+		"a43969f223633e3463d116d58e73b832db7513f3e9ac811fe66bdfa4dd3e0e43|2017-01-04|2017-01-04||Paris Cafe|||-10|EUR|-11.5|USD",
+		"a43969f223633e3463d116d58e73b832db7513f3e9ac811fe66bdfa4dd3e0e43-2|2017-01-04|2017-01-04||Paris Cafe|||-10|EUR|-11.5|USD",
+	})
+
+	transactions, err = N26CSVParseFile("testdata/n26-new.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTransactions(t, transactions, []string{
+		"c2eeef5737e3aa58e2cd96f2cf9a891623153cfbf30735d7d712c43e545c0f6f|2017-01-06|2017-01-07||Jane Doe|DE89370400440532013000|Rent|100|EUR",
+	})
+}
+
+// TestN26Dedupe checks that transactions are imported only once from the
+// JSON data and the CSV export, in either order.
+func TestN26Dedupe(t *testing.T) {
+	json, err := N26ParseFile("testdata/n26.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csv, err := N26CSVParseFile("testdata/n26.csv")
+	if _, err := Lenient(err); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name          string
+		first, second []Transaction
+		want          []string
+	}{
+		// Both have two identical payments on one day
+		{"json first", json, csv, nil},
+		{"csv first", csv, json, nil},
+	} {
+		s, err := OpenState(filepath.Join(t.TempDir(), "state"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.Filter(test.first); len(got) != len(test.first) {
+			t.Errorf("%s: got %d new transactions, want %d", test.name, len(got), len(test.first))
+		}
+		if err := s.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if s, err = OpenState(filepath.Join(filepath.Dir(s.path), "state")); err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(s.Filter(test.second)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got new transactions %v, want %v", test.name, got, test.want)
+		}
+	}
+}
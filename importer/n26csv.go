@@ -0,0 +1,256 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package importer
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// n26Columns maps the column names of the English, German, and newer N26
+// CSV exports to the names used by n26ParseRecord.
+var n26Columns = map[string]string{
+	"Date":                      "date",
+	"Datum":                     "date",
+	"Booking Date":              "date",
+	"Buchungsdatum":             "date",
+	"Value Date":                "valuta",
+	"Wertstellungsdatum":        "valuta",
+	"Payee":                     "payee",
+	"Empfänger":                 "payee",
+	"Partner Name":              "payee",
+	"Account number":            "account",
+	"Kontonummer":               "account",
+	"Partner Iban":              "account",
+	"Transaction type":          "type",
+	"Transaktionstyp":           "type",
+	"Type":                      "type",
+	"Payment reference":         "reference",
+	"Payment Reference":         "reference",
+	"Verwendungszweck":          "reference",
+	"Category":                  "category",
+	"Kategorie":                 "category",
+	"Amount (Foreign Currency)": "foreign-amount",
+	"Betrag (Fremdwährung)":     "foreign-amount",
+	"Original Amount":           "foreign-amount",
+	"Type Foreign Currency":     "foreign-currency",
+	"Fremdwährung":              "foreign-currency",
+	"Original Currency":         "foreign-currency",
+	"Exchange Rate":             "exchange-rate",
+	"Wechselkurs":               "exchange-rate",
+}
+
+// n26AmountColumn matches the column of the amount, which names the
+// currency of the account, like "Amount (EUR)".
+var n26AmountColumn = regexp.MustCompile(`^(?:Amount|Betrag) \(([A-Z]{3})\)$`)
+
+// n26CSVCategories maps the category names of the CSV export to those of
+// the JSON data.
+var n26CSVCategories = map[string]string{
+	"ATM":                      "micro-v2-atm",
+	"Business expenses":        "micro-v2-business",
+	"Food & Groceries":         "micro-v2-food-groceries",
+	"Income":                   "micro-v2-income",
+	"Leisure & Entertainment":  "micro-v2-leisure-entertainment",
+	"Miscellaneous":            "micro-v2-miscellaneous",
+	"Savings & Investments":    "micro-v2-savings-investments",
+	"Shopping":                 "micro-v2-shopping",
+	"Transport & Car":          "micro-v2-transport-car",
+	"Bars & Restaurants":       "micro-v2-bars-restaurants",
+	"Travel & Holidays":        "micro-v2-travel-holidays",
+	"Healthcare & Drug Stores": "micro-v2-healthcare-drugstores",
+}
+
+// n26CSVHeader returns the columns of an N26 CSV header and the currency of
+// the account, or an error if it lacks required columns.
+func n26CSVHeader(header []string) (map[string]int, string, error) {
+	columns := make(map[string]int)
+	var currency string
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if m := n26AmountColumn.FindStringSubmatch(name); m != nil {
+			columns["amount"] = i
+			currency = m[1]
+		} else if column, ok := n26Columns[name]; ok {
+			columns[column] = i
+		}
+	}
+	for _, column := range []string{"date", "payee", "amount"} {
+		if _, ok := columns[column]; !ok {
+			return nil, "", fmt.Errorf("missing column %s", column)
+		}
+	}
+	return columns, currency, nil
+}
+
+// n26ParseRecord parses a record of the CSV export into the fields of a
+// JSON transaction, so both behave the same.
+func n26ParseRecord(record []string, header []string, columns map[string]int, currency string) (*n26Transaction, *ParseError) {
+	value := func(column string) string {
+		if i, ok := columns[column]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	date := func(column string) (int64, *ParseError) {
+		d, err := time.ParseInLocation("2006-01-02", value(column), n26Location)
+		if err != nil {
+			return 0, &ParseError{Column: header[columns[column]], Value: value(column), Err: err}
+		}
+		return d.Unix() * 1000, nil
+	}
+	number := func(column string) (decimal.Decimal, *ParseError) {
+		if value(column) == "" {
+			return decimal.Zero, nil
+		}
+		d, err := decimal.NewFromString(value(column))
+		if err != nil {
+			return decimal.Zero, &ParseError{Column: header[columns[column]], Value: value(column), Err: err}
+		}
+		return d, nil
+	}
+
+	var t n26Transaction
+	var perr *ParseError
+	if t.VisibleTS, perr = date("date"); perr != nil {
+		return nil, perr
+	}
+	if value("valuta") != "" {
+		if t.CreatedTS, perr = date("valuta"); perr != nil {
+			return nil, perr
+		}
+	}
+	if t.Amount, perr = number("amount"); perr != nil {
+		return nil, perr
+	}
+	if t.OriginalAmount, perr = number("foreign-amount"); perr != nil {
+		return nil, perr
+	}
+	if t.ExchangeRate, perr = number("exchange-rate"); perr != nil {
+		return nil, perr
+	}
+	t.CurrencyCode = currency
+	t.PartnerName = value("payee")
+	t.PartnerIban = value("account")
+	t.BankTransferTypeText = value("type")
+	t.ReferenceText = value("reference")
+	t.Category = n26CSVCategories[value("category")]
+	t.OriginalCurrency = value("foreign-currency")
+	if _, ok := n26Space(t.PartnerName); ok && t.PartnerIban == "" {
+		t.PaymentScheme = "SPACES"
+	}
+	return &t, nil
+}
+
+func init() {
+	Register(Format{Name: "n26-csv", Detect: n26CSVDetect, Parse: N26CSVParse})
+}
+
+// n26CSVDetect checks for a header with the column names of the N26 CSV
+// export.
+func n26CSVDetect(data []byte) bool {
+	lines := firstLines(data, 1)
+	if len(lines) == 0 {
+		return false
+	}
+	header, err := csv.NewReader(strings.NewReader(strings.TrimPrefix(lines[0], "\ufeff"))).Read()
+	if err != nil {
+		return false
+	}
+	_, _, err = n26CSVHeader(header)
+	return err == nil
+}
+
+// N26CSVParseFile parses a CSV file exported by the N26 web app into a slice
+// of transactions.
+func N26CSVParseFile(path string) (transactions []Transaction, err error) {
+	err = withFile(path, func(r io.Reader) error {
+		transactions, err = N26CSVParse(r)
+		return err
+	})
+	return transactions, err
+}
+
+// N26CSVParse parses CSV data exported by the N26 web app, in English,
+// German, or the newer format. The transactions behave like those of
+// N26Parse. As the export has no IDs, hashes of the contents of the
+// transactions are used, which transactions of N26Parse have as aliases,
+// so files of both can be imported.
+//
+// Records that cannot be parsed are skipped and reported in a ParseErrors
+// error, along with the other transactions.
+func N26CSVParse(fr io.Reader) ([]Transaction, error) {
+	var transactions []Transaction
+	var errs ParseErrors
+
+	// The newer exports start with a byte order mark
+	br := bufio.NewReader(fr)
+	if bom, err := br.Peek(3); err == nil && string(bom) == "\ufeff" {
+		br.Discard(3)
+	}
+	r := csv.NewReader(br)
+	r.FieldsPerRecord = -1
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, &ParseError{Record: 1, Err: err}
+	}
+	columns, currency, err := n26CSVHeader(header)
+	if err != nil {
+		return nil, &ParseError{Record: 1, Err: err}
+	}
+
+	seen := make(map[string]int)
+	for n := 2; ; n++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		var csvErr *csv.ParseError
+		if errors.As(err, &csvErr) {
+			errs = append(errs, &ParseError{Record: n, Err: err})
+			continue
+		}
+		if err != nil {
+			return nil, &ParseError{Record: n, Err: err}
+		}
+
+		t, perr := n26ParseRecord(record, header, columns, currency)
+		if perr != nil {
+			perr.Record = n
+			errs = append(errs, perr)
+			continue
+		}
+		// The CSV export has no IDs, so the content hash is used, with the
+		// number of identical transactions before as a suffix
+		t.ID, t.hashID = n26Transaction2{t}.contentHash(), true
+		if seen[t.ID]++; seen[t.ID] > 1 {
+			t.ID += fmt.Sprintf("-%d", seen[t.ID])
+		}
+		transactions = append(transactions, n26Transaction2{t})
+	}
+	return transactions, errs.result()
+}
@@ -0,0 +1,452 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package importer
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// ofxNode is an element of an OFX document. OFX 1.x files are SGML files
+// where leaf elements are not closed, so the OFX files are parsed into a
+// simple tree rather than using encoding/xml.
+type ofxNode struct {
+	name     string
+	value    string
+	parent   *ofxNode
+	children []*ofxNode
+}
+
+// ofxParse parses an OFX 1.x (SGML) or 2.x (XML) document.
+func ofxParse(data string) (*ofxNode, error) {
+	root := &ofxNode{}
+	top := root
+	start := strings.Index(data, "<")
+	if start == -1 {
+		return nil, fmt.Errorf("no OFX content")
+	}
+	// Skip the OFX 1.x header
+	data = data[start:]
+
+	for len(data) > 0 {
+		lt := strings.IndexByte(data, '<')
+		if lt == -1 {
+			lt = len(data)
+		}
+		if text := strings.TrimSpace(data[:lt]); text != "" {
+			if top == root {
+				return nil, fmt.Errorf("text %q outside of element", text)
+			}
+			// An element with text is a leaf. In OFX 1.x, it is not closed.
+			top.value = html.UnescapeString(text)
+			top = top.parent
+		}
+		if lt == len(data) {
+			break
+		}
+		data = data[lt:]
+
+		gt := strings.IndexByte(data, '>')
+		if gt == -1 {
+			return nil, fmt.Errorf("unterminated tag")
+		}
+		tag := data[1:gt]
+		data = data[gt+1:]
+
+		switch {
+		case strings.HasPrefix(tag, "?"), strings.HasPrefix(tag, "!"):
+			// Processing instructions, comments, and declarations
+			if strings.HasPrefix(tag, "!--") && !strings.HasSuffix(tag, "--") {
+				end := strings.Index(data, "-->")
+				if end == -1 {
+					return nil, fmt.Errorf("unterminated comment")
+				}
+				data = data[end+3:]
+			}
+		case strings.HasPrefix(tag, "/"):
+			name := strings.ToUpper(strings.TrimSpace(tag[1:]))
+			// Close the element and all unclosed elements in it. Closing
+			// tags of leaves are ignored, as the leaves are closed already.
+			for n := top; n != root; n = n.parent {
+				if n.name == name {
+					top = n.parent
+					break
+				}
+			}
+		case strings.HasSuffix(tag, "/"):
+			name := strings.ToUpper(strings.TrimSpace(strings.TrimSuffix(tag, "/")))
+			top.children = append(top.children, &ofxNode{name: name, parent: top})
+		default:
+			name := strings.ToUpper(strings.TrimSpace(tag))
+			if i := strings.IndexAny(name, " \t\r\n"); i != -1 {
+				name = name[:i]
+			}
+			node := &ofxNode{name: name, parent: top}
+			top.children = append(top.children, node)
+			top = node
+		}
+	}
+	return root, nil
+}
+
+// child returns the first child found by following the path of names.
+func (n *ofxNode) child(path ...string) *ofxNode {
+	for _, name := range path {
+		var next *ofxNode
+		for _, c := range n.children {
+			if c.name == name {
+				next = c
+				break
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		n = next
+	}
+	return n
+}
+
+// text returns the value of the child at the path, or an empty string.
+func (n *ofxNode) text(path ...string) string {
+	if c := n.child(path...); c != nil {
+		return c.value
+	}
+	return ""
+}
+
+// findAll returns all descendants with the given name.
+func (n *ofxNode) findAll(name string) []*ofxNode {
+	var result []*ofxNode
+	for _, c := range n.children {
+		if c.name == name {
+			result = append(result, c)
+		} else {
+			result = append(result, c.findAll(name)...)
+		}
+	}
+	return result
+}
+
+// ofxParseDate parses a date of the form YYYYMMDD[HHMMSS[.XXX]][[offset:TZ]]
+func ofxParseDate(s string) (time.Time, error) {
+	location := time.UTC
+	if i := strings.IndexByte(s, '['); i != -1 {
+		tz := strings.TrimSuffix(s[i+1:], "]")
+		s = s[:i]
+		name := ""
+		if j := strings.IndexByte(tz, ':'); j != -1 {
+			tz, name = tz[:j], tz[j+1:]
+		}
+		offset, err := strconv.ParseFloat(tz, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time zone")
+		}
+		if name == "" {
+			name = "UTC" + tz
+		}
+		location = time.FixedZone(name, int(offset*3600))
+	}
+	if i := strings.IndexByte(s, '.'); i != -1 {
+		s = s[:i]
+	}
+
+	var layout string
+	switch len(s) {
+	case 8:
+		layout = "20060102"
+	case 12:
+		layout = "200601021504"
+	case 14:
+		layout = "20060102150405"
+	default:
+		return time.Time{}, fmt.Errorf("invalid date")
+	}
+	return time.ParseInLocation(layout, s, location)
+}
+
+// ofxParseAmount parses an amount, which some banks write with a decimal
+// comma.
+func ofxParseAmount(s string) (decimal.Decimal, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, ".") {
+		s = strings.Replace(s, ",", ".", 1)
+	}
+	return decimal.NewFromString(s)
+}
+
+// ofxTransaction is a STMTTRN element of a bank or credit card statement.
+type ofxTransaction struct {
+	fitID           string
+	transactionType string
+	localAccount    string
+	remoteAccount   string
+	name            string
+	memo            string
+	amount          decimal.Decimal
+	currency        string
+	foreignAmount   decimal.Decimal
+	foreignCurrency string
+	date            time.Time
+	valutaDate      time.Time
+	occurrence      int
+}
+
+func (t ofxTransaction) ID() string {
+	if t.fitID != "" {
+		return t.fitID
+	}
+	return hashID(t, t.occurrence)
+}
+
+func (t *ofxTransaction) setOccurrence(n int) {
+	t.occurrence = n
+}
+
+func (t ofxTransaction) Category() Category {
+	return CategoryMisc
+}
+
+// LocalAccount returns an ID of the local account.
+func (t ofxTransaction) LocalAccount() string {
+	return t.localAccount
+}
+
+// RemoteAccount returns an ID of the remote account, for transfers.
+func (t ofxTransaction) RemoteAccount() string {
+	return t.remoteAccount
+}
+
+// RemoteName returns a name of the other account.
+func (t ofxTransaction) RemoteName() string {
+	return t.name
+}
+
+// ReferenceText returns a description of the transaction.
+func (t ofxTransaction) ReferenceText() string {
+	return t.memo
+}
+
+// Amount returns the amount of the transaction.
+func (t ofxTransaction) Amount() decimal.Decimal {
+	return t.amount
+}
+
+// Date returns the date of the transaction.
+func (t ofxTransaction) Date() time.Time {
+	return t.date
+}
+
+// ValutaDate returns the date the transaction was posted.
+func (t ofxTransaction) ValutaDate() time.Time {
+	return t.valutaDate
+}
+
+// Currency returns a currency code for the account.
+func (t ofxTransaction) Currency() string {
+	return t.currency
+}
+
+// ForeignAmount returns the original amount of the transaction.
+func (t ofxTransaction) ForeignAmount() decimal.Decimal {
+	return t.foreignAmount
+}
+
+// ForeignCurrency returns the original currency of the transaction.
+func (t ofxTransaction) ForeignCurrency() string {
+	return t.foreignCurrency
+}
+
+func ofxParseTransaction(n *ofxNode, account string, currency string) (*ofxTransaction, *ParseError) {
+	var err error
+	t := &ofxTransaction{
+		fitID:           n.text("FITID"),
+		transactionType: n.text("TRNTYPE"),
+		localAccount:    account,
+		remoteAccount:   n.text("BANKACCTTO", "ACCTID"),
+		name:            n.text("NAME"),
+		memo:            n.text("MEMO"),
+		currency:        currency,
+	}
+	if t.remoteAccount == "" {
+		t.remoteAccount = n.text("CCACCTTO", "ACCTID")
+	}
+	if t.name == "" {
+		t.name = n.text("PAYEE", "NAME")
+	}
+	if t.amount, err = ofxParseAmount(n.text("TRNAMT")); err != nil {
+		return nil, &ParseError{Column: "TRNAMT", Value: n.text("TRNAMT"), Err: err}
+	}
+	if t.valutaDate, err = ofxParseDate(n.text("DTPOSTED")); err != nil {
+		return nil, &ParseError{Column: "DTPOSTED", Value: n.text("DTPOSTED"), Err: err}
+	}
+	t.date = t.valutaDate
+	if user := n.text("DTUSER"); user != "" {
+		if t.date, err = ofxParseDate(user); err != nil {
+			return nil, &ParseError{Column: "DTUSER", Value: user, Err: err}
+		}
+	}
+
+	// CURRATE is the ratio of the statement currency to the currency in
+	// CURSYM. With CURRENCY, TRNAMT is in CURSYM, with ORIGCURRENCY, it
+	// is in the statement currency, but originates from CURSYM.
+	for _, name := range []string{"CURRENCY", "ORIGCURRENCY"} {
+		c := n.child(name)
+		if c == nil {
+			continue
+		}
+		rate, err := ofxParseAmount(c.text("CURRATE"))
+		if err == nil && rate.IsZero() {
+			err = fmt.Errorf("rate is zero")
+		}
+		if err != nil {
+			return nil, &ParseError{Column: name + "/CURRATE", Value: c.text("CURRATE"), Err: err}
+		}
+		t.foreignCurrency = c.text("CURSYM")
+		if name == "CURRENCY" {
+			t.foreignAmount = t.amount
+			t.amount = t.amount.Mul(rate).Round(2)
+		} else {
+			t.foreignAmount = t.amount.Div(rate).Round(2)
+		}
+	}
+	return t, nil
+}
+
+func ofxParseBalance(n *ofxNode, currency string) (*Balance, *ParseError) {
+	if n == nil {
+		return nil, nil
+	}
+	var b Balance
+	var err error
+	if b.Amount, err = ofxParseAmount(n.text("BALAMT")); err != nil {
+		return nil, &ParseError{Column: n.name + "/BALAMT", Value: n.text("BALAMT"), Err: err}
+	}
+	if b.Date, err = ofxParseDate(n.text("DTASOF")); err != nil {
+		return nil, &ParseError{Column: n.name + "/DTASOF", Value: n.text("DTASOF"), Err: err}
+	}
+	b.Currency = currency
+	return &b, nil
+}
+
+func init() {
+	Register(Format{Name: "ofx", Detect: ofxDetect, Parse: OFXParse, ParseStatements: OFXParseStatements})
+}
+
+// ofxDetect checks for an OFX 1.x header or an OFX element.
+func ofxDetect(data []byte) bool {
+	head := data
+	if len(head) > 4096 {
+		head = head[:4096]
+	}
+	head = bytes.ToUpper(head)
+	return bytes.HasPrefix(bytes.TrimSpace(head), []byte("OFXHEADER:")) || bytes.Contains(head, []byte("<OFX>"))
+}
+
+// OFXParseStatementsFile parses the statements in an OFX 1.x or 2.x file,
+// see OFXParseStatements.
+func OFXParseStatementsFile(path string) (statements []Statement, err error) {
+	err = withFile(path, func(r io.Reader) error {
+		statements, err = OFXParseStatements(r)
+		return err
+	})
+	return statements, err
+}
+
+// OFXParseStatements parses the bank (STMTRS) and credit card (CCSTMTRS)
+// statements in an OFX 1.x or 2.x document. The ledger balance (LEDGERBAL)
+// is returned as the closing balance, and the available balance (AVAILBAL)
+// as the available balance.
+//
+// Transactions and balances that cannot be parsed are skipped and reported
+// in a ParseErrors error, along with the other statements. The record number
+// of a transaction is the number of the STMTTRN element in the document.
+func OFXParseStatements(r io.Reader) ([]Statement, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	root, err := ofxParse(string(data))
+	if err != nil {
+		return nil, &ParseError{Err: err}
+	}
+
+	var statements []Statement
+	var errs ParseErrors
+	var perr *ParseError
+	record := 0
+	for _, n := range append(root.findAll("STMTRS"), root.findAll("CCSTMTRS")...) {
+		var s Statement
+		currency := n.text("CURDEF")
+		s.LocalAccount = n.text("BANKACCTFROM", "ACCTID")
+		if s.LocalAccount == "" {
+			s.LocalAccount = n.text("CCACCTFROM", "ACCTID")
+		}
+		if s.Closing, perr = ofxParseBalance(n.child("LEDGERBAL"), currency); perr != nil {
+			errs = append(errs, perr)
+		}
+		if s.Available, perr = ofxParseBalance(n.child("AVAILBAL"), currency); perr != nil {
+			errs = append(errs, perr)
+		}
+		if list := n.child("BANKTRANLIST"); list != nil {
+			for _, tn := range list.children {
+				if tn.name != "STMTTRN" {
+					continue
+				}
+				record++
+				t, perr := ofxParseTransaction(tn, s.LocalAccount, currency)
+				if perr != nil {
+					perr.Record = record
+					errs = append(errs, perr)
+					continue
+				}
+				s.Transactions = append(s.Transactions, t)
+			}
+		}
+		numberOccurrences(s.Transactions)
+		statements = append(statements, s)
+	}
+	return statements, errs.result()
+}
+
+// OFXParseFile parses an OFX 1.x or 2.x file (also known as QFX) into a
+// slice of transactions.
+func OFXParseFile(path string) (transactions []Transaction, err error) {
+	err = withFile(path, func(r io.Reader) error {
+		transactions, err = OFXParse(r)
+		return err
+	})
+	return transactions, err
+}
+
+// OFXParse parses an OFX 1.x or 2.x document into a slice of transactions.
+func OFXParse(r io.Reader) ([]Transaction, error) {
+	statements, err := OFXParseStatements(r)
+	var transactions []Transaction
+	for _, s := range statements {
+		transactions = append(transactions, s.Transactions...)
+	}
+	return transactions, err
+}
@@ -0,0 +1,62 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package importer
+
+import (
+	"os"
+	"testing"
+)
+
+func TestOFXParse(t *testing.T) {
+	for _, test := range []struct {
+		file         string
+		account      string
+		closing      string
+		available    string
+		transactions []string
+	}{
+		// OFX 1.x SGML, with unclosed elements and entities
+		{"testdata/ofx1.ofx", "9876", "2017-01-05 1000 USD", "2017-01-05 900 USD", []string{
+			"F1|2017-01-02|2017-01-03|9876|Coffee & Co||Card 1234|-12.5|USD",
+			"F2|2017-01-04|2017-01-04|9876|Paris|||-10.5|USD|-10|EUR",
+		}},
+		// OFX 2.x XML credit card statement
+		{"testdata/ofx2.ofx", "4111", "2017-01-02 -5 GBP", "<nil>", []string{
+			"X|2017-01-02|2017-01-02|4111|Tesco|||-5|GBP",
+		}},
+	} {
+		t.Run(test.file, func(t *testing.T) {
+			data, err := os.ReadFile(test.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f, ok := Detect(data); !ok || f.Name != "ofx" {
+				t.Errorf("detected %q, want ofx", f.Name)
+			}
+			statements, err := OFXParseStatementsFile(test.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(statements) != 1 {
+				t.Fatalf("got %d statements, want 1", len(statements))
+			}
+			checkStatement(t, statements[0], test.account, "<nil>", test.closing, test.available)
+			checkTransactions(t, statements[0].Transactions, test.transactions)
+		})
+	}
+}
@@ -18,18 +18,115 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package importer
 
 import (
+	"archive/zip"
+	"bytes"
 	"encoding/xml"
-	"github.com/shopspring/decimal"
-
+	"errors"
 	"fmt"
-	"os"
+	"io"
+	"time"
+
+	"github.com/shopspring/decimal"
 )
 
 // portfolio performance xml impoorter
 
+// PortfolioClient is the content of a Portfolio Performance XML file.
 type PortfolioClient struct {
-	XMLName    xml.Name    `xml:"client"`
-	Portfolios []Portfolio `xml:"portfolios>portfolio"`
+	XMLName      xml.Name            `xml:"client"`
+	BaseCurrency string              `xml:"baseCurrency"`
+	Securities   []PortfolioSecurity `xml:"securities>security"`
+	Accounts     []PortfolioAccount  `xml:"accounts>account"`
+	Portfolios   []Portfolio         `xml:"portfolios>portfolio"`
+}
+
+// PortfolioSecurity is a security, like a share or a fund.
+type PortfolioSecurity struct {
+	UUID         string `xml:"uuid"`
+	Name         string `xml:"name"`
+	CurrencyCode string `xml:"currencyCode"`
+	ISIN         string `xml:"isin"`
+	WKN          string `xml:"wkn"`
+	TickerSymbol string `xml:"tickerSymbol"`
+	// Prices are the historical prices, ordered by date, and Latest is the
+	// latest quote, if any.
+	Prices []PortfolioPrice `xml:"prices>price"`
+	Latest *PortfolioPrice  `xml:"latest"`
+}
+
+// PortfolioPrice is the price of a security at a date, in the currency of
+// the security.
+type PortfolioPrice struct {
+	Date  string          `xml:"t,attr"`
+	Value decimal.Decimal `xml:"v,attr"`
+}
+
+// Price returns the price, which Portfolio Performance stores multiplied
+// by 10^8.
+func (p PortfolioPrice) Price() decimal.Decimal {
+	return p.Value.Shift(-8)
+}
+
+// Time returns the date of the price. Dates are checked by
+// PortfolioParseReader.
+func (p PortfolioPrice) Time() time.Time {
+	date, _ := portfolioParseDate(p.Date)
+	return date
+}
+
+// PriceAt returns the latest price of the security at the given date.
+func (s *PortfolioSecurity) PriceAt(date time.Time) (decimal.Decimal, bool) {
+	prices := s.Prices
+	if s.Latest != nil {
+		prices = append(prices[:len(prices):len(prices)], *s.Latest)
+	}
+	var price *PortfolioPrice
+	for i := range prices {
+		if t := prices[i].Time(); !t.After(date) && (price == nil || !t.Before(price.Time())) {
+			price = &prices[i]
+		}
+	}
+	if price == nil {
+		return decimal.Zero, false
+	}
+	return price.Price(), true
+}
+
+// PortfolioAccount is a deposit account, holding the cash of portfolios.
+type PortfolioAccount struct {
+	UUID         string                        `xml:"uuid"`
+	Name         string                        `xml:"name"`
+	CurrencyCode string                        `xml:"currencyCode"`
+	Transactions []PortfolioAccountTransaction `xml:"transactions>account-transaction"`
+}
+
+// PortfolioAccountTransaction is a transaction of a deposit account, like
+// DEPOSIT or DIVIDENDS. The amount is always positive.
+type PortfolioAccountTransaction struct {
+	UUID         string             `xml:"uuid"`
+	Type         string             `xml:"type"`
+	CurrencyCode string             `xml:"currencyCode"`
+	Amount       decimal.Decimal    `xml:"amount"`
+	Date         string             `xml:"date"`
+	Shares       decimal.Decimal    `xml:"shares"`
+	Note         string             `xml:"note"`
+	Security     *PortfolioSecurity `xml:"security"`
+	Units        PortfolioUnits     `xml:"units>unit"`
+	// CrossEntry links BUY and SELL transactions to their portfolio
+	// transaction, see PortfolioCrossEntry.
+	CrossEntry *PortfolioCrossEntry `xml:"-"`
+}
+
+// PortfolioCrossEntry links a BUY or SELL transaction of a portfolio to the
+// transaction of the deposit account paying for it or receiving the money.
+//
+// Portfolio Performance stores these links in crossEntry elements, which
+// are resolved by PortfolioParseReader.
+type PortfolioCrossEntry struct {
+	Portfolio            *Portfolio
+	PortfolioTransaction *PortfolioTransaction
+	Account              *PortfolioAccount
+	AccountTransaction   *PortfolioAccountTransaction
 }
 
 type Portfolio struct {
@@ -37,28 +134,507 @@ type Portfolio struct {
 	XMLName      xml.Name               `xml:"portfolio"`
 	Transactions []PortfolioTransaction `xml:"transactions>portfolio-transaction"`
 }
+
+// PortfolioTransaction is a transaction of a portfolio, like BUY or SELL.
+//
+// The amount includes fees and taxes, that is, for BUY, it is the amount
+// paid, and for SELL, the amount received.
 type PortfolioTransaction struct {
-	XMLName xml.Name        `xml:"portfolio-transaction"`
-	Amount  decimal.Decimal `xml:"amount"`
-	Date    string          `xml:"date"`
-	Shares  decimal.Decimal `xml:"shares"`
+	XMLName      xml.Name           `xml:"portfolio-transaction"`
+	UUID         string             `xml:"uuid"`
+	Type         string             `xml:"type"`
+	CurrencyCode string             `xml:"currencyCode"`
+	Amount       decimal.Decimal    `xml:"amount"`
+	Date         string             `xml:"date"`
+	Shares       decimal.Decimal    `xml:"shares"`
+	Note         string             `xml:"note"`
+	Security     *PortfolioSecurity `xml:"security"`
+	Units        PortfolioUnits     `xml:"units>unit"`
+	// CrossEntry links BUY and SELL transactions to their account
+	// transaction, see PortfolioCrossEntry.
+	CrossEntry *PortfolioCrossEntry `xml:"-"`
 }
 
-// LBBParseFile parses a CSV file generated by the Landesbank Berlin for their
-// Amazon credit cards.
-func PortfolioParse(path string) (*PortfolioClient, error) {
-	var client PortfolioClient
-	r, err := os.Open(path)
+// PortfolioUnit is a part of the amount of a transaction, like a fee.
+type PortfolioUnit struct {
+	// Type is GROSS_VALUE, FEE, or TAX
+	Type   string `xml:"type,attr"`
+	Amount struct {
+		Currency string          `xml:"currency,attr"`
+		Amount   decimal.Decimal `xml:"amount,attr"`
+	} `xml:"amount"`
+}
+
+// PortfolioUnits are the units of a transaction.
+type PortfolioUnits []PortfolioUnit
+
+// Sum returns the sum of the units of the given type, like FEE.
+func (u PortfolioUnits) Sum(typ string) decimal.Decimal {
+	sum := decimal.Zero
+	for _, unit := range u {
+		if unit.Type == typ {
+			sum = sum.Add(unit.Amount.Amount.Shift(-2))
+		}
+	}
+	return sum
+}
+
+// Symbol returns the ticker symbol of the security, or, if it has none, its
+// ISIN, WKN, or name.
+func (s *PortfolioSecurity) Symbol() string {
+	for _, symbol := range []string{s.TickerSymbol, s.ISIN, s.WKN} {
+		if symbol != "" {
+			return symbol
+		}
+	}
+	return s.Name
+}
+
+// Value returns the amount of the transaction, which Portfolio Performance
+// stores in cents.
+func (t *PortfolioTransaction) Value() decimal.Decimal {
+	return t.Amount.Shift(-2)
+}
+
+// Quantity returns the number of shares, which Portfolio Performance
+// stores multiplied by 10^8.
+func (t *PortfolioTransaction) Quantity() decimal.Decimal {
+	return t.Shares.Shift(-8)
+}
+
+// Time returns the date of the transaction. Dates are checked by
+// PortfolioParseReader.
+func (t *PortfolioTransaction) Time() time.Time {
+	date, _ := portfolioParseDate(t.Date)
+	return date
+}
+
+// Value returns the amount of the transaction, see
+// PortfolioTransaction.Value.
+func (t *PortfolioAccountTransaction) Value() decimal.Decimal {
+	return t.Amount.Shift(-2)
+}
+
+// Quantity returns the number of shares, see PortfolioTransaction.Quantity.
+func (t *PortfolioAccountTransaction) Quantity() decimal.Decimal {
+	return t.Shares.Shift(-8)
+}
+
+// Time returns the date of the transaction.
+func (t *PortfolioAccountTransaction) Time() time.Time {
+	date, _ := portfolioParseDate(t.Date)
+	return date
+}
+
+// portfolioTransaction adapts a portfolio transaction to the Transaction
+// interface. Amounts are stored in cents by Portfolio Performance.
+type portfolioTransaction struct {
+	portfolio *Portfolio
+	t         *PortfolioTransaction
+}
+
+// portfolioAccountTransaction adapts an account transaction to the
+// Transaction interface.
+type portfolioAccountTransaction struct {
+	account *PortfolioAccount
+	t       *PortfolioAccountTransaction
+}
+
+func init() {
+	Register(Format{
+		Name:   "portfolio",
+		Detect: portfolioDetect,
+		Parse: func(r io.Reader) ([]Transaction, error) {
+			client, err := PortfolioParseReader(r)
+			if client == nil {
+				return nil, err
+			}
+			return client.Transactions(), err
+		},
+	})
+}
+
+// Transactions returns the transactions of all deposit accounts and
+// portfolios. Portfolio transactions linked to an account transaction by
+// a cross entry are left out, as the account transaction already books
+// the money.
+func (c *PortfolioClient) Transactions() []Transaction {
+	var transactions []Transaction
+	for i := range c.Accounts {
+		a := &c.Accounts[i]
+		for j := range a.Transactions {
+			transactions = append(transactions, a.Transaction(j))
+		}
+	}
+	for i := range c.Portfolios {
+		p := &c.Portfolios[i]
+		for j := range p.Transactions {
+			if p.Transactions[j].CrossEntry == nil {
+				transactions = append(transactions, portfolioTransaction{p, &p.Transactions[j]})
+			}
+		}
+	}
+	return transactions
+}
+
+// Transaction returns the i-th transaction of the account as a
+// Transaction.
+func (a *PortfolioAccount) Transaction(i int) Transaction {
+	return portfolioAccountTransaction{a, &a.Transactions[i]}
+}
+
+func (t portfolioTransaction) ID() string {
+	if t.t.UUID != "" {
+		return t.t.UUID
+	}
+	return hashTransaction(t)
+}
+
+func (t portfolioTransaction) Category() Category {
+	return CategorySavingsInvestments
+}
+
+// LocalAccount returns the name of the portfolio.
+func (t portfolioTransaction) LocalAccount() string {
+	return t.portfolio.Name
+}
+
+// RemoteAccount returns the symbol of the security.
+func (t portfolioTransaction) RemoteAccount() string {
+	if t.t.Security == nil {
+		return ""
+	}
+	return t.t.Security.Symbol()
+}
+
+// RemoteName returns the type of the transaction, like BUY.
+func (t portfolioTransaction) RemoteName() string {
+	return t.t.Type
+}
+
+// ReferenceText returns the note of the transaction.
+func (t portfolioTransaction) ReferenceText() string {
+	return t.t.Note
+}
+
+// Amount returns the change of the portfolio's value, that is, it is
+// positive for shares added to the portfolio.
+func (t portfolioTransaction) Amount() decimal.Decimal {
+	amount := t.t.Value()
+	switch t.t.Type {
+	case "SELL", "TRANSFER_OUT", "DELIVERY_OUTBOUND":
+		return amount.Neg()
+	default:
+		return amount
+	}
+}
+
+// Date returns the date of the transaction.
+func (t portfolioTransaction) Date() time.Time {
+	return t.t.Time()
+}
+
+// ValutaDate returns the date of the transaction.
+func (t portfolioTransaction) ValutaDate() time.Time {
+	return t.Date()
+}
+
+// Currency returns the currency code of the transaction.
+func (t portfolioTransaction) Currency() string {
+	return t.t.CurrencyCode
+}
+
+func (t portfolioAccountTransaction) ID() string {
+	if t.t.UUID != "" {
+		return t.t.UUID
+	}
+	return hashTransaction(t)
+}
+
+// Category returns CategoryIncome for interest and dividends, and
+// CategorySavingsInvestments for other transactions concerning securities.
+func (t portfolioAccountTransaction) Category() Category {
+	switch t.t.Type {
+	case "INTEREST", "DIVIDENDS":
+		return CategoryIncome
+	case "BUY", "SELL", "FEES", "FEES_REFUND", "TAXES", "TAX_REFUND":
+		return CategorySavingsInvestments
+	}
+	return CategoryMisc
+}
+
+// LocalAccount returns the name of the account.
+func (t portfolioAccountTransaction) LocalAccount() string {
+	return t.account.Name
+}
+
+// RemoteAccount returns the symbol of the security, if any.
+func (t portfolioAccountTransaction) RemoteAccount() string {
+	if t.t.Security == nil {
+		return ""
+	}
+	return t.t.Security.Symbol()
+}
+
+// RemoteName returns the type of the transaction, like DEPOSIT.
+func (t portfolioAccountTransaction) RemoteName() string {
+	return t.t.Type
+}
+
+// ReferenceText returns the note of the transaction.
+func (t portfolioAccountTransaction) ReferenceText() string {
+	return t.t.Note
+}
+
+// Amount returns the change of the account's balance.
+func (t portfolioAccountTransaction) Amount() decimal.Decimal {
+	amount := t.t.Value()
+	switch t.t.Type {
+	case "REMOVAL", "INTEREST_CHARGE", "FEES", "TAXES", "BUY", "TRANSFER_OUT":
+		return amount.Neg()
+	default:
+		return amount
+	}
+}
+
+// Date returns the date of the transaction.
+func (t portfolioAccountTransaction) Date() time.Time {
+	return t.t.Time()
+}
+
+// ValutaDate returns the date of the transaction.
+func (t portfolioAccountTransaction) ValutaDate() time.Time {
+	return t.Date()
+}
+
+// Currency returns the currency code of the transaction.
+func (t portfolioAccountTransaction) Currency() string {
+	return t.t.CurrencyCode
+}
+
+// portfolioParseDate parses dates, which are either plain dates, or dates
+// with a time of day.
+func portfolioParseDate(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"} {
+		if date, err := time.Parse(layout, s); err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date")
+}
+
+// ErrPortfolioUnsupported is returned for encrypted Portfolio Performance
+// files, which are not supported. Such files can be saved unencrypted in
+// Portfolio Performance.
+var ErrPortfolioUnsupported = errors.New("encrypted Portfolio Performance files are not supported, save the file without a password")
+
+// Signatures of the binary and encrypted Portfolio Performance formats
+var (
+	portfolioBinarySignature    = []byte("PPPBV1")
+	portfolioEncryptedSignature = []byte("PORTFOLIO")
+	zipSignature                = []byte("PK\x03\x04")
+)
+
+// portfolioDetect checks whether data is a Portfolio Performance file,
+// including encrypted ones, so that parsing them reports
+// ErrPortfolioUnsupported.
+func portfolioDetect(data []byte) bool {
+	if bytes.HasPrefix(data, portfolioBinarySignature) || bytes.HasPrefix(data, portfolioEncryptedSignature) {
+		return true
+	}
+	if bytes.HasPrefix(data, zipSignature) {
+		_, err := portfolioUnzip(data)
+		return err == nil
+	}
+	return detectXMLRoot(data, "client", "")
+}
+
+// portfolioUnzip returns the content of a compressed Portfolio Performance
+// file, which is a ZIP archive holding a data.xml file, or, for the
+// binary format, a data.portfolio file.
+func portfolioUnzip(data []byte) ([]byte, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		r.Close()
-	}()
-	err = xml.NewDecoder(r).Decode(&client)
+	for _, f := range archive.File {
+		switch f.Name {
+		case "data.xml", "data.portfolio":
+			r, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer func() {
+				r.Close()
+			}()
+			return io.ReadAll(r)
+		}
+	}
+	return nil, fmt.Errorf("no data.xml in archive")
+}
+
+// PortfolioParse parses a Portfolio Performance file.
+func PortfolioParse(path string) (client *PortfolioClient, err error) {
+	err = withFile(path, func(r io.Reader) error {
+		client, err = PortfolioParseReader(r)
+		return err
+	})
+	return client, err
+}
+
+// PortfolioParseReader parses a Portfolio Performance file in the XML or
+// the binary (protobuf) format, which may be compressed. The references in
+// XML files are resolved, so the securities of transactions point to the
+// securities of the client, and BUY and SELL transactions are linked by
+// cross entries.
+//
+// Prices and transactions with invalid dates are skipped and reported in a
+// ParseErrors error, along with the client. The record numbers are the
+// numbers of the transactions in the portfolio or account, or of the prices
+// of the security.
+func PortfolioParseReader(r io.Reader) (*PortfolioClient, error) {
+	data, err := io.ReadAll(r)
 	if err != nil {
-		fmt.Printf("%s", err)
 		return nil, err
 	}
-	return &client, nil
+	if bytes.HasPrefix(data, zipSignature) {
+		if data, err = portfolioUnzip(data); err != nil {
+			return nil, &ParseError{Err: err}
+		}
+	}
+	var client *PortfolioClient
+	var links map[string]string
+	switch {
+	case bytes.HasPrefix(data, portfolioEncryptedSignature):
+		err = ErrPortfolioUnsupported
+	case bytes.HasPrefix(data, portfolioBinarySignature):
+		client, links, err = portfolioDecodeProto(data[len(portfolioBinarySignature):])
+	default:
+		client, links, err = portfolioDecodeXML(data)
+	}
+	if err != nil {
+		return nil, &ParseError{Err: err}
+	}
+
+	var errs ParseErrors
+
+	securities := make(map[string]*PortfolioSecurity)
+	for i := range client.Securities {
+		s := &client.Securities[i]
+		securities[s.UUID] = s
+		var prices []PortfolioPrice
+		for j, p := range s.Prices {
+			if _, err := portfolioParseDate(p.Date); err != nil {
+				errs = append(errs, &ParseError{Record: j + 1, Column: s.Name + "/price", Value: p.Date, Err: err})
+				continue
+			}
+			prices = append(prices, p)
+		}
+		s.Prices = prices
+	}
+	linkSecurity := func(s *PortfolioSecurity) *PortfolioSecurity {
+		if s != nil && securities[s.UUID] != nil {
+			return securities[s.UUID]
+		}
+		return s
+	}
+	for i := range client.Accounts {
+		a := &client.Accounts[i]
+		var transactions []PortfolioAccountTransaction
+		for j, t := range a.Transactions {
+			if _, err := portfolioParseDate(t.Date); err != nil {
+				errs = append(errs, &ParseError{Record: j + 1, Column: a.Name + "/date", Value: t.Date, Err: err})
+				continue
+			}
+			t.Security = linkSecurity(t.Security)
+			transactions = append(transactions, t)
+		}
+		a.Transactions = transactions
+	}
+	for i := range client.Portfolios {
+		p := &client.Portfolios[i]
+		var transactions []PortfolioTransaction
+		for j, t := range p.Transactions {
+			if _, err := portfolioParseDate(t.Date); err != nil {
+				errs = append(errs, &ParseError{Record: j + 1, Column: p.Name + "/date", Value: t.Date, Err: err})
+				continue
+			}
+			t.Security = linkSecurity(t.Security)
+			transactions = append(transactions, t)
+		}
+		p.Transactions = transactions
+	}
+	client.linkCrossEntries(links)
+	return client, errs.result()
+}
+
+// portfolioDecodeXML decodes a client in the XML format, and returns the
+// links of its cross entries, see portfolioCrossEntries.
+func portfolioDecodeXML(data []byte) (*PortfolioClient, map[string]string, error) {
+	var client PortfolioClient
+	document, err := parseXStream(bytes.NewReader(data))
+	if err == nil {
+		err = document.decode(&client)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	links, err := portfolioCrossEntries(document)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &client, links, nil
+}
+
+// portfolioCrossEntries returns the UUIDs of the portfolio transactions the
+// account transactions, identified by their UUIDs, are linked to by their
+// cross entries.
+func portfolioCrossEntries(d *xstreamDocument) (map[string]string, error) {
+	links := make(map[string]string)
+	transactions, err := d.find(d.root, "accounts", "account", "transactions", "account-transaction")
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range transactions {
+		uuid, err := d.find(t, "uuid")
+		if err != nil || len(uuid) == 0 {
+			continue
+		}
+		other, err := d.find(t, "crossEntry", "portfolioTransaction", "uuid")
+		if err != nil {
+			return nil, err
+		}
+		if len(other) != 0 {
+			links[uuid[0].text()] = other[0].text()
+		}
+	}
+	return links, nil
+}
+
+// linkCrossEntries links the account transactions to the portfolio
+// transactions given by their UUIDs in links.
+func (c *PortfolioClient) linkCrossEntries(links map[string]string) {
+	type entry struct {
+		p *Portfolio
+		t *PortfolioTransaction
+	}
+	transactions := make(map[string]entry)
+	for i := range c.Portfolios {
+		p := &c.Portfolios[i]
+		for j := range p.Transactions {
+			transactions[p.Transactions[j].UUID] = entry{p, &p.Transactions[j]}
+		}
+	}
+	for i := range c.Accounts {
+		a := &c.Accounts[i]
+		for j := range a.Transactions {
+			at := &a.Transactions[j]
+			pt, ok := transactions[links[at.UUID]]
+			if !ok || at.UUID == "" || pt.t.CrossEntry != nil {
+				continue
+			}
+			at.CrossEntry = &PortfolioCrossEntry{Portfolio: pt.p, PortfolioTransaction: pt.t, Account: a, AccountTransaction: at}
+			pt.t.CrossEntry = at.CrossEntry
+		}
+	}
 }
@@ -0,0 +1,329 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package importer
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// portfolioSummary describes the transactions of the client, including the
+// linked securities and cross entries, one per line.
+func portfolioSummary(c *PortfolioClient) string {
+	var lines []string
+	security := func(s *PortfolioSecurity) string {
+		if s == nil {
+			return "-"
+		}
+		return fmt.Sprintf("%s(%d prices)", s.Symbol(), len(s.Prices))
+	}
+	crossEntry := func(e *PortfolioCrossEntry) string {
+		if e == nil {
+			return "-"
+		}
+		return e.Account.Name + "/" + e.AccountTransaction.UUID + "<>" + e.Portfolio.Name + "/" + e.PortfolioTransaction.UUID
+	}
+	for _, a := range c.Accounts {
+		for _, t := range a.Transactions {
+			lines = append(lines, fmt.Sprintf("%s: %s %s %s %s %s %s %s", a.Name, t.UUID, t.Type, t.Time().Format("2006-01-02"), t.Value(), t.CurrencyCode, security(t.Security), crossEntry(t.CrossEntry)))
+		}
+	}
+	for _, p := range c.Portfolios {
+		for _, t := range p.Transactions {
+			lines = append(lines, fmt.Sprintf("%s: %s %s %s %s %s %s fees %s %s", p.Name, t.UUID, t.Type, t.Time().Format("2006-01-02"), t.Value(), t.Quantity(), security(t.Security), t.Units.Sum("FEE"), crossEntry(t.CrossEntry)))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestPortfolioParseXStreamReferences(t *testing.T) {
+	want := strings.Join([]string{
+		"Cash: at1 BUY 2017-01-02 409.95 EUR IE00B4L5Y983(1 prices) Cash/at1<>Depot/pt1",
+		"Depot: pt1 BUY 2017-01-02 409.95 10 IE00B4L5Y983(1 prices) fees 9.95 Cash/at1<>Depot/pt1",
+		"Depot: pt2 SELL 2017-03-02 240 5 IE00B4L5Y983(1 prices) fees 0 -",
+	}, "\n")
+	for _, file := range []string{"testdata/portfolio-paths.xml", "testdata/portfolio-ids.xml"} {
+		client, err := PortfolioParse(file)
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		if got := portfolioSummary(client); got != want {
+			t.Errorf("%s: got\n%s\nwant\n%s", file, got, want)
+		}
+	}
+}
+
+func TestPortfolioParseInvalidDates(t *testing.T) {
+	client, err := PortfolioParseReader(strings.NewReader(`<client>
+  <securities>
+    <security><uuid>s1</uuid><name>World</name><isin>IE00B4L5Y983</isin><prices><price t="2017-01-02" v="4000000000"/><price t="2017-02-30" v="4100000000"/></prices></security>
+  </securities>
+  <accounts>
+    <account><uuid>a1</uuid><name>Cash</name><currencyCode>EUR</currencyCode>
+      <transactions>
+        <account-transaction><uuid>at1</uuid><date>2017-01-02T00:00</date><currencyCode>EUR</currencyCode><amount>1000</amount><type>DEPOSIT</type></account-transaction>
+        <account-transaction><uuid>at2</uuid><date>yesterday</date><currencyCode>EUR</currencyCode><amount>1000</amount><type>DEPOSIT</type></account-transaction>
+      </transactions>
+    </account>
+  </accounts>
+</client>`))
+	errs, err := Lenient(err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 2 || errs[0].Record != 2 || errs[0].Column != "World/price" || errs[1].Record != 2 || errs[1].Column != "Cash/date" {
+		t.Errorf("got errors %v, want errors for the second price and transaction", errs)
+	}
+	// The records with invalid dates are skipped
+	if got, want := portfolioSummary(client), "Cash: at1 DEPOSIT 2017-01-02 10 EUR - -"; got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if len(client.Securities) != 1 || len(client.Securities[0].Prices) != 1 {
+		t.Errorf("invalid price not skipped")
+	}
+}
+
+func TestPortfolioTransactions(t *testing.T) {
+	client, err := PortfolioParseReader(strings.NewReader(`<client>
+  <securities>
+    <security><uuid>s1</uuid><name>World</name><isin>IE00B4L5Y983</isin></security>
+  </securities>
+  <accounts>
+    <account><uuid>a1</uuid><name>Cash</name><currencyCode>EUR</currencyCode>
+      <transactions>
+        <account-transaction><uuid>at1</uuid><date>2017-01-02T00:00</date><currencyCode>EUR</currencyCode><amount>100000</amount><type>DEPOSIT</type></account-transaction>
+        <account-transaction><uuid>at2</uuid><date>2017-01-03T00:00</date><currencyCode>EUR</currencyCode><amount>500</amount><note>Account fee</note><type>FEES</type></account-transaction>
+        <account-transaction><uuid>at3</uuid><date>2017-01-04</date><currencyCode>EUR</currencyCode><amount>1200</amount><security><uuid>s1</uuid></security><type>DIVIDENDS</type></account-transaction>
+        <account-transaction><date>2017-01-05T00:00</date><currencyCode>EUR</currencyCode><amount>2000</amount><type>REMOVAL</type></account-transaction>
+      </transactions>
+    </account>
+  </accounts>
+  <portfolios>
+    <portfolio><uuid>p1</uuid><name>Depot</name>
+      <transactions>
+        <portfolio-transaction><uuid>pt1</uuid><date>2017-01-06T00:00</date><currencyCode>EUR</currencyCode><amount>40000</amount><security><uuid>s1</uuid></security><shares>1000000000</shares><type>DELIVERY_OUTBOUND</type></portfolio-transaction>
+      </transactions>
+    </portfolio>
+  </portfolios>
+</client>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transactions := client.Transactions()
+	// Transactions without a UUID get a hash ID
+	removal := transactions[3].ID()
+	checkTransactions(t, transactions, []string{
+		"at1|2017-01-02|2017-01-02|Cash|DEPOSIT|||1000|EUR",
+		"at2|2017-01-03|2017-01-03|Cash|FEES||Account fee|-5|EUR",
+		"at3|2017-01-04|2017-01-04|Cash|DIVIDENDS|IE00B4L5Y983||12|EUR",
+		removal + "|2017-01-05|2017-01-05|Cash|REMOVAL|||-20|EUR",
+		"pt1|2017-01-06|2017-01-06|Depot|DELIVERY_OUTBOUND|IE00B4L5Y983||-400|EUR",
+	})
+	if len(removal) != 64 {
+		t.Errorf("got ID %q for a transaction without UUID, want a hash", removal)
+	}
+	for i, want := range []Category{CategoryMisc, CategorySavingsInvestments, CategoryIncome, CategoryMisc, CategorySavingsInvestments} {
+		if got := transactions[i].Category(); got != want {
+			t.Errorf("transaction %d: got category %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestPortfolioLinkCrossEntries(t *testing.T) {
+	client := &PortfolioClient{
+		Accounts: []PortfolioAccount{{Name: "Cash", Transactions: []PortfolioAccountTransaction{
+			{UUID: "at1", Type: "BUY"},
+			// pt1 is already linked to at1
+			{UUID: "at2", Type: "BUY"},
+			{UUID: "at3", Type: "SELL"},
+			{Type: "SELL"},
+		}}},
+		Portfolios: []Portfolio{{Name: "Depot", Transactions: []PortfolioTransaction{
+			{UUID: "pt1", Type: "BUY"},
+			{UUID: "pt2", Type: "SELL"},
+		}}},
+	}
+	client.linkCrossEntries(map[string]string{"at1": "pt1", "at2": "pt1", "at3": "unknown", "": "pt2"})
+
+	a, p := &client.Accounts[0], &client.Portfolios[0]
+	e := a.Transactions[0].CrossEntry
+	if e == nil || e.Account != a || e.AccountTransaction != &a.Transactions[0] || e.Portfolio != p || e.PortfolioTransaction != &p.Transactions[0] {
+		t.Fatalf("at1 is not linked to pt1: %+v", e)
+	}
+	if p.Transactions[0].CrossEntry != e {
+		t.Errorf("pt1 is not linked to at1")
+	}
+	for i := 1; i < len(a.Transactions); i++ {
+		if a.Transactions[i].CrossEntry != nil {
+			t.Errorf("account transaction %d is linked to %s", i, a.Transactions[i].CrossEntry.PortfolioTransaction.UUID)
+		}
+	}
+	if p.Transactions[1].CrossEntry != nil {
+		t.Errorf("pt2 is linked")
+	}
+
+	// Linked portfolio transactions are left out, as the account
+	// transaction books the money
+	var types []string
+	for _, tr := range client.Transactions() {
+		types = append(types, tr.RemoteName())
+	}
+	if got, want := strings.Join(types, " "), "BUY BUY SELL SELL SELL"; got != want {
+		t.Errorf("got transactions %s, want %s", got, want)
+	}
+}
+
+func TestPortfolioPriceAt(t *testing.T) {
+	s := PortfolioSecurity{
+		// Prices do not have to be ordered
+		Prices: []PortfolioPrice{{"2017-01-05", decimal.New(41, 8)}, {"2017-01-02", decimal.New(40, 8)}},
+		Latest: &PortfolioPrice{"2017-01-10", decimal.New(42, 8)},
+	}
+	for _, test := range []struct {
+		date  string
+		price int64
+		ok    bool
+	}{
+		{"2017-01-01", 0, false},
+		{"2017-01-02", 40, true},
+		{"2017-01-04", 40, true},
+		{"2017-01-05", 41, true},
+		{"2017-01-09", 41, true},
+		{"2017-01-20", 42, true},
+	} {
+		date, _ := time.Parse("2006-01-02", test.date)
+		price, ok := s.PriceAt(date)
+		if ok != test.ok || !price.Equal(decimal.New(test.price, 0)) {
+			t.Errorf("%s: got %s %v, want %d %v", test.date, price, ok, test.price, test.ok)
+		}
+	}
+}
+
+// protoMessage builds protobuf messages for tests.
+type protoMessage []byte
+
+func (m protoMessage) varint(value uint64) protoMessage {
+	var buf [binary.MaxVarintLen64]byte
+	return append(m, buf[:binary.PutUvarint(buf[:], value)]...)
+}
+
+func (m protoMessage) int(number int, value int64) protoMessage {
+	return m.varint(uint64(number<<3 | protoVarint)).varint(uint64(value))
+}
+
+func (m protoMessage) bytes(number int, value []byte) protoMessage {
+	m = m.varint(uint64(number<<3 | protoBytes)).varint(uint64(len(value)))
+	return append(m, value...)
+}
+
+func (m protoMessage) string(number int, value string) protoMessage {
+	return m.bytes(number, []byte(value))
+}
+
+// testPortfolioProto is a client in the binary format with a purchase, a
+// dividend, and a transfer of cash and of the shares.
+func testPortfolioProto() []byte {
+	// 2017-01-02 as seconds and days since 1970-01-01
+	const seconds, days = 1483315200, 17168
+	date := protoMessage{}.int(1, seconds)
+	client := protoMessage{}.
+		int(1, 58).
+		bytes(2, protoMessage{}.string(1, "s1").string(3, "World").string(4, "EUR").string(7, "IE00B4L5Y983").
+			bytes(13, protoMessage{}.int(1, days).int(2, 4000000000)).
+			bytes(16, protoMessage{}.int(1, days+1).int(2, 4100000000))).
+		bytes(3, protoMessage{}.string(1, "a1").string(2, "Cash").string(3, "EUR")).
+		bytes(3, protoMessage{}.string(1, "a2").string(2, "Savings").string(3, "EUR")).
+		bytes(4, protoMessage{}.string(1, "p1").string(2, "Depot")).
+		bytes(4, protoMessage{}.string(1, "p2").string(2, "Other")).
+		// PURCHASE
+		bytes(5, protoMessage{}.string(1, "pt1").int(2, 0).string(3, "a1").string(4, "p1").string(7, "at1").
+			bytes(9, date).string(10, "EUR").int(11, 40995).int(12, 1000000000).string(14, "s1").
+			bytes(15, protoMessage{}.int(1, 2).int(2, 995).string(3, "EUR"))).
+		// DIVIDEND
+		bytes(5, protoMessage{}.string(1, "at2").int(2, 8).string(3, "a1").
+			bytes(9, date).string(10, "EUR").int(11, 500).string(14, "s1").string(13, "Q1")).
+		// CASH_TRANSFER
+		bytes(5, protoMessage{}.string(1, "at3").int(2, 5).string(3, "a1").string(5, "a2").string(7, "at4").
+			bytes(9, date).string(10, "EUR").int(11, 100)).
+		// SECURITY_TRANSFER
+		bytes(5, protoMessage{}.string(1, "pt2").int(2, 4).string(4, "p1").string(6, "p2").string(7, "pt3").
+			bytes(9, date).string(10, "EUR").int(11, 40000).int(12, 1000000000).string(14, "s1")).
+		string(12, "EUR")
+	return append([]byte("PPPBV1"), client...)
+}
+
+func TestPortfolioParseProto(t *testing.T) {
+	data := testPortfolioProto()
+	var zipped bytes.Buffer
+	w := zip.NewWriter(&zipped)
+	f, err := w.Create("data.portfolio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := strings.Join([]string{
+		"Cash: at1 BUY 2017-01-02 409.95 EUR IE00B4L5Y983(1 prices) Cash/at1<>Depot/pt1",
+		"Cash: at2 DIVIDENDS 2017-01-02 5 EUR IE00B4L5Y983(1 prices) -",
+		"Cash: at3 TRANSFER_OUT 2017-01-02 1 EUR - -",
+		"Savings: at4 TRANSFER_IN 2017-01-02 1 EUR - -",
+		"Depot: pt1 BUY 2017-01-02 409.95 10 IE00B4L5Y983(1 prices) fees 9.95 Cash/at1<>Depot/pt1",
+		"Depot: pt2 TRANSFER_OUT 2017-01-02 400 10 IE00B4L5Y983(1 prices) fees 0 -",
+		"Other: pt3 TRANSFER_IN 2017-01-02 400 10 IE00B4L5Y983(1 prices) fees 0 -",
+	}, "\n")
+	for name, data := range map[string][]byte{"plain": data, "zipped": zipped.Bytes()} {
+		if f, ok := Detect(data); !ok || f.Name != "portfolio" {
+			t.Errorf("%s: detected %q, want portfolio", name, f.Name)
+		}
+		client, err := PortfolioParseReader(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got := portfolioSummary(client); got != want {
+			t.Errorf("%s: got\n%s\nwant\n%s", name, got, want)
+		}
+		if client.BaseCurrency != "EUR" {
+			t.Errorf("%s: got base currency %q, want EUR", name, client.BaseCurrency)
+		}
+		s := client.Securities[0]
+		if s.Prices[0].Date != "2017-01-02" || !s.Prices[0].Price().Equal(decimal.RequireFromString("40")) || s.Latest == nil || s.Latest.Date != "2017-01-03" {
+			t.Errorf("%s: got prices %v, latest %v", name, s.Prices, s.Latest)
+		}
+	}
+
+	if _, err := PortfolioParseReader(bytes.NewReader(data[:len(data)-3])); err == nil {
+		t.Errorf("no error for a truncated file")
+	}
+	if _, err := PortfolioParseReader(strings.NewReader("PORTFOLIO\x01encrypted")); err == nil || !strings.Contains(err.Error(), ErrPortfolioUnsupported.Error()) {
+		t.Errorf("got %v for an encrypted file, want %v", err, ErrPortfolioUnsupported)
+	}
+}
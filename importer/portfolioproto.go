@@ -0,0 +1,427 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package importer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Portfolio Performance's binary format is the signature PPPBV1 followed by
+// a protobuf PClient message, see client.proto in its sources. Only the
+// fields used by PortfolioClient are decoded.
+
+// Wire types of protobuf fields
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// protoField is a field of a protobuf message. Value is the value of
+// varint fields, and Bytes the content of length-delimited ones.
+type protoField struct {
+	Number int
+	Type   int
+	Value  uint64
+	Bytes  []byte
+}
+
+// errProtoTruncated is returned for messages that end within a field.
+var errProtoTruncated = errors.New("truncated protobuf message")
+
+// protoFields splits a protobuf message into its fields.
+func protoFields(data []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errProtoTruncated
+		}
+		data = data[n:]
+		f := protoField{Number: int(key >> 3), Type: int(key & 7)}
+		switch f.Type {
+		case protoVarint:
+			if f.Value, n = binary.Uvarint(data); n <= 0 {
+				return nil, errProtoTruncated
+			}
+			data = data[n:]
+		case protoFixed64, protoFixed32:
+			size := 8
+			if f.Type == protoFixed32 {
+				size = 4
+			}
+			if len(data) < size {
+				return nil, errProtoTruncated
+			}
+			data = data[size:]
+		case protoBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return nil, errProtoTruncated
+			}
+			f.Bytes = data[n : n+int(length)]
+			data = data[n+int(length):]
+		default:
+			return nil, fmt.Errorf("unsupported protobuf wire type %d", f.Type)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// protoDecode calls fn for each field of the message.
+func protoDecode(data []byte, fn func(f protoField) error) error {
+	fields, err := protoFields(data)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Int returns the value of an int64 or enum field.
+func (f protoField) Int() int64 {
+	return int64(f.Value)
+}
+
+// String returns the value of a string field.
+func (f protoField) String() string {
+	return string(f.Bytes)
+}
+
+// protoTransactionTypes are the names of the PTransaction types, in the
+// order of their numbers.
+var protoTransactionTypes = []string{
+	"PURCHASE", "SALE", "INBOUND_DELIVERY", "OUTBOUND_DELIVERY",
+	"SECURITY_TRANSFER", "CASH_TRANSFER", "DEPOSIT", "REMOVAL", "DIVIDEND",
+	"INTEREST", "INTEREST_CHARGE", "TAX", "TAX_REFUND", "FEE", "FEE_REFUND",
+}
+
+// protoAccountTypes maps PTransaction types that only concern a deposit
+// account to the types of the XML format.
+var protoAccountTypes = map[string]string{
+	"DEPOSIT":         "DEPOSIT",
+	"REMOVAL":         "REMOVAL",
+	"DIVIDEND":        "DIVIDENDS",
+	"INTEREST":        "INTEREST",
+	"INTEREST_CHARGE": "INTEREST_CHARGE",
+	"TAX":             "TAXES",
+	"TAX_REFUND":      "TAX_REFUND",
+	"FEE":             "FEES",
+	"FEE_REFUND":      "FEES_REFUND",
+}
+
+// protoUnitTypes are the names of the PTransactionUnit types.
+var protoUnitTypes = []string{"GROSS_VALUE", "TAX", "FEE"}
+
+// protoTransaction is a decoded PTransaction. Both sides of transfers and
+// of purchases and sales are stored in one transaction, the other side is
+// identified by OtherUUID in OtherAccount or OtherPortfolio.
+type protoTransaction struct {
+	UUID, Type                   string
+	Account, Portfolio           string
+	OtherAccount, OtherPortfolio string
+	OtherUUID                    string
+	Date                         string
+	CurrencyCode                 string
+	Amount, Shares               decimal.Decimal
+	Note, Security               string
+	Units                        PortfolioUnits
+}
+
+// protoDate returns the date of a google.protobuf.Timestamp in the format
+// of the XML files.
+func protoDate(data []byte) (string, error) {
+	var seconds int64
+	err := protoDecode(data, func(f protoField) error {
+		if f.Number == 1 {
+			seconds = f.Int()
+		}
+		return nil
+	})
+	return time.Unix(seconds, 0).UTC().Format("2006-01-02T15:04"), err
+}
+
+// protoPrice decodes a PHistoricalPrice or PFullHistoricalPrice, whose date
+// is the number of days since 1970-01-01.
+func protoPrice(data []byte) (PortfolioPrice, error) {
+	var p PortfolioPrice
+	err := protoDecode(data, func(f protoField) error {
+		switch f.Number {
+		case 1:
+			p.Date = time.Unix(f.Int()*24*60*60, 0).UTC().Format("2006-01-02")
+		case 2:
+			p.Value = decimal.New(f.Int(), 0)
+		}
+		return nil
+	})
+	return p, err
+}
+
+// protoSecurity decodes a PSecurity.
+func protoSecurity(data []byte) (PortfolioSecurity, error) {
+	var s PortfolioSecurity
+	err := protoDecode(data, func(f protoField) error {
+		switch f.Number {
+		case 1:
+			s.UUID = f.String()
+		case 3:
+			s.Name = f.String()
+		case 4:
+			s.CurrencyCode = f.String()
+		case 7:
+			s.ISIN = f.String()
+		case 8:
+			s.TickerSymbol = f.String()
+		case 9:
+			s.WKN = f.String()
+		case 13:
+			p, err := protoPrice(f.Bytes)
+			s.Prices = append(s.Prices, p)
+			return err
+		case 16:
+			p, err := protoPrice(f.Bytes)
+			s.Latest = &p
+			return err
+		}
+		return nil
+	})
+	return s, err
+}
+
+// protoUnit decodes a PTransactionUnit.
+func protoUnit(data []byte) (PortfolioUnit, error) {
+	var u PortfolioUnit
+	u.Type = protoUnitTypes[0]
+	err := protoDecode(data, func(f protoField) error {
+		switch f.Number {
+		case 1:
+			if f.Value >= uint64(len(protoUnitTypes)) {
+				return fmt.Errorf("unknown unit type %d", f.Value)
+			}
+			u.Type = protoUnitTypes[f.Value]
+		case 2:
+			u.Amount.Amount = decimal.New(f.Int(), 0)
+		case 3:
+			u.Amount.Currency = f.String()
+		}
+		return nil
+	})
+	return u, err
+}
+
+// protoDecodeTransaction decodes a PTransaction.
+func protoDecodeTransaction(data []byte) (*protoTransaction, error) {
+	t := &protoTransaction{Type: protoTransactionTypes[0]}
+	err := protoDecode(data, func(f protoField) error {
+		var err error
+		switch f.Number {
+		case 1:
+			t.UUID = f.String()
+		case 2:
+			if f.Value >= uint64(len(protoTransactionTypes)) {
+				return fmt.Errorf("unknown transaction type %d", f.Value)
+			}
+			t.Type = protoTransactionTypes[f.Value]
+		case 3:
+			t.Account = f.String()
+		case 4:
+			t.Portfolio = f.String()
+		case 5:
+			t.OtherAccount = f.String()
+		case 6:
+			t.OtherPortfolio = f.String()
+		case 7:
+			t.OtherUUID = f.String()
+		case 9:
+			t.Date, err = protoDate(f.Bytes)
+		case 10:
+			t.CurrencyCode = f.String()
+		case 11:
+			t.Amount = decimal.New(f.Int(), 0)
+		case 12:
+			t.Shares = decimal.New(f.Int(), 0)
+		case 13:
+			t.Note = f.String()
+		case 14:
+			t.Security = f.String()
+		case 15:
+			var u PortfolioUnit
+			u, err = protoUnit(f.Bytes)
+			t.Units = append(t.Units, u)
+		}
+		return err
+	})
+	return t, err
+}
+
+// portfolioDecodeProto decodes a PClient message into a client, and returns
+// the links between account and portfolio transactions like
+// portfolioCrossEntries.
+func portfolioDecodeProto(data []byte) (*PortfolioClient, map[string]string, error) {
+	var client PortfolioClient
+	var transactions []*protoTransaction
+	accounts := make(map[string]int)
+	portfolios := make(map[string]int)
+	err := protoDecode(data, func(f protoField) error {
+		switch f.Number {
+		case 2:
+			s, err := protoSecurity(f.Bytes)
+			client.Securities = append(client.Securities, s)
+			return err
+		case 3:
+			var a PortfolioAccount
+			err := protoDecode(f.Bytes, func(f protoField) error {
+				switch f.Number {
+				case 1:
+					a.UUID = f.String()
+				case 2:
+					a.Name = f.String()
+				case 3:
+					a.CurrencyCode = f.String()
+				}
+				return nil
+			})
+			accounts[a.UUID] = len(client.Accounts)
+			client.Accounts = append(client.Accounts, a)
+			return err
+		case 4:
+			var p Portfolio
+			var uuid string
+			err := protoDecode(f.Bytes, func(f protoField) error {
+				switch f.Number {
+				case 1:
+					uuid = f.String()
+				case 2:
+					p.Name = f.String()
+				}
+				return nil
+			})
+			portfolios[uuid] = len(client.Portfolios)
+			client.Portfolios = append(client.Portfolios, p)
+			return err
+		case 5:
+			t, err := protoDecodeTransaction(f.Bytes)
+			transactions = append(transactions, t)
+			return err
+		case 12:
+			client.BaseCurrency = f.String()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	securities := make(map[string]*PortfolioSecurity)
+	for i := range client.Securities {
+		securities[client.Securities[i].UUID] = &client.Securities[i]
+	}
+	account := func(uuid string) (*PortfolioAccount, error) {
+		i, ok := accounts[uuid]
+		if !ok {
+			return nil, fmt.Errorf("unknown account %q", uuid)
+		}
+		return &client.Accounts[i], nil
+	}
+	portfolio := func(uuid string) (*Portfolio, error) {
+		i, ok := portfolios[uuid]
+		if !ok {
+			return nil, fmt.Errorf("unknown portfolio %q", uuid)
+		}
+		return &client.Portfolios[i], nil
+	}
+	links := make(map[string]string)
+	for _, t := range transactions {
+		at := PortfolioAccountTransaction{UUID: t.UUID, Type: protoAccountTypes[t.Type], CurrencyCode: t.CurrencyCode, Amount: t.Amount, Date: t.Date, Shares: t.Shares, Note: t.Note, Security: securities[t.Security], Units: t.Units}
+		pt := PortfolioTransaction{UUID: t.UUID, CurrencyCode: t.CurrencyCode, Amount: t.Amount, Date: t.Date, Shares: t.Shares, Note: t.Note, Security: securities[t.Security], Units: t.Units}
+		switch t.Type {
+		case "PURCHASE", "SALE":
+			// The units and shares belong to the portfolio transaction
+			pt.Type, at.Type = "BUY", "BUY"
+			if t.Type == "SALE" {
+				pt.Type, at.Type = "SELL", "SELL"
+			}
+			at.UUID, at.Shares, at.Units = t.OtherUUID, decimal.Zero, nil
+			p, err := portfolio(t.Portfolio)
+			if err != nil {
+				return nil, nil, err
+			}
+			a, err := account(t.Account)
+			if err != nil {
+				return nil, nil, err
+			}
+			p.Transactions = append(p.Transactions, pt)
+			a.Transactions = append(a.Transactions, at)
+			links[at.UUID] = pt.UUID
+		case "INBOUND_DELIVERY", "OUTBOUND_DELIVERY":
+			pt.Type = "DELIVERY_INBOUND"
+			if t.Type == "OUTBOUND_DELIVERY" {
+				pt.Type = "DELIVERY_OUTBOUND"
+			}
+			p, err := portfolio(t.Portfolio)
+			if err != nil {
+				return nil, nil, err
+			}
+			p.Transactions = append(p.Transactions, pt)
+		case "SECURITY_TRANSFER":
+			out, err := portfolio(t.Portfolio)
+			if err != nil {
+				return nil, nil, err
+			}
+			in, err := portfolio(t.OtherPortfolio)
+			if err != nil {
+				return nil, nil, err
+			}
+			pt.Type = "TRANSFER_OUT"
+			out.Transactions = append(out.Transactions, pt)
+			pt.UUID, pt.Type = t.OtherUUID, "TRANSFER_IN"
+			in.Transactions = append(in.Transactions, pt)
+		case "CASH_TRANSFER":
+			out, err := account(t.Account)
+			if err != nil {
+				return nil, nil, err
+			}
+			in, err := account(t.OtherAccount)
+			if err != nil {
+				return nil, nil, err
+			}
+			at.Type = "TRANSFER_OUT"
+			out.Transactions = append(out.Transactions, at)
+			at.UUID, at.Type = t.OtherUUID, "TRANSFER_IN"
+			in.Transactions = append(in.Transactions, at)
+		default:
+			a, err := account(t.Account)
+			if err != nil {
+				return nil, nil, err
+			}
+			a.Transactions = append(a.Transactions, at)
+		}
+	}
+	return &client, links, nil
+}
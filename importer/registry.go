@@ -0,0 +1,144 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Format describes a file format that can be parsed into transactions.
+type Format struct {
+	// Name is a short name of the format, like hbci
+	Name string
+	// Detect checks whether data, the content of a file, is in this format
+	Detect func(data []byte) bool
+	// Parse parses the content of a file
+	Parse func(r io.Reader) ([]Transaction, error)
+	// ParseStatements parses the content of a file into statements with
+	// balances. It is nil for formats without balances.
+	ParseStatements func(r io.Reader) ([]Statement, error)
+}
+
+// ErrUnknownFormat is returned by ParseAny if no format matched.
+var ErrUnknownFormat = errors.New("unknown file format")
+
+var (
+	formatsMutex sync.RWMutex
+	formats      []Format
+)
+
+// Register registers a format for Lookup, Detect, and ParseAny. A format
+// registered with the same name as an existing one replaces it.
+//
+// The built-in formats are hbci, lbb, n26, n26-csv, portfolio, camt, mt940,
+// and ofx.
+func Register(f Format) {
+	formatsMutex.Lock()
+	defer formatsMutex.Unlock()
+	for i := range formats {
+		if formats[i].Name == f.Name {
+			formats[i] = f
+			return
+		}
+	}
+	formats = append(formats, f)
+}
+
+// Formats returns all registered formats.
+func Formats() []Format {
+	formatsMutex.RLock()
+	defer formatsMutex.RUnlock()
+	return append([]Format(nil), formats...)
+}
+
+// Lookup returns the format with the given name.
+func Lookup(name string) (Format, bool) {
+	for _, f := range Formats() {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Format{}, false
+}
+
+// Detect returns the first registered format whose Detect function accepts
+// the data.
+func Detect(data []byte) (Format, bool) {
+	for _, f := range Formats() {
+		if f.Detect != nil && f.Detect(data) {
+			return f, true
+		}
+	}
+	return Format{}, false
+}
+
+// ParseAny reads all of r, detects its format, and parses it. It returns
+// ErrUnknownFormat if the format could not be detected.
+func ParseAny(r io.Reader) ([]Transaction, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := Detect(data)
+	if !ok {
+		return nil, ErrUnknownFormat
+	}
+	return f.Parse(bytes.NewReader(data))
+}
+
+// detectXMLRoot checks whether data is an XML document with the given root
+// element, and the root element's namespace contains ns.
+func detectXMLRoot(data []byte, root string, ns string) bool {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	// Only the name of the root element matters, so ignore the encoding
+	decoder.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	for {
+		token, err := decoder.RawToken()
+		if err != nil {
+			return false
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			if start.Name.Local != root {
+				return false
+			}
+			for _, attr := range start.Attr {
+				if attr.Name.Local == "xmlns" && bytes.Contains([]byte(attr.Value), []byte(ns)) {
+					return true
+				}
+			}
+			return ns == ""
+		}
+	}
+}
+
+// firstLines returns up to n lines at the start of data.
+func firstLines(data []byte, n int) []string {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for len(lines) < n && scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
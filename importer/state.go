@@ -0,0 +1,207 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package importer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// State records the IDs of imported transactions per local account in a
+// file, so that transactions occurring in several imported files are only
+// imported once.
+//
+// Transactions marked as imported are pending until Commit is called;
+// Rollback forgets them again, for example if writing the journal failed.
+type State struct {
+	path     string
+	imported map[string]map[string]bool
+	pending  map[string]map[string]bool
+}
+
+// OpenState reads the state file at path. If it does not exist yet, the
+// state is empty, and the file is created on Commit.
+func OpenState(path string) (*State, error) {
+	s := &State{
+		path:     path,
+		imported: make(map[string]map[string]bool),
+		pending:  make(map[string]map[string]bool),
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var accounts map[string][]string
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for account, ids := range accounts {
+		s.imported[account] = make(map[string]bool)
+		for _, id := range ids {
+			s.imported[account][id] = true
+		}
+	}
+	return s, nil
+}
+
+// aliasPrefix marks the aliases of imported transactions in the state, see
+// AliasedTransaction.
+const aliasPrefix = "alias:"
+
+// Imported checks whether the transaction has been marked as imported,
+// including pending marks. A transaction also counts as imported if its ID
+// is an alias of a marked transaction, or one of its aliases is the ID of
+// a marked transaction, see AliasedTransaction. IDs of transactions without
+// a local account, as in files that do not name it, match the IDs of any
+// account.
+func (s *State) Imported(t Transaction) bool {
+	ids := []string{t.ID(), aliasPrefix + t.ID()}
+	if a, ok := t.(AliasedTransaction); ok {
+		ids = append(ids, a.Aliases()...)
+	}
+	accounts := []string{t.LocalAccount(), ""}
+	if t.LocalAccount() == "" {
+		accounts = nil
+		for _, marks := range []map[string]map[string]bool{s.imported, s.pending} {
+			for account := range marks {
+				accounts = append(accounts, account)
+			}
+		}
+	}
+	for _, account := range accounts {
+		for _, id := range ids {
+			if s.imported[account][id] || s.pending[account][id] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Mark marks the transaction, and its aliases, as imported.
+func (s *State) Mark(t Transaction) {
+	if s.imported[t.LocalAccount()][t.ID()] {
+		return
+	}
+	if s.pending[t.LocalAccount()] == nil {
+		s.pending[t.LocalAccount()] = make(map[string]bool)
+	}
+	s.pending[t.LocalAccount()][t.ID()] = true
+	if a, ok := t.(AliasedTransaction); ok {
+		for _, alias := range a.Aliases() {
+			s.pending[t.LocalAccount()][aliasPrefix+alias] = true
+		}
+	}
+}
+
+// Filter returns the transactions that have not been imported before, and
+// marks them as imported. Transactions are not compared to each other, as
+// transactions with the same ID in one file are different transactions;
+// parsers give the same ID to identical transactions only if the bank does.
+func (s *State) Filter(transactions []Transaction) []Transaction {
+	var result []Transaction
+	for _, t := range transactions {
+		if !s.Imported(t) {
+			result = append(result, t)
+		}
+	}
+	for _, t := range result {
+		s.Mark(t)
+	}
+	return result
+}
+
+// Rollback forgets all marks since the last Commit.
+func (s *State) Rollback() {
+	s.pending = make(map[string]map[string]bool)
+}
+
+// Commit writes the state, including all pending marks, to the file.
+func (s *State) Commit() error {
+	accounts := make(map[string][]string)
+	for _, marks := range []map[string]map[string]bool{s.imported, s.pending} {
+		for account, ids := range marks {
+			for id := range ids {
+				accounts[account] = append(accounts[account], id)
+			}
+		}
+	}
+	for _, ids := range accounts {
+		sort.Strings(ids)
+	}
+
+	data, err := json.MarshalIndent(accounts, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, append(data, '\n')); err != nil {
+		return err
+	}
+
+	for account, ids := range s.pending {
+		if s.imported[account] == nil {
+			s.imported[account] = make(map[string]bool)
+		}
+		for id := range ids {
+			s.imported[account][id] = true
+		}
+	}
+	s.Rollback()
+	return nil
+}
+
+// writeFileAtomic replaces the file at path by a file with the given data.
+// The permissions of an existing file are kept.
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Only has an effect if we failed before the rename
+		os.Remove(f.Name())
+	}()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,150 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package importer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testHBCI has two identical card payments, which have hash IDs
+const testHBCI = `localIban;remoteIban;remoteAccountNumber;localAccountNumber;remoteName;ultimateDebtor;ultimateCreditor;value_value;value_currency;purpose;date;fiId;bankReference;type;transactionText
+DE89370400440532013000;;;;Bakery;;;-2.50;EUR;Card payment;2017/01/02;;;statement;
+DE89370400440532013000;;;;Bakery;;;-2.50;EUR;Card payment;2017/01/02;;;statement;
+DE89370400440532013000;;;;Employer;;;1000/1;EUR;Salary;2017/01/02;FI-1;;statement;
+`
+
+func testHBCITransactions(t *testing.T) []Transaction {
+	t.Helper()
+	transactions, err := HBCIParse(strings.NewReader(testHBCI), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transactions
+}
+
+func ids(transactions []Transaction) []string {
+	var ids []string
+	for _, t := range transactions {
+		ids = append(ids, t.ID())
+	}
+	return ids
+}
+
+func TestNumberOccurrences(t *testing.T) {
+	got := ids(testHBCITransactions(t))
+	if len(got) != 3 || got[1] != got[0]+"-2" || got[2] != "FI-1" {
+		t.Errorf("got IDs %v, want HASH, HASH-2, FI-1", got)
+	}
+	// The IDs stay the same when parsing again
+	if again := ids(testHBCITransactions(t)); !reflect.DeepEqual(again, got) {
+		t.Errorf("got IDs %v, then %v", got, again)
+	}
+}
+
+func TestStateFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	s, err := OpenState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transactions := testHBCITransactions(t)
+
+	// Identical transactions in one file are all new
+	if got := s.Filter(transactions[:2]); len(got) != 2 {
+		t.Errorf("got %d new transactions, want 2", len(got))
+	}
+	// Pending marks count until they are rolled back
+	if got := ids(s.Filter(transactions)); !reflect.DeepEqual(got, []string{"FI-1"}) {
+		t.Errorf("got new transactions %v, want [FI-1]", got)
+	}
+	s.Rollback()
+	if got := s.Filter(transactions); len(got) != 3 {
+		t.Errorf("got %d new transactions after rollback, want 3", len(got))
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("state file written before commit: %v", err)
+	}
+
+	if err := s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	s.Rollback()
+	if got := s.Filter(transactions); len(got) != 0 {
+		t.Errorf("got %d new transactions after commit, want 0", len(got))
+	}
+
+	// The state is read again, and transactions of other accounts are new
+	s, err = OpenState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Filter(transactions); len(got) != 0 {
+		t.Errorf("got %d new transactions after reopening, want 0", len(got))
+	}
+	other, err := HBCIParse(strings.NewReader(strings.Replace(testHBCI, "DE89370400440532013000", "DE02100100100006820101", -1)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Filter(other); len(got) != 3 {
+		t.Errorf("got %d new transactions of another account, want 3", len(got))
+	}
+}
+
+func TestStateCommitKeepsPermissions(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state")
+	s, err := OpenState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Filter(testHBCITransactions(t))
+	if err := s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("got mode %v, want 0644", info.Mode().Perm())
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("got mode %v, want 0600", info.Mode().Perm())
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %d files, want only the state file", len(entries))
+	}
+}
@@ -46,11 +46,34 @@ const (
 	CategoryHealthcareDrugstores
 )
 
+var categoryNames = []string{
+	CategoryMisc:                 "misc",
+	CategoryATM:                  "atm",
+	CategoryBusiness:             "business",
+	CategoryFoodGroceries:        "food-groceries",
+	CategoryIncome:               "income",
+	CategoryLeisureEntertainment: "leisure-entertainment",
+	CategorySavingsInvestments:   "savings-investments",
+	CategoryShopping:             "shopping",
+	CategoryTransportCar:         "transport-car",
+	CategoryTravelHolidays:       "travel-holidays",
+	CategoryBarsRestaurants:      "bars-restaurants",
+	CategoryHealthcareDrugstores: "healthcare-drugstores",
+}
+
+// String returns a lower case name of the category, like food-groceries.
+func (c Category) String() string {
+	if c < 0 || int(c) >= len(categoryNames) {
+		return fmt.Sprintf("category-%d", int(c))
+	}
+	return categoryNames[c]
+}
+
 // Transaction describes a generic incoming transaction.
 type Transaction interface {
 	// An identifier describing the description, to filter out duplicates.
 	//
-	// If the bank does not provide identifiers, use hashTransaction() when
+	// If the bank does not provide identifiers, use hashID() when
 	// implementing a new transaction parser.
 	ID() string
 	// Category of the transaction
@@ -109,38 +132,105 @@ type MultilineTransaction interface {
 	Purposes() []string
 }
 
+// PendingTransaction is a transaction that might not be booked yet.
+type PendingTransaction interface {
+	Transaction
+
+	// Pending returns true if the bank has not booked the transaction yet.
+	Pending() bool
+}
+
+// AliasedTransaction is a transaction that may also have been imported
+// from another source, where it has a different ID, like the JSON data and
+// the CSV export of N26.
+type AliasedTransaction interface {
+	Transaction
+
+	// Aliases returns the IDs of the transaction in other sources. They
+	// are only compared to the IDs of other transactions, not to their
+	// aliases, so transactions sharing an alias are not duplicates.
+	Aliases() []string
+}
+
+// SpaceTransaction is a transaction that might be a transfer between an
+// account and one of its sub-accounts, like the Spaces of N26.
+type SpaceTransaction interface {
+	Transaction
+
+	// Space returns the name and, if known, the ID of the sub-account
+	// money is transferred to or from, or empty strings if the transaction
+	// is not such a transfer.
+	Space() (name string, id string)
+}
+
+// Balance is the balance of an account at a given date.
+type Balance struct {
+	Date     time.Time
+	Amount   decimal.Decimal
+	Currency string
+}
+
+// Statement is a list of transactions of a local account, together with
+// the balances reported by the bank, if any.
+type Statement struct {
+	LocalAccount string
+	// Opening and Closing are the balances before the first and after the
+	// last transaction of the statement.
+	Opening *Balance
+	Closing *Balance
+	// Available is the balance available for use at the end of the
+	// statement.
+	Available    *Balance
+	Transactions []Transaction
+}
+
 // hashTransaction is a base implementation for Transaction.ID().
-// It just hashes all values using SHA1.
+// It just hashes all values using SHA256.
 func hashTransaction(t Transaction) string {
 	hash := sha256.New()
-	_, err := hash.Write([]byte(t.Date().String()))
-	if err != nil {
-		panic(err)
-	}
-	_, err = hash.Write([]byte(t.ValutaDate().String()))
-	if err != nil {
-		panic(err)
-	}
-	_, err = hash.Write([]byte(t.LocalAccount()))
-	if err != nil {
-		panic(err)
-	}
-	_, err = hash.Write([]byte(t.RemoteName()))
-	if err != nil {
-		panic(err)
-	}
-	_, err = hash.Write([]byte(t.RemoteAccount()))
-	if err != nil {
-		panic(err)
-	}
-	_, err = hash.Write([]byte(t.ReferenceText()))
-	if err != nil {
-		panic(err)
-	}
-	_, err = hash.Write([]byte(fmt.Sprint(t.Amount())))
-	if err != nil {
-		panic(err)
+	// Writing to a hash never fails
+	for _, value := range []string{
+		t.Date().String(),
+		t.ValutaDate().String(),
+		t.LocalAccount(),
+		t.RemoteName(),
+		t.RemoteAccount(),
+		t.ReferenceText(),
+		fmt.Sprint(t.Amount()),
+	} {
+		hash.Write([]byte(value))
 	}
 
 	return fmt.Sprintf("%x", hash.Sum(nil))
 }
+
+// hashID returns the hash of the transaction, see hashTransaction, followed
+// by -N if it is the Nth transaction with this hash, see numberOccurrences.
+func hashID(t Transaction, occurrence int) string {
+	if occurrence > 1 {
+		return fmt.Sprintf("%s-%d", hashTransaction(t), occurrence)
+	}
+	return hashTransaction(t)
+}
+
+// occurrenceTransaction is a transaction whose ID may be a hash, which is
+// numbered by numberOccurrences.
+type occurrenceTransaction interface {
+	Transaction
+	setOccurrence(n int)
+}
+
+// numberOccurrences numbers the transactions with the same ID in order, so
+// that identical transactions, like two card payments of the same amount on
+// one day, get different hash IDs. The IDs stay the same when the same
+// file is parsed again.
+func numberOccurrences(transactions []Transaction) {
+	seen := make(map[string]int)
+	for _, t := range transactions {
+		if ot, ok := t.(occurrenceTransaction); ok {
+			id := t.ID()
+			seen[id]++
+			ot.setOccurrence(seen[id])
+		}
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package importer
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// summary describes the values of a transaction in one line, for comparing
+// them in tests.
+func summary(t Transaction) string {
+	values := []string{
+		t.ID(),
+		t.Date().Format("2006-01-02"),
+		t.ValutaDate().Format("2006-01-02"),
+		t.LocalAccount(),
+		t.RemoteName(),
+		t.RemoteAccount(),
+		t.ReferenceText(),
+		t.Amount().String(),
+		t.Currency(),
+	}
+	if f, ok := t.(ForeignTransaction); ok && f.ForeignCurrency() != "" {
+		values = append(values, f.ForeignAmount().String(), f.ForeignCurrency())
+	}
+	if p, ok := t.(PendingTransaction); ok && p.Pending() {
+		values = append(values, "pending")
+	}
+	return strings.Join(values, "|")
+}
+
+// checkTransactions checks the summaries of the transactions.
+func checkTransactions(t *testing.T, transactions []Transaction, want []string) {
+	t.Helper()
+	for i, tr := range transactions {
+		got := summary(tr)
+		if i >= len(want) {
+			t.Errorf("unexpected transaction %d: %s", i, got)
+			continue
+		}
+		if got != want[i] {
+			t.Errorf("transaction %d:\n got %s\nwant %s", i, got, want[i])
+		}
+	}
+	if len(transactions) < len(want) {
+		t.Errorf("got %d transactions, want %d", len(transactions), len(want))
+	}
+}
+
+// balance describes a balance, or nil, in one line.
+func balance(b *Balance) string {
+	if b == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%s %s %s", b.Date.Format("2006-01-02"), b.Amount, b.Currency)
+}
+
+// checkStatement checks the local account and the balances of a statement.
+func checkStatement(t *testing.T, s Statement, account, opening, closing, available string) {
+	t.Helper()
+	if s.LocalAccount != account {
+		t.Errorf("got local account %q, want %q", s.LocalAccount, account)
+	}
+	for _, b := range []struct{ name, got, want string }{
+		{"opening", balance(s.Opening), opening},
+		{"closing", balance(s.Closing), closing},
+		{"available", balance(s.Available), available},
+	} {
+		if b.got != b.want {
+			t.Errorf("got %s balance %s, want %s", b.name, b.got, b.want)
+		}
+	}
+}
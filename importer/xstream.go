@@ -0,0 +1,275 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package importer
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// xstreamNode is an element of an XML document written by XStream.
+type xstreamNode struct {
+	start  xml.StartElement
+	parent *xstreamNode
+	depth  int
+	// content are the child elements (*xstreamNode) and the character
+	// data (xml.CharData) in document order.
+	content []interface{}
+}
+
+// xstreamDocument is an XML document written by XStream, a Java library
+// that serializes object graphs. An object that occurs more than once is
+// only written in full the first time; later occurrences are elements
+// with a reference attribute, which is either the relative path to the
+// first occurrence, like "../../securities/security[2]", or the value of
+// its id attribute.
+type xstreamDocument struct {
+	root *xstreamNode
+	ids  map[string]*xstreamNode
+}
+
+// parseXStream reads an XStream document.
+func parseXStream(r io.Reader) (*xstreamDocument, error) {
+	d := &xstreamDocument{ids: make(map[string]*xstreamNode)}
+	decoder := xml.NewDecoder(r)
+	var current *xstreamNode
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			n := &xstreamNode{start: token.Copy(), parent: current}
+			if current == nil {
+				if d.root != nil {
+					return nil, fmt.Errorf("more than one root element")
+				}
+				d.root = n
+			} else {
+				n.depth = current.depth + 1
+				current.content = append(current.content, n)
+			}
+			if id := n.attr("id"); id != "" {
+				d.ids[id] = n
+			}
+			current = n
+		case xml.EndElement:
+			current = current.parent
+		case xml.CharData:
+			if current != nil {
+				current.content = append(current.content, token.Copy())
+			}
+		}
+	}
+	if d.root == nil {
+		return nil, fmt.Errorf("no root element")
+	}
+	return d, nil
+}
+
+// attr returns the value of the attribute with the given name.
+func (n *xstreamNode) attr(name string) string {
+	for _, attr := range n.start.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// children returns the child elements with the given name.
+func (n *xstreamNode) children(name string) []*xstreamNode {
+	var children []*xstreamNode
+	for _, c := range n.content {
+		if c, ok := c.(*xstreamNode); ok && c.start.Name.Local == name {
+			children = append(children, c)
+		}
+	}
+	return children
+}
+
+// leaf checks whether the element has no child elements and is not a
+// reference.
+func (n *xstreamNode) leaf() bool {
+	for _, c := range n.content {
+		if _, ok := c.(*xstreamNode); ok {
+			return false
+		}
+	}
+	return n.attr("reference") == ""
+}
+
+// text returns the character data of the element.
+func (n *xstreamNode) text() string {
+	var b strings.Builder
+	for _, c := range n.content {
+		if c, ok := c.(xml.CharData); ok {
+			b.Write(c)
+		}
+	}
+	return b.String()
+}
+
+// resolve returns the element n refers to, or n if it is no reference.
+func (d *xstreamDocument) resolve(n *xstreamNode) (*xstreamNode, error) {
+	for seen := 0; n.attr("reference") != ""; seen++ {
+		if seen > 100 {
+			return nil, fmt.Errorf("reference loop at %q", n.attr("reference"))
+		}
+		reference := n.attr("reference")
+		if !strings.Contains(reference, "/") && !strings.HasPrefix(reference, ".") {
+			target, ok := d.ids[reference]
+			if !ok {
+				return nil, fmt.Errorf("unknown reference id %q", reference)
+			}
+			n = target
+			continue
+		}
+		for i, component := range strings.Split(reference, "/") {
+			switch {
+			case component == "" && i == 0:
+				// Absolute paths start with the root element
+				n = &xstreamNode{content: []interface{}{d.root}, depth: -1}
+			case component == "" || component == ".":
+			case component == "..":
+				n = n.parent
+			default:
+				n = n.child(component)
+			}
+			if n == nil {
+				return nil, fmt.Errorf("cannot resolve reference %q", reference)
+			}
+		}
+	}
+	return n, nil
+}
+
+// child returns the child element for a path component like "name" or
+// "name[2]", where the index starts at 1.
+func (n *xstreamNode) child(component string) *xstreamNode {
+	name, index := component, 1
+	if i := strings.IndexByte(component, '['); i != -1 && strings.HasSuffix(component, "]") {
+		var err error
+		if index, err = strconv.Atoi(component[i+1 : len(component)-1]); err != nil {
+			return nil
+		}
+		name = component[:i]
+	}
+	children := n.children(name)
+	if index < 1 || index > len(children) {
+		return nil
+	}
+	return children[index-1]
+}
+
+// find returns the elements at the path of element names below n,
+// resolving references on the way.
+func (d *xstreamDocument) find(n *xstreamNode, path ...string) ([]*xstreamNode, error) {
+	nodes := []*xstreamNode{n}
+	for _, name := range path {
+		var next []*xstreamNode
+		for _, n := range nodes {
+			for _, c := range n.children(name) {
+				c, err := d.resolve(c)
+				if err != nil {
+					return nil, err
+				}
+				next = append(next, c)
+			}
+		}
+		nodes = next
+	}
+	return nodes, nil
+}
+
+// tokens returns the tokens of the document with the references resolved.
+//
+// The objects are needed in full at their shallowest occurrence, which in
+// Portfolio Performance files are the lists of the client, like the
+// securities. A reference is thus replaced by a copy of the element it
+// refers to if it is nested less deeply, and otherwise by a stub holding
+// only the child elements without children, like the uuid. A reference to
+// an element that is being copied is always replaced by a stub.
+func (d *xstreamDocument) tokens() ([]xml.Token, error) {
+	return d.emit(nil, d.root, 0, make(map[*xstreamNode]bool))
+}
+
+// emit appends the tokens of the element n at the given depth, see tokens.
+func (d *xstreamDocument) emit(tokens []xml.Token, n *xstreamNode, depth int, copying map[*xstreamNode]bool) ([]xml.Token, error) {
+	target, err := d.resolve(n)
+	if err != nil {
+		return nil, err
+	}
+	full := target == n || (depth < target.depth && !copying[target])
+	start := xml.StartElement{Name: n.start.Name}
+	for _, attr := range target.start.Attr {
+		if attr.Name.Local != "id" && attr.Name.Local != "reference" {
+			start.Attr = append(start.Attr, attr)
+		}
+	}
+	tokens = append(tokens, start)
+	if full {
+		copying[target] = true
+		defer delete(copying, target)
+	}
+	for _, c := range target.content {
+		switch c := c.(type) {
+		case xml.CharData:
+			if full {
+				tokens = append(tokens, c)
+			}
+		case *xstreamNode:
+			if full || c.leaf() {
+				if tokens, err = d.emit(tokens, c, depth+1, copying); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return append(tokens, start.End()), nil
+}
+
+// xstreamTokens implements xml.TokenReader for a list of tokens.
+type xstreamTokens []xml.Token
+
+func (t *xstreamTokens) Token() (xml.Token, error) {
+	if len(*t) == 0 {
+		return nil, io.EOF
+	}
+	token := (*t)[0]
+	*t = (*t)[1:]
+	return token, nil
+}
+
+// decode decodes the document with the references resolved into v, like
+// xml.Unmarshal.
+func (d *xstreamDocument) decode(v interface{}) error {
+	tokens, err := d.tokens()
+	if err != nil {
+		return err
+	}
+	reader := xstreamTokens(tokens)
+	return xml.NewTokenDecoder(&reader).Decode(v)
+}
@@ -0,0 +1,131 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package goledger
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Journal is a list of transactions, forming a ledger file
+type Journal []Transaction
+
+// Print prints all transactions in the journal to the writer, in hledger
+// syntax
+func (j Journal) Print(w io.Writer) error {
+	return j.Render(w, HledgerRenderer{})
+}
+
+// Render renders all transactions in the journal to the writer
+func (j Journal) Render(w io.Writer, r Renderer) error {
+	for i := range j {
+		if err := r.RenderTransaction(w, &j[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteFile writes the journal to the file at path, using the renderer r,
+// or hledger syntax if r is nil.
+//
+// The journal is first written to a temporary file in the same directory
+// which then replaces path, so readers either see the old or the new
+// journal, but never a partially written one. The permissions of an
+// existing file are kept.
+func (j Journal) WriteFile(path string, r Renderer) error {
+	if r == nil {
+		r = HledgerRenderer{}
+	}
+	return writeFileAtomic(path, func(w io.Writer) error {
+		return j.Render(w, r)
+	})
+}
+
+// AppendFile appends the journal to the file at path, which is created if
+// it does not exist yet. Like WriteFile, the file is replaced atomically.
+func (j Journal) AppendFile(path string, r Renderer) error {
+	if r == nil {
+		r = HledgerRenderer{}
+	}
+	existing, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return writeFileAtomic(path, func(w io.Writer) error {
+		if _, err := w.Write(existing); err != nil {
+			return err
+		}
+		// Separate the new transactions by an empty line
+		var separator string
+		switch {
+		case len(existing) == 0 || bytes.HasSuffix(existing, []byte("\n\n")):
+		case bytes.HasSuffix(existing, []byte("\n")):
+			separator = "\n"
+		default:
+			separator = "\n\n"
+		}
+		if _, err := io.WriteString(w, separator); err != nil {
+			return err
+		}
+		return j.Render(w, r)
+	})
+}
+
+// writeFileAtomic calls write with a temporary file and renames the
+// temporary file to path if write succeeded.
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Only has an effect if we failed before the rename
+		os.Remove(f.Name())
+	}()
+
+	bw := bufio.NewWriter(f)
+	if err := write(bw); err != nil {
+		f.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,141 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package goledger
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+var errWrite = errors.New("write failed")
+
+// failingWriter fails all writes
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errWrite
+}
+
+// failingRenderer fails to render any transaction
+type failingRenderer struct{}
+
+func (failingRenderer) RenderTransaction(w io.Writer, t *Transaction) error {
+	return errWrite
+}
+
+var testJournalTransactions = Journal{{
+	Date:        time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC),
+	Description: "REWE",
+	Postings: []Posting{
+		{Account: "assets:bank", Value: decimal.New(-5, 0), Currency: "EUR"},
+		{Account: "expenses:food", Value: decimal.New(5, 0), Currency: "EUR"},
+	},
+}}
+
+const testJournalPrinted = "2017/01/02 REWE\n    assets:bank  -5.00 EUR\n    expenses:food  5.00 EUR\n\n"
+
+// checkDir checks that dir only contains the file name with the given
+// content and permissions, and no temporary files.
+func checkDir(t *testing.T, dir string, name string, content string, mode os.FileMode) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != name {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("got files %v, want only %s", names, name)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != content {
+		t.Errorf("got content:\n%s\nwant:\n%s", data, content)
+	}
+	info, err := os.Stat(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != mode {
+		t.Errorf("got mode %v, want %v", info.Mode().Perm(), mode)
+	}
+}
+
+func TestPrintErrors(t *testing.T) {
+	if err := testJournalTransactions.Print(failingWriter{}); !errors.Is(err, errWrite) {
+		t.Errorf("Journal.Print: got error %v, want %v", err, errWrite)
+	}
+	if err := testJournalTransactions[0].Print(failingWriter{}); !errors.Is(err, errWrite) {
+		t.Errorf("Transaction.Print: got error %v, want %v", err, errWrite)
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.journal")
+
+	if err := testJournalTransactions.WriteFile(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkDir(t, dir, "main.journal", testJournalPrinted, 0644)
+
+	// The permissions of the replaced file are kept
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := testJournalTransactions.AppendFile(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkDir(t, dir, "main.journal", testJournalPrinted+testJournalPrinted, 0600)
+
+	// If rendering fails, the file is not touched
+	if err := testJournalTransactions.WriteFile(path, failingRenderer{}); !errors.Is(err, errWrite) {
+		t.Errorf("got error %v, want %v", err, errWrite)
+	}
+	checkDir(t, dir, "main.journal", testJournalPrinted+testJournalPrinted, 0600)
+}
+
+func TestAppendFileSeparator(t *testing.T) {
+	for _, existing := range []string{"", "; a\n", "; a\n\n", "; a"} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "main.journal")
+		if existing != "" {
+			if err := os.WriteFile(path, []byte(existing), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := testJournalTransactions.AppendFile(path, nil); err != nil {
+			t.Fatal(err)
+		}
+		want := testJournalPrinted
+		if existing != "" {
+			want = "; a\n\n" + testJournalPrinted
+		}
+		checkDir(t, dir, "main.journal", want, 0644)
+	}
+}
@@ -0,0 +1,803 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package goledger
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/shopspring/decimal"
+)
+
+// ParseError describes an error at a specific line of a journal.
+type ParseError struct {
+	Path string
+	Line int
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.Path, e.Line, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// parser is a parser for ledger files in hledger syntax.
+type parser struct {
+	path    string
+	line    int
+	year    int
+	journal Journal
+	// current is the transaction whose postings are being parsed
+	current *Transaction
+	// inComment is set between "comment" and "end comment"
+	inComment bool
+	// inDirective is set while skipping the indented lines of a directive
+	inDirective bool
+	// commodity is the commodity of the current commodity directive
+	commodity string
+
+	// spans are the line ranges of the parsed transactions, and span the
+	// one of the current transaction
+	spans []lineSpan
+	span  lineSpan
+	// skipIncludes skips include directives instead of parsing the files
+	skipIncludes bool
+	// open are the absolute paths of the files being parsed, to detect
+	// include cycles
+	open map[string]bool
+	// stylesOnly only parses the directives declaring commodity styles,
+	// see ParseCommodityStyles
+	stylesOnly bool
+
+	// decimalMark is set by the decimal-mark directive
+	decimalMark byte
+	// styles are the commodity styles declared by commodity directives
+	styles CommodityStyles
+}
+
+// ParseJournal parses transactions in hledger (or ledger) syntax.
+//
+// Directives are skipped, except for Y/year, which sets the year for dates
+// without one, and the commodity and decimal-mark directives, which
+// determine the decimal mark of amounts. Otherwise, it is guessed. The
+// include directive is only supported by ParseJournalFile.
+// Postings without an amount are marked as elided; call Journal.Balance to
+// infer their amounts.
+func ParseJournal(r io.Reader) (Journal, error) {
+	p := newParser()
+	if err := p.parse(r); err != nil {
+		return nil, err
+	}
+	return p.journal, nil
+}
+
+// ParseJournalFile parses the journal file at path, see ParseJournal.
+func ParseJournalFile(path string) (Journal, error) {
+	p := newParser()
+	if err := p.parseFile(path); err != nil {
+		return nil, err
+	}
+	return p.journal, nil
+}
+
+// ParseCommodityStyles returns the commodity styles declared by the
+// commodity directives of a journal, like
+//
+//	commodity €1.000,00
+//	commodity BTC
+//	    format 1.00000000 BTC
+//
+// Only the commodity, decimal-mark, and comment directives are parsed, and
+// the include directive by ParseCommodityStylesFile, so errors in other
+// lines, and files that cannot be included, are ignored.
+func ParseCommodityStyles(r io.Reader) (CommodityStyles, error) {
+	p := newParser()
+	p.stylesOnly = true
+	if err := p.parse(r); err != nil {
+		return nil, err
+	}
+	return p.styles, nil
+}
+
+// ParseCommodityStylesFile parses the commodity styles of the journal file
+// at path, see ParseCommodityStyles.
+func ParseCommodityStylesFile(path string) (CommodityStyles, error) {
+	p := newParser()
+	p.stylesOnly = true
+	if err := p.parseFile(path); err != nil {
+		return nil, err
+	}
+	return p.styles, nil
+}
+
+func newParser() *parser {
+	return &parser{year: time.Now().Year(), styles: make(CommodityStyles), open: make(map[string]bool)}
+}
+
+func (p *parser) parseFile(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if p.open[abs] {
+		return p.errorf("include cycle: %s includes itself", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	p.open[abs] = true
+	defer func() {
+		delete(p.open, abs)
+		f.Close()
+	}()
+
+	sub := *p
+	sub.path = path
+	sub.line = 0
+	sub.current = nil
+	sub.inDirective = false
+	if err := sub.parse(f); err != nil {
+		return err
+	}
+	p.journal = sub.journal
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &ParseError{Path: p.path, Line: p.line, Err: fmt.Errorf(format, args...)}
+}
+
+func (p *parser) parse(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		p.line++
+		if err := p.parseLine(strings.TrimRight(scanner.Text(), "\r")); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	p.finishTransaction()
+	return nil
+}
+
+// lineSpan is a range of lines, from first to last, counting from 1.
+type lineSpan struct {
+	first, last int
+}
+
+func (p *parser) finishTransaction() {
+	if p.current != nil {
+		p.journal = append(p.journal, *p.current)
+		p.spans = append(p.spans, p.span)
+		p.current = nil
+	}
+}
+
+func (p *parser) parseLine(line string) error {
+	if p.inComment {
+		if strings.TrimSpace(line) == "end comment" {
+			p.inComment = false
+		}
+		return nil
+	}
+	if strings.TrimSpace(line) == "" {
+		p.finishTransaction()
+		p.inDirective = false
+		return nil
+	}
+	if p.stylesOnly {
+		return p.parseStyleLine(line)
+	}
+
+	if line[0] == ' ' || line[0] == '\t' {
+		switch {
+		case p.current != nil:
+			p.span.last = p.line
+			return p.parsePostingLine(strings.TrimSpace(line))
+		case p.inDirective:
+			return p.parseSubdirective(strings.TrimSpace(line))
+		default:
+			return p.errorf("unexpected indented line")
+		}
+	}
+
+	p.finishTransaction()
+	p.inDirective = false
+	switch {
+	case strings.ContainsRune(";#*%|", rune(line[0])):
+		return nil
+	case line[0] >= '0' && line[0] <= '9':
+		return p.parseTransactionHeader(line)
+	default:
+		return p.parseDirective(line)
+	}
+}
+
+func (p *parser) parseDirective(line string) error {
+	line, _ = splitComment(line)
+	fields := strings.Fields(line)
+	p.inDirective = true
+	p.commodity = ""
+	if len(fields) == 0 {
+		return nil
+	}
+
+	switch fields[0] {
+	case "commodity":
+		sample := strings.TrimSpace(strings.TrimPrefix(line, "commodity"))
+		if commodity, rest, err := p.parseCommodity(sample); err == nil && rest == "" {
+			// Only the commodity, possibly followed by a format subdirective
+			p.commodity = commodity
+			return nil
+		}
+		return p.parseCommodityStyle(sample)
+	case "decimal-mark":
+		if len(fields) != 2 || (fields[1] != "." && fields[1] != ",") {
+			return p.errorf("invalid decimal-mark directive")
+		}
+		p.decimalMark = fields[1][0]
+	case "comment":
+		p.inComment = true
+	case "Y", "year":
+		if len(fields) != 2 {
+			return p.errorf("invalid year directive")
+		}
+		year, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return p.errorf("invalid year %q", fields[1])
+		}
+		p.year = year
+	case "include", "!include":
+		if p.skipIncludes {
+			return nil
+		}
+		if p.path == "" {
+			return p.errorf("include is not supported when parsing from a reader")
+		}
+		if len(fields) != 2 {
+			return p.errorf("invalid include directive")
+		}
+		path := fields[1]
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(p.path), path)
+		}
+		return p.parseFile(path)
+	}
+	return nil
+}
+
+// parseStyleLine parses a line if it belongs to a directive declaring
+// commodity styles, see ParseCommodityStyles.
+func (p *parser) parseStyleLine(line string) error {
+	if line[0] == ' ' || line[0] == '\t' {
+		if p.inDirective {
+			return p.parseSubdirective(strings.TrimSpace(line))
+		}
+		return nil
+	}
+	p.inDirective = false
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case "commodity", "decimal-mark", "comment":
+		return p.parseDirective(line)
+	case "include", "!include":
+		// Only report errors in the directives of included files
+		var perr *ParseError
+		if err := p.parseDirective(line); errors.As(err, &perr) && perr.Path != p.path {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseSubdirective parses an indented line of a directive. Only the
+// format subdirective of the commodity directive is supported.
+func (p *parser) parseSubdirective(line string) error {
+	line, _ = splitComment(line)
+	if p.commodity == "" || !strings.HasPrefix(line, "format") {
+		return nil
+	}
+	return p.parseCommodityStyle(strings.TrimSpace(strings.TrimPrefix(line, "format")))
+}
+
+// parseCommodityStyle parses the sample amount of a commodity directive.
+func (p *parser) parseCommodityStyle(sample string) error {
+	commodity, style, err := parseCommodityStyle(sample, rune(p.decimalMark))
+	if err != nil {
+		return p.errorf("invalid commodity directive: %v", err)
+	}
+	if p.commodity != "" && commodity != p.commodity {
+		return p.errorf("format %q does not match commodity %q", sample, p.commodity)
+	}
+	p.styles[commodity] = style
+	return nil
+}
+
+// parseDate parses a date in one of the formats 2006/01/02, 2006-01-02,
+// or 2006.01.02, or without the year.
+func (p *parser) parseDate(s string) (time.Time, error) {
+	sep := strings.IndexAny(s, "/-.")
+	if sep == -1 {
+		return time.Time{}, p.errorf("invalid date %q", s)
+	}
+	parts := strings.Split(s, s[sep:sep+1])
+	if len(parts) == 2 {
+		parts = append([]string{strconv.Itoa(p.year)}, parts...)
+	}
+	if len(parts) != 3 {
+		return time.Time{}, p.errorf("invalid date %q", s)
+	}
+	var numbers [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return time.Time{}, p.errorf("invalid date %q", s)
+		}
+		numbers[i] = n
+	}
+	date := time.Date(numbers[0], time.Month(numbers[1]), numbers[2], 0, 0, 0, 0, time.UTC)
+	if date.Month() != time.Month(numbers[1]) || date.Day() != numbers[2] {
+		return time.Time{}, p.errorf("invalid date %q", s)
+	}
+	return date, nil
+}
+
+// splitComment splits a line into content and the comment following a ';'
+func splitComment(line string) (string, string) {
+	i := strings.IndexByte(line, ';')
+	if i == -1 {
+		return strings.TrimSpace(line), ""
+	}
+	return strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+}
+
+// parseComment splits a comment into text and tags. A comment consists
+// either of tags written as "name: value" or "name:" and separated by
+// commas, of ledger-style tags like ":name1:name2:", or of text.
+func parseComment(comment string) (string, []Tag) {
+	comment = strings.TrimSpace(comment)
+	if len(comment) > 1 && strings.HasPrefix(comment, ":") && strings.HasSuffix(comment, ":") {
+		var tags []Tag
+		for _, name := range strings.Split(comment[1:len(comment)-1], ":") {
+			if !validTagName(name) {
+				return comment, nil
+			}
+			tags = append(tags, Tag{Name: name})
+		}
+		return "", tags
+	}
+
+	var tags []Tag
+	for _, part := range strings.Split(comment, ",") {
+		part = strings.TrimSpace(part)
+		i := tagColon(part)
+		if i == -1 {
+			// A single tag whose value contains commas
+			if i := tagColon(comment); i != -1 {
+				return "", []Tag{{Name: comment[:i], Value: strings.TrimSpace(comment[i+1:])}}
+			}
+			return comment, nil
+		}
+		tags = append(tags, Tag{Name: part[:i], Value: strings.TrimSpace(part[i+1:])})
+	}
+	return "", tags
+}
+
+// validTagName checks that name is not empty and contains no spaces.
+func validTagName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " \t")
+}
+
+// tagColon returns the index of the colon after the tag name s starts
+// with, or -1 if s does not start with a tag. The colon must be followed
+// by a space or end s, so that URLs like https://example.com are no tags.
+func tagColon(s string) int {
+	i := strings.IndexByte(s, ':')
+	if i == -1 || !validTagName(s[:i]) || (i+1 < len(s) && s[i+1] != ' ' && s[i+1] != '\t') {
+		return -1
+	}
+	return i
+}
+
+// appendLine appends a line to a multi-line text
+func appendLine(text, line string) string {
+	switch {
+	case line == "":
+		return text
+	case text == "":
+		return line
+	default:
+		return text + "\n" + line
+	}
+}
+
+// ledgerDatesRe matches ledger-style posting dates like [2017/01/02=2017/01/03]
+var ledgerDatesRe = regexp.MustCompile(`\[([0-9]+[/.-][0-9]+(?:[/.-][0-9]+)?)?(?:=([0-9]+[/.-][0-9]+(?:[/.-][0-9]+)?))?\]`)
+
+// addComment adds a comment to the last posting of the current transaction,
+// or to the transaction itself if it has no postings yet. The id tag of a
+// transaction is stored as its ID, and the date and date2 tags or ledger
+// style [date=date2] comments of a posting as its dates.
+func (p *parser) addComment(comment string) error {
+	n := len(p.current.Postings)
+	if n == 0 {
+		text, tags := parseComment(comment)
+		p.current.Comment = appendLine(p.current.Comment, text)
+		for _, tag := range tags {
+			if tag.Name == "id" && p.current.ID == "" {
+				p.current.ID = tag.Value
+			} else {
+				p.current.Tags = append(p.current.Tags, tag)
+			}
+		}
+		return nil
+	}
+
+	var err error
+	posting := &p.current.Postings[n-1]
+	if m := ledgerDatesRe.FindStringSubmatchIndex(comment); m != nil && m[1]-m[0] > 2 {
+		if m[2] != -1 {
+			if posting.Date, err = p.parseDate(comment[m[2]:m[3]]); err != nil {
+				return err
+			}
+		}
+		if m[4] != -1 {
+			if posting.ValutaDate, err = p.parseDate(comment[m[4]:m[5]]); err != nil {
+				return err
+			}
+		}
+		comment = comment[:m[0]] + comment[m[1]:]
+	}
+	text, tags := parseComment(comment)
+	posting.Comment = appendLine(posting.Comment, text)
+	for _, tag := range tags {
+		switch tag.Name {
+		case "date":
+			posting.Date, err = p.parseDate(tag.Value)
+		case "date2":
+			posting.ValutaDate, err = p.parseDate(tag.Value)
+		default:
+			posting.Tags = append(posting.Tags, tag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseStatus parses a status mark at the start of s, and returns the
+// status and the rest of s.
+func parseStatus(s string) (Status, string) {
+	switch {
+	case strings.HasPrefix(s, "*"):
+		return Cleared, strings.TrimSpace(s[1:])
+	case strings.HasPrefix(s, "!"):
+		return Pending, strings.TrimSpace(s[1:])
+	}
+	return Unmarked, s
+}
+
+func (p *parser) parseTransactionHeader(line string) error {
+	var t Transaction
+	var err error
+	var comment string
+
+	line, comment = splitComment(line)
+	dates := line
+	if i := strings.IndexAny(line, " \t"); i != -1 {
+		dates, line = line[:i], strings.TrimSpace(line[i:])
+	} else {
+		line = ""
+	}
+
+	if i := strings.IndexByte(dates, '='); i != -1 {
+		if t.ValutaDate, err = p.parseDate(dates[i+1:]); err != nil {
+			return err
+		}
+		dates = dates[:i]
+	}
+	if t.Date, err = p.parseDate(dates); err != nil {
+		return err
+	}
+	if t.ValutaDate.IsZero() {
+		t.ValutaDate = t.Date
+	}
+
+	t.Status, line = parseStatus(line)
+	if strings.HasPrefix(line, "(") {
+		if i := strings.IndexByte(line, ')'); i != -1 {
+			t.Code = line[1:i]
+			line = strings.TrimSpace(line[i+1:])
+		}
+	}
+
+	t.Description = line
+	p.current = &t
+	p.span = lineSpan{p.line, p.line}
+	return p.addComment(comment)
+}
+
+// splitAccount splits a posting into the account name and the rest. The
+// account name ends at two spaces or a tab.
+func splitAccount(line string) (string, string) {
+	for i, c := range line {
+		if c == '\t' || (c == ' ' && strings.HasPrefix(line[i:], "  ")) {
+			return line[:i], strings.TrimSpace(line[i:])
+		}
+	}
+	return line, ""
+}
+
+func (p *parser) parsePostingLine(line string) error {
+	if line[0] == ';' || line[0] == '#' {
+		return p.addComment(line[1:])
+	}
+
+	var posting Posting
+	var comment string
+	line, comment = splitComment(line)
+	if line == "" {
+		return nil
+	}
+	posting.Status, line = parseStatus(line)
+
+	posting.Account, line = splitAccount(line)
+	switch {
+	case len(posting.Account) > 2 && posting.Account[0] == '(' && posting.Account[len(posting.Account)-1] == ')':
+		posting.Type = VirtualPosting
+	case len(posting.Account) > 2 && posting.Account[0] == '[' && posting.Account[len(posting.Account)-1] == ']':
+		posting.Type = BalancedVirtualPosting
+	}
+	if posting.Type != RegularPosting {
+		posting.Account = posting.Account[1 : len(posting.Account)-1]
+	}
+	if line != "" {
+		if err := p.parsePostingAmounts(&posting, line); err != nil {
+			return err
+		}
+	} else {
+		posting.Elided = true
+	}
+
+	p.current.Postings = append(p.current.Postings, posting)
+	return p.addComment(comment)
+}
+
+// parsePostingAmounts parses the amount of a posting, followed by an optional
+// unit cost ({}), an optional unit (@) or total (@@) price, and an optional
+// balance assertion.
+func (p *parser) parsePostingAmounts(posting *Posting, s string) error {
+	var err error
+	// The cost is cut out first, as fixed lot costs {=cost} contain a =
+	if i := strings.IndexByte(s, '{'); i != -1 {
+		j := strings.IndexByte(s[i:], '}')
+		switch {
+		case strings.HasPrefix(s[i:], "{{"):
+			return p.errorf("total costs are not supported")
+		case j == -1:
+			return p.errorf("invalid cost %q", strings.TrimSpace(s[i:]))
+		}
+		cost := strings.TrimPrefix(strings.TrimSpace(s[i+1:i+j]), "=")
+		if posting.Cost, posting.CostCurrency, err = p.parseAmount(cost); err != nil {
+			return err
+		}
+		s = strings.TrimSpace(s[:i] + " " + s[i+j+1:])
+	}
+	if i := strings.IndexByte(s, '='); i != -1 {
+		if err := p.parseAssertion(posting, s[i:]); err != nil {
+			return err
+		}
+		s = strings.TrimSpace(s[:i])
+		if s == "" {
+			return p.errorf("balance assignments are not supported")
+		}
+	}
+	if s == "" {
+		return nil
+	}
+
+	price := ""
+	total := false
+	if i := strings.IndexByte(s, '@'); i != -1 {
+		price = s[i+1:]
+		s = strings.TrimSpace(s[:i])
+		if strings.HasPrefix(price, "@") {
+			price = price[1:]
+			total = true
+		}
+	}
+
+	if posting.Value, posting.Currency, err = p.parseAmount(s); err != nil {
+		return err
+	}
+	if price == "" {
+		return nil
+	}
+	if posting.AtValue, posting.AtCurrency, err = p.parseAmount(price); err != nil {
+		return err
+	}
+	if total {
+		if posting.Value.IsZero() {
+			return p.errorf("total price for zero amount")
+		}
+		posting.atTotal = posting.AtValue
+		posting.AtValue = posting.AtValue.Div(posting.Value.Abs())
+	}
+	return nil
+}
+
+// parseAssertion parses a balance assertion like "= 5 EUR" or "==* 5 EUR".
+func (p *parser) parseAssertion(posting *Posting, s string) error {
+	var err error
+	for _, kind := range []AssertionKind{AssertSoleBalanceInclusive, AssertSoleBalance, AssertBalanceInclusive, AssertBalance} {
+		if strings.HasPrefix(s, kind.String()) {
+			posting.Assertion = kind
+			s = strings.TrimSpace(s[len(kind.String()):])
+			break
+		}
+	}
+	if posting.AssertionValue, posting.AssertionCurrency, err = p.parseAmount(s); err != nil {
+		return err
+	}
+	return nil
+}
+
+// isCommodityRune checks whether c can be part of an unquoted commodity.
+func isCommodityRune(c rune) bool {
+	return !unicode.IsSpace(c) && !unicode.IsDigit(c) && !strings.ContainsRune("-+.,;:@=*!\"(){}[]<>/", c)
+}
+
+// parseCommodity parses a commodity at the start of s and returns it along
+// with the rest of the string.
+func (p *parser) parseCommodity(s string) (string, string, error) {
+	if strings.HasPrefix(s, "\"") {
+		end := strings.IndexByte(s[1:], '"')
+		if end == -1 {
+			return "", "", p.errorf("unterminated commodity in %q", s)
+		}
+		return s[1 : end+1], strings.TrimSpace(s[end+2:]), nil
+	}
+	end := strings.IndexFunc(s, func(c rune) bool { return !isCommodityRune(c) })
+	if end == -1 {
+		end = len(s)
+	}
+	return s[:end], strings.TrimSpace(s[end:]), nil
+}
+
+// parseAmount parses an amount with the commodity either in front of the
+// number or following it.
+func (p *parser) parseAmount(s string) (decimal.Decimal, string, error) {
+	var commodity string
+	var err error
+	orig := s
+	s = strings.TrimSpace(s)
+
+	negative := false
+	if strings.HasPrefix(s, "-") || strings.HasPrefix(s, "+") {
+		negative = s[0] == '-'
+		s = strings.TrimSpace(s[1:])
+	}
+	if c, _ := utf8.DecodeRuneInString(s); c == '"' || isCommodityRune(c) {
+		if commodity, s, err = p.parseCommodity(s); err != nil {
+			return decimal.Zero, "", err
+		}
+		if strings.HasPrefix(s, "-") || strings.HasPrefix(s, "+") {
+			negative = negative != (s[0] == '-')
+			s = strings.TrimSpace(s[1:])
+		}
+	}
+
+	end := strings.IndexFunc(s, func(c rune) bool { return !unicode.IsDigit(c) && c != '.' && c != ',' })
+	if end == -1 {
+		end = len(s)
+	}
+	number, s := s[:end], strings.TrimSpace(s[end:])
+	if number == "" {
+		return decimal.Zero, "", p.errorf("missing number in amount %q", orig)
+	}
+	if s != "" {
+		if commodity != "" {
+			return decimal.Zero, "", p.errorf("trailing %q in amount %q", s, orig)
+		}
+		if commodity, s, err = p.parseCommodity(s); err != nil {
+			return decimal.Zero, "", err
+		}
+		if s != "" || commodity == "" {
+			return decimal.Zero, "", p.errorf("invalid amount %q", orig)
+		}
+	}
+
+	mark := p.decimalMark
+	if style, ok := p.styles[commodity]; ok && style.DecimalMark != 0 {
+		mark = byte(style.DecimalMark)
+	}
+	value, err := parseNumber(number, mark)
+	if err != nil {
+		return decimal.Zero, "", p.errorf("invalid number in amount %q", orig)
+	}
+	if negative {
+		value = value.Neg()
+	}
+	return value, commodity, nil
+}
+
+// guessDecimalMark guesses the decimal mark of a number where either ','
+// or '.' is the decimal mark and the other one the thousands separator. If
+// both occur, the last one is the decimal mark. If only one of them occurs,
+// it is the decimal mark if it occurs exactly once.
+func guessDecimalMark(s string) byte {
+	lastDot := strings.LastIndexByte(s, '.')
+	lastComma := strings.LastIndexByte(s, ',')
+
+	switch {
+	case lastDot != -1 && lastComma != -1 && lastComma > lastDot:
+		return ','
+	case lastDot != -1 && lastComma != -1:
+	case lastComma != -1 && strings.Count(s, ",") == 1:
+		return ','
+	case lastDot != -1 && strings.Count(s, ".") > 1:
+		return ','
+	}
+	return '.'
+}
+
+// parseNumber parses a number with the given decimal mark, where the other
+// one of ',' and '.' is the thousands separator. If mark is zero, it is
+// guessed, see guessDecimalMark.
+func parseNumber(s string, mark byte) (decimal.Decimal, error) {
+	if mark == 0 {
+		mark = guessDecimalMark(s)
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == mark:
+			b.WriteByte('.')
+		case s[i] == '.' || s[i] == ',':
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	if b.Len() == 0 || b.String() == "." {
+		return decimal.Zero, errors.New("empty number")
+	}
+	return decimal.NewFromString(b.String())
+}
@@ -0,0 +1,251 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package goledger
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+const testJournal = `; comment
+commodity 1.000,00 EUR
+
+2017/01/02=2017/01/03 * (42) REWE  ; shop: rewe
+    ; id: abc
+    ; groceries
+    assets:bank:giro    -1.012,34 EUR = 100,00 EUR
+    expenses:food    1.012,34 EUR  ; date: 2017/01/04
+
+2017-01-05 ! Exchange
+    assets:cash  -10 USD @@ 9,00 EUR
+    assets:bank
+    [budget:food]  5 EUR
+    [budget:free]
+    (tracking)  1 X
+`
+
+func TestParseJournal(t *testing.T) {
+	j, err := ParseJournal(strings.NewReader(testJournal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(j) != 2 {
+		t.Fatalf("got %d transactions, want 2", len(j))
+	}
+
+	tr := j[0]
+	if want := time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC); !tr.Date.Equal(want) {
+		t.Errorf("got date %v, want %v", tr.Date, want)
+	}
+	if want := time.Date(2017, 1, 3, 0, 0, 0, 0, time.UTC); !tr.ValutaDate.Equal(want) {
+		t.Errorf("got valuta date %v, want %v", tr.ValutaDate, want)
+	}
+	if tr.Status != Cleared || tr.Code != "42" || tr.Description != "REWE" || tr.ID != "abc" || tr.Comment != "groceries" {
+		t.Errorf("got status %q, code %q, description %q, ID %q, comment %q", tr.Status, tr.Code, tr.Description, tr.ID, tr.Comment)
+	}
+	if shop, _ := tr.Tag("shop"); shop != "rewe" {
+		t.Errorf("got tag shop %q, want rewe", shop)
+	}
+	if len(tr.Postings) != 2 {
+		t.Fatalf("got %d postings, want 2", len(tr.Postings))
+	}
+	p := tr.Postings[0]
+	if p.Account != "assets:bank:giro" || !p.Value.Equal(decimal.RequireFromString("-1012.34")) || p.Currency != "EUR" {
+		t.Errorf("got posting %s %s %s", p.Account, p.Value, p.Currency)
+	}
+	if p.Assertion != AssertBalance || !p.AssertionValue.Equal(decimal.New(100, 0)) || p.AssertionCurrency != "EUR" {
+		t.Errorf("got assertion %s %s %s", p.Assertion, p.AssertionValue, p.AssertionCurrency)
+	}
+	if want := time.Date(2017, 1, 4, 0, 0, 0, 0, time.UTC); !tr.Postings[1].Date.Equal(want) {
+		t.Errorf("got posting date %v, want %v", tr.Postings[1].Date, want)
+	}
+
+	tr = j[1]
+	if tr.Status != Pending || len(tr.Postings) != 5 {
+		t.Fatalf("got status %q and %d postings, want ! and 5", tr.Status, len(tr.Postings))
+	}
+	p = tr.Postings[0]
+	if !p.AtValue.Equal(decimal.RequireFromString("0.9")) || p.AtCurrency != "EUR" {
+		t.Errorf("got price %s %s, want 0.9 EUR", p.AtValue, p.AtCurrency)
+	}
+	for i, want := range []PostingType{RegularPosting, RegularPosting, BalancedVirtualPosting, BalancedVirtualPosting, VirtualPosting} {
+		if got := tr.Postings[i].Type; got != want {
+			t.Errorf("posting %d: got %s, want %s", i, got, want)
+		}
+	}
+	if !tr.Postings[1].Elided || !tr.Postings[3].Elided {
+		t.Errorf("postings without amount are not elided")
+	}
+}
+
+func TestPrintRoundTrip(t *testing.T) {
+	j, err := ParseJournal(strings.NewReader(testJournal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var printed strings.Builder
+	if err := j.Print(&printed); err != nil {
+		t.Fatal(err)
+	}
+	j2, err := ParseJournal(strings.NewReader(printed.String()))
+	if err != nil {
+		t.Fatalf("%v in:\n%s", err, printed.String())
+	}
+	var reprinted strings.Builder
+	if err := j2.Print(&reprinted); err != nil {
+		t.Fatal(err)
+	}
+	if printed.String() != reprinted.String() {
+		t.Errorf("printed:\n%s\nreprinted:\n%s", printed.String(), reprinted.String())
+	}
+}
+
+func TestParseJournalErrors(t *testing.T) {
+	for _, journal := range []string{
+		"2017/13/01 Invalid date\n    a  1 EUR\n    b\n",
+		"2017/01/01 Invalid amount\n    a  1x2 EUR\n    b\n",
+		"    a  1 EUR\n",
+	} {
+		if _, err := ParseJournal(strings.NewReader(journal)); err == nil {
+			t.Errorf("no error for %q", journal)
+		}
+	}
+}
+
+func TestParseCosts(t *testing.T) {
+	for _, test := range []struct {
+		posting   string
+		cost      string
+		price     string
+		assertion string
+	}{
+		{"10 AAPL {12.34 EUR}", "12.34 EUR", "0 ", "0 "},
+		{"10 AAPL {12.34 EUR} @ 13 EUR", "12.34 EUR", "13 EUR", "0 "},
+		// Fixed lot costs are not balance assertions
+		{"10 AAPL {=12.34 EUR}", "12.34 EUR", "0 ", "0 "},
+		{"10 AAPL {=12.34 EUR} @ 13 EUR = 20 AAPL", "12.34 EUR", "13 EUR", "20 AAPL"},
+	} {
+		j, err := ParseJournal(strings.NewReader("2017/01/02 Buy\n    assets:depot  " + test.posting + "\n    assets:bank\n"))
+		if err != nil {
+			t.Errorf("%s: %v", test.posting, err)
+			continue
+		}
+		p := j[0].Postings[0]
+		if !p.Value.Equal(decimal.New(10, 0)) || p.Currency != "AAPL" {
+			t.Errorf("%s: got amount %s %s", test.posting, p.Value, p.Currency)
+		}
+		for _, got := range []struct{ name, got, want string }{
+			{"cost", p.Cost.String() + " " + p.CostCurrency, test.cost},
+			{"price", p.AtValue.String() + " " + p.AtCurrency, test.price},
+			{"assertion", p.AssertionValue.String() + " " + p.AssertionCurrency, test.assertion},
+		} {
+			if got.got != got.want {
+				t.Errorf("%s: got %s %q, want %q", test.posting, got.name, got.got, got.want)
+			}
+		}
+	}
+	for _, posting := range []string{"10 AAPL {{123.40 EUR}}", "10 AAPL {12.34 EUR"} {
+		if _, err := ParseJournal(strings.NewReader("2017/01/02 Buy\n    assets:depot  " + posting + "\n    assets:bank\n")); err == nil {
+			t.Errorf("%s: no error", posting)
+		}
+	}
+}
+
+func TestParseComment(t *testing.T) {
+	for _, test := range []struct {
+		comment string
+		text    string
+		tags    []Tag
+	}{
+		{"groceries", "groceries", nil},
+		{"shop: rewe, city: Berlin", "", []Tag{{"shop", "rewe"}, {"city", "Berlin"}}},
+		{"reviewed:", "", []Tag{{"reviewed", ""}}},
+		{"note: a, b", "", []Tag{{"note", "a, b"}}},
+		{":a:b:", "", []Tag{{Name: "a"}, {Name: "b"}}},
+		{"https://example.com/receipt", "https://example.com/receipt", nil},
+		{"see https://example.com", "see https://example.com", nil},
+		{"time:12:30", "time:12:30", nil},
+	} {
+		text, tags := parseComment(test.comment)
+		if text != test.text || !reflect.DeepEqual(tags, test.tags) {
+			t.Errorf("%q: got %q, %v, want %q, %v", test.comment, text, tags, test.text, test.tags)
+		}
+	}
+}
+
+func TestParseJournalFileInclude(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	transaction := "2017/01/02 REWE\n    expenses:food  5 EUR\n    assets:bank\n"
+
+	// Including a file twice is fine
+	write("b.journal", transaction)
+	j, err := ParseJournalFile(write("a.journal", "include b.journal\ninclude b.journal\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(j) != 2 {
+		t.Errorf("got %d transactions, want 2", len(j))
+	}
+
+	write("c.journal", "include d.journal\n")
+	write("d.journal", transaction+"\ninclude c.journal\n")
+	_, err = ParseJournalFile(filepath.Join(dir, "c.journal"))
+	var perr *ParseError
+	if !errors.As(err, &perr) || perr.Path != filepath.Join(dir, "d.journal") || perr.Line != 5 {
+		t.Errorf("got error %v, want an include cycle error in line 5 of d.journal", err)
+	}
+}
+
+func TestParseCommodityStylesFileLenient(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"a.journal": "commodity 1.000,00 EUR\ninclude b.journal\ninclude missing.journal\n\n2017/01/01 Buy\n    assets:depot  10 AAPL {{100 EUR}}\n    assets:bank\n",
+		"b.journal": "include a.journal\ncommodity $1,000.00\n",
+		"c.journal": "include d.journal\n",
+		"d.journal": "decimal-mark x\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	styles, err := ParseCommodityStylesFile(filepath.Join(dir, "a.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := styles.Format(decimal.New(1234, 0), "EUR") + " " + styles.Format(decimal.New(1234, 0), "$"); got != "1.234,00 EUR $1,234.00" {
+		t.Errorf("got %q", got)
+	}
+	// Errors in the parsed directives of included files are reported
+	if _, err := ParseCommodityStylesFile(filepath.Join(dir, "c.journal")); err == nil {
+		t.Errorf("no error for invalid decimal-mark directive")
+	}
+}
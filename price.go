@@ -0,0 +1,71 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package goledger
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Price is the market price of one unit of a commodity at a date, as
+// declared by a P directive.
+type Price struct {
+	Date      time.Time
+	Commodity string
+	Value     decimal.Decimal
+	Currency  string
+}
+
+// PriceRenderer is implemented by renderers that can render prices.
+type PriceRenderer interface {
+	RenderPrice(w io.Writer, p *Price) error
+}
+
+// Render renders the price to the writer.
+func (p *Price) Render(w io.Writer, r PriceRenderer) error {
+	return r.RenderPrice(w, p)
+}
+
+// commodity returns the commodity as written in amounts.
+func (s CommodityStyles) commodity(commodity string) string {
+	if symbol := s.Style(commodity).Symbol; symbol != "" {
+		commodity = symbol
+	}
+	return quoteCommodity(commodity)
+}
+
+// RenderPrice renders the price as a P directive.
+func (r HledgerRenderer) RenderPrice(w io.Writer, p *Price) error {
+	_, err := fmt.Fprintf(w, "P %s %s %s\n", renderDate(p.Date), r.Styles.commodity(p.Commodity), r.Styles.Format(p.Value, p.Currency))
+	return err
+}
+
+// RenderPrice renders the price as a P directive.
+func (r LedgerRenderer) RenderPrice(w io.Writer, p *Price) error {
+	_, err := fmt.Fprintf(w, "P %s %s %s\n", renderDate(p.Date), r.Styles.commodity(p.Commodity), r.Styles.Format(p.Value, p.Currency))
+	return err
+}
+
+// RenderPrice renders the price as a price directive.
+func (r BeancountRenderer) RenderPrice(w io.Writer, p *Price) error {
+	_, err := fmt.Fprintf(w, "%s price %s  %s %s\n", p.Date.Format("2006-01-02"), beancountCommodity(p.Commodity), r.number(p.Value, p.Currency), beancountCommodity(p.Currency))
+	return err
+}
@@ -0,0 +1,61 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package goledger
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestRenderPrice(t *testing.T) {
+	p := Price{
+		Date:      time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC),
+		Commodity: "IE00B4L5Y983",
+		Value:     decimal.RequireFromString("40.5"),
+		Currency:  "EUR",
+	}
+	styles := CommodityStyles{"EUR": {Symbol: "€", DecimalMark: ',', Precision: 2}}
+	for _, test := range []struct {
+		r    PriceRenderer
+		want string
+	}{
+		{HledgerRenderer{}, "P 2017/01/02 \"IE00B4L5Y983\" 40.50 EUR\n"},
+		{LedgerRenderer{Styles: styles}, "P 2017/01/02 \"IE00B4L5Y983\" 40,50€\n"},
+		{BeancountRenderer{Styles: styles}, "2017-01-02 price IE00B4L5Y983  40.50 EUR\n"},
+	} {
+		var b strings.Builder
+		if err := p.Render(&b, test.r); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != test.want {
+			t.Errorf("%T: got %q, want %q", test.r, b.String(), test.want)
+		}
+	}
+
+	// The rendered directive is a valid journal
+	var b strings.Builder
+	if err := p.Render(&b, HledgerRenderer{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseJournal(strings.NewReader(b.String())); err != nil {
+		t.Error(err)
+	}
+}
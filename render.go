@@ -0,0 +1,236 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package goledger
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Renderer renders transactions in the syntax of a plain text accounting
+// program. Renderers refuse to render transactions that do not balance,
+// see Transaction.Validate, unless configured otherwise.
+type Renderer interface {
+	RenderTransaction(w io.Writer, t *Transaction) error
+}
+
+// HledgerRenderer renders transactions in hledger syntax. This is the
+// syntax used by Print.
+type HledgerRenderer struct {
+	// Styles are the styles of amounts, see CommodityStyles.Format.
+	Styles CommodityStyles
+	// AmountColumn is the column amounts are right-aligned to, if not
+	// zero. Amounts that do not fit are aligned further right, so that all
+	// amounts and prices of a transaction are aligned.
+	AmountColumn int
+	// AllowUnbalanced renders transactions that do not balance instead
+	// of returning an error.
+	AllowUnbalanced bool
+}
+
+// LedgerRenderer renders transactions in ledger-cli syntax.
+type LedgerRenderer struct {
+	// Styles are the styles of amounts, see CommodityStyles.Format.
+	Styles CommodityStyles
+	// AmountColumn is the column amounts are right-aligned to, if not
+	// zero. Amounts that do not fit are aligned further right, so that all
+	// amounts and prices of a transaction are aligned.
+	AmountColumn int
+	// AllowUnbalanced renders transactions that do not balance instead
+	// of returning an error.
+	AllowUnbalanced bool
+}
+
+// RenderTransaction renders the transaction in hledger syntax.
+func (r HledgerRenderer) RenderTransaction(w io.Writer, t *Transaction) error {
+	if !r.AllowUnbalanced {
+		if err := t.Validate(); err != nil {
+			return err
+		}
+	}
+	return renderLedgerTransaction(w, t, r.Styles, r.AmountColumn, true)
+}
+
+// RenderTransaction renders the transaction in ledger-cli syntax.
+func (r LedgerRenderer) RenderTransaction(w io.Writer, t *Transaction) error {
+	if !r.AllowUnbalanced {
+		if err := t.Validate(); err != nil {
+			return err
+		}
+	}
+	return renderLedgerTransaction(w, t, r.Styles, r.AmountColumn, false)
+}
+
+func renderDate(d time.Time) string {
+	return fmt.Sprintf("%d/%02d/%02d", d.Year(), d.Month(), d.Day())
+}
+
+// postingLine is a rendered posting, split at the amount for alignment.
+type postingLine struct {
+	prefix string
+	amount string
+	suffix string
+	// after are the lines following the posting, like comments
+	after string
+}
+
+// writePostingLines writes the posting lines with their amounts
+// right-aligned to end at column, or further right if needed to align all
+// of them. If column is zero, amounts follow the account after two spaces.
+func writePostingLines(b *strings.Builder, lines []postingLine, column int) {
+	end := column
+	for _, l := range lines {
+		if width := utf8.RuneCountInString(l.prefix) + 2 + utf8.RuneCountInString(l.amount); l.amount != "" && width > end {
+			end = width
+		}
+	}
+	for _, l := range lines {
+		b.WriteString(l.prefix)
+		if l.amount != "" {
+			padding := 2
+			if column != 0 {
+				padding = end - utf8.RuneCountInString(l.prefix) - utf8.RuneCountInString(l.amount)
+			}
+			b.WriteString(strings.Repeat(" ", padding))
+			b.WriteString(l.amount)
+		}
+		b.WriteString(l.suffix)
+		b.WriteString("\n")
+		b.WriteString(l.after)
+	}
+}
+
+// renderLedgerTag renders a tag. Tags without a value are rendered as
+// name: for hledger, and as :name: for ledger-cli.
+func renderLedgerTag(tag Tag, hledger bool) string {
+	switch {
+	case tag.Value != "":
+		return tag.Name + ": " + tag.Value
+	case hledger:
+		return tag.Name + ":"
+	default:
+		return ":" + tag.Name + ":"
+	}
+}
+
+// renderLedgerComments renders the comment lines and tags with the given
+// indentation.
+func renderLedgerComments(b *strings.Builder, indent string, comment string, tags []Tag, hledger bool) {
+	if comment != "" {
+		for _, line := range strings.Split(comment, "\n") {
+			fmt.Fprintf(b, "%s; %s\n", indent, line)
+		}
+	}
+	for _, tag := range tags {
+		fmt.Fprintf(b, "%s; %s\n", indent, renderLedgerTag(tag, hledger))
+	}
+}
+
+// priceSuffix renders the unit (@) or total (@@) price of the posting, if
+// any.
+func priceSuffix(p *Posting, styles CommodityStyles) string {
+	if total, ok := p.totalPrice(); ok {
+		return " @@ " + styles.Format(total, p.AtCurrency)
+	}
+	if !p.AtValue.IsZero() {
+		return " @ " + styles.Format(p.AtValue, p.AtCurrency)
+	}
+	return ""
+}
+
+// renderLedgerTransaction renders a transaction in the syntax shared by
+// hledger and ledger-cli. The valuta date is rendered as the secondary
+// (hledger) or auxiliary (ledger) date, and the ID as metadata (which
+// hledger calls a tag). As ledger-cli only knows one kind of balance
+// assertion, all assertions are rendered as = for it.
+//
+// Posting dates are rendered as date and date2 tags for hledger, and as
+// [date=date2] comments for ledger-cli. Costs are rendered as {cost},
+// followed by the price, if any, for both.
+func renderLedgerTransaction(w io.Writer, l *Transaction, styles CommodityStyles, column int, hledger bool) error {
+	var b strings.Builder
+	date, valutaDate := l.dates()
+	b.WriteString(renderDate(date))
+	if !valutaDate.IsZero() {
+		fmt.Fprintf(&b, "=%s", renderDate(valutaDate))
+	}
+	if l.Status != Unmarked {
+		fmt.Fprintf(&b, " %s", l.Status)
+	}
+	if l.Code != "" {
+		fmt.Fprintf(&b, " (%s)", l.Code)
+	}
+	fmt.Fprintf(&b, " %s\n", l.Description)
+	tags := l.Tags
+	if l.ID != "" {
+		tags = append([]Tag{{"id", l.ID}}, tags...)
+	}
+	renderLedgerComments(&b, "    ", l.Comment, tags, hledger)
+	var lines []postingLine
+	for _, p := range l.Postings {
+		var line postingLine
+		line.prefix = "    " + p.Type.account(p.Account)
+		if p.Status != Unmarked {
+			line.prefix = "    " + p.Status.String() + " " + p.Type.account(p.Account)
+		}
+		if !p.Elided {
+			line.amount = styles.Format(p.Value, p.Currency)
+			line.suffix = priceSuffix(&p, styles)
+			if !p.Cost.IsZero() {
+				line.suffix = " {" + styles.Format(p.Cost, p.CostCurrency) + "}" + line.suffix
+			}
+		}
+		if p.Assertion != NoAssertion {
+			kind := AssertBalance.String()
+			if hledger {
+				kind = p.Assertion.String()
+			}
+			line.suffix += fmt.Sprintf(" %s %s", kind, styles.Format(p.AssertionValue, p.AssertionCurrency))
+		}
+		var after strings.Builder
+		comment, tags := p.Comment, p.Tags
+		switch {
+		case hledger:
+			if !p.ValutaDate.IsZero() {
+				tags = append([]Tag{{"date2", renderDate(p.ValutaDate)}}, tags...)
+			}
+			if !p.Date.IsZero() {
+				tags = append([]Tag{{"date", renderDate(p.Date)}}, tags...)
+			}
+		case !p.Date.IsZero() || !p.ValutaDate.IsZero():
+			dates := "["
+			if !p.Date.IsZero() {
+				dates += renderDate(p.Date)
+			}
+			if !p.ValutaDate.IsZero() {
+				dates += "=" + renderDate(p.ValutaDate)
+			}
+			comment = appendLine(dates+"]", comment)
+		}
+		renderLedgerComments(&after, "        ", comment, tags, hledger)
+		line.after = after.String()
+		lines = append(lines, line)
+	}
+	writePostingLines(&b, lines, column)
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,208 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package goledger
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// renderJournal parses the journal and renders it with the renderer.
+func renderJournal(t *testing.T, journal string, r Renderer) string {
+	t.Helper()
+	j, err := ParseJournal(strings.NewReader(journal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	for i := range j {
+		if err := r.RenderTransaction(&b, &j[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b.String()
+}
+
+func TestLedgerRenderer(t *testing.T) {
+	got := renderJournal(t, `2017/01/02=2017/01/03 * (42) Exchange
+    ; trip
+    ; id: 123
+    assets:cash  -10.00 USD @ 0.87 EUR
+    assets:bank  5.00 AAPL {1.00 EUR} @ 1.10 EUR = 5.00 AAPL
+    ! expenses:misc
+`, LedgerRenderer{})
+	want := `2017/01/02=2017/01/03 * (42) Exchange
+    ; trip
+    ; id: 123
+    assets:cash  -10.00 USD @ 0.87 EUR
+    assets:bank  5.00 AAPL {1.00 EUR} @ 1.10 EUR = 5.00 AAPL
+    ! expenses:misc
+
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLedgerRendererUnbalanced(t *testing.T) {
+	j, err := ParseJournal(strings.NewReader("2017/01/02 Unbalanced\n    a  1.00 EUR\n    b  -2.00 EUR\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := (LedgerRenderer{}).RenderTransaction(&b, &j[0]); err == nil {
+		t.Errorf("expected an error, got:\n%s", b.String())
+	}
+	if err := (LedgerRenderer{AllowUnbalanced: true}).RenderTransaction(&b, &j[0]); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRenderMetadata(t *testing.T) {
+	l := Transaction{
+		Date:        time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC),
+		Status:      Pending,
+		Code:        "42",
+		Description: "REWE",
+		Comment:     "first\nsecond",
+		Tags:        []Tag{{"category", "food"}, {"pending", ""}},
+		ID:          "abc",
+		Postings: []Posting{
+			{Account: "assets:bank", Status: Cleared, Value: decimal.New(-5, 0), Currency: "EUR", Comment: "card", Tags: []Tag{{"receipt", "yes"}, {"checked", ""}}},
+			{Account: "expenses:food", Value: decimal.New(5, 0), Currency: "EUR"},
+		},
+	}
+	for _, test := range []struct {
+		r    Renderer
+		want string
+	}{
+		{HledgerRenderer{}, `2017/01/02 ! (42) REWE
+    ; first
+    ; second
+    ; id: abc
+    ; category: food
+    ; pending:
+    * assets:bank  -5.00 EUR
+        ; card
+        ; receipt: yes
+        ; checked:
+    expenses:food  5.00 EUR
+
+`},
+		{LedgerRenderer{}, `2017/01/02 ! (42) REWE
+    ; first
+    ; second
+    ; id: abc
+    ; category: food
+    ; :pending:
+    * assets:bank  -5.00 EUR
+        ; card
+        ; receipt: yes
+        ; :checked:
+    expenses:food  5.00 EUR
+
+`},
+		{BeancountRenderer{}, `2017-01-02 ! "REWE" #pending
+  code: "42"
+  import-id: "abc"
+  ; first
+  ; second
+  category: "food"
+  * Assets:Bank  -5.00 EUR
+    ; card
+    receipt: "yes"
+  Expenses:Food  5.00 EUR
+
+`},
+	} {
+		var b strings.Builder
+		if err := test.r.RenderTransaction(&b, &l); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != test.want {
+			t.Errorf("%T: got:\n%s\nwant:\n%s", test.r, b.String(), test.want)
+		}
+	}
+}
+
+func TestRenderPostingDates(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2017, 1, d, 0, 0, 0, 0, time.UTC) }
+	l := Transaction{
+		Date:        day(2),
+		Description: "Transfer",
+		Postings: []Posting{
+			{Account: "assets:bank", Value: decimal.New(-5, 0), Currency: "EUR", Comment: "sent"},
+			{Account: "assets:savings", Value: decimal.New(5, 0), Currency: "EUR", Date: day(4), ValutaDate: day(5)},
+			{Account: "budget:savings", Type: BalancedVirtualPosting, Value: decimal.New(5, 0), Currency: "EUR", Date: day(4)},
+			{Account: "budget:free", Type: BalancedVirtualPosting, Value: decimal.New(-5, 0), Currency: "EUR", ValutaDate: day(3)},
+			{Account: "tracking", Type: VirtualPosting, Value: decimal.New(1, 0), Currency: "EUR"},
+		},
+	}
+	for _, test := range []struct {
+		r    Renderer
+		want string
+	}{
+		{HledgerRenderer{}, `2017/01/02 Transfer
+    assets:bank  -5.00 EUR
+        ; sent
+    assets:savings  5.00 EUR
+        ; date: 2017/01/04
+        ; date2: 2017/01/05
+    [budget:savings]  5.00 EUR
+        ; date: 2017/01/04
+    [budget:free]  -5.00 EUR
+        ; date2: 2017/01/03
+    (tracking)  1.00 EUR
+
+`},
+		{LedgerRenderer{}, `2017/01/02 Transfer
+    assets:bank  -5.00 EUR
+        ; sent
+    assets:savings  5.00 EUR
+        ; [2017/01/04=2017/01/05]
+    [budget:savings]  5.00 EUR
+        ; [2017/01/04]
+    [budget:free]  -5.00 EUR
+        ; [=2017/01/03]
+    (tracking)  1.00 EUR
+
+`},
+	} {
+		var b strings.Builder
+		if err := test.r.RenderTransaction(&b, &l); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != test.want {
+			t.Errorf("%T: got:\n%s\nwant:\n%s", test.r, b.String(), test.want)
+		}
+
+		j, err := ParseJournal(strings.NewReader(b.String()))
+		if err != nil {
+			t.Fatalf("%T: %v", test.r, err)
+		}
+		for i, p := range j[0].Postings {
+			want := l.Postings[i]
+			if p.Account != want.Account || p.Type != want.Type || !p.Date.Equal(want.Date) || !p.ValutaDate.Equal(want.ValutaDate) || p.Comment != want.Comment || len(p.Tags) != 0 {
+				t.Errorf("%T: posting %d: got %+v, want %+v", test.r, i, p, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,387 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package rules
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/julian-klode/goledger"
+	"github.com/julian-klode/goledger/importer"
+	"github.com/shopspring/decimal"
+)
+
+// PortfolioAccounts are the ledger accounts portfolio transactions are
+// booked on by ConvertPortfolio.
+type PortfolioAccounts struct {
+	// Securities is the parent account of the accounts holding the
+	// securities of each portfolio, which are named like the portfolio
+	// unless LocalAccounts has an entry for the portfolio name.
+	Securities string
+	// Cash is the account the cash side of transactions is booked on,
+	// unless LocalAccounts has an entry for the name of the deposit
+	// account.
+	Cash string
+	// Fees, Taxes, Gains, and Dividends are the accounts for fees, taxes,
+	// realized capital gains, and dividends.
+	Fees      string
+	Taxes     string
+	Gains     string
+	Dividends string
+	// Transfers is the counter account for deliveries and transfers of
+	// securities between portfolios.
+	Transfers string
+}
+
+// DefaultPortfolioAccounts are the default accounts for ConvertPortfolio.
+var DefaultPortfolioAccounts = PortfolioAccounts{
+	Securities: "assets:portfolio",
+	Cash:       "assets:cash",
+	Fees:       "expenses:fees",
+	Taxes:      "expenses:taxes",
+	Gains:      "income:capital-gains",
+	Dividends:  "income:dividends",
+	Transfers:  "equity:transfers",
+}
+
+// portfolioDescriptions are the descriptions of the transaction types
+var portfolioDescriptions = map[string]string{
+	"BUY":               "Buy",
+	"SELL":              "Sell",
+	"DELIVERY_INBOUND":  "Inbound delivery of",
+	"DELIVERY_OUTBOUND": "Outbound delivery of",
+	"TRANSFER_IN":       "Transfer of",
+	"TRANSFER_OUT":      "Transfer of",
+	"DIVIDENDS":         "Dividends of",
+}
+
+// portfolioPrecision is the number of decimal places of unit costs and
+// prices, as in Portfolio Performance.
+const portfolioPrecision = 8
+
+// lot is a number of shares bought at the same time and cost.
+type lot struct {
+	quantity decimal.Decimal
+	cost     decimal.Decimal
+	currency string
+}
+
+// lotKey identifies the lots of a security in a portfolio
+type lotKey struct {
+	portfolio string
+	security  string
+}
+
+// portfolioConverter holds the state of ConvertPortfolio.
+type portfolioConverter struct {
+	rules    *Rules
+	accounts PortfolioAccounts
+	lots     map[lotKey][]lot
+	// transfers are the lots transferred out of a portfolio, per
+	// security, that have not been transferred into another one yet.
+	transfers map[string][]lot
+}
+
+// portfolioEntry is a transaction of a portfolio or the i-th transaction
+// of an account.
+type portfolioEntry struct {
+	date      time.Time
+	portfolio *importer.Portfolio
+	t         *importer.PortfolioTransaction
+	account   *importer.PortfolioAccount
+	i         int
+}
+
+// ConvertPortfolio converts the transactions of the portfolios and deposit
+// accounts in a Portfolio Performance file into ledger transactions, ordered
+// by date.
+//
+// Bought shares are booked with their cost {} per share, which excludes
+// fees and taxes. Sold shares are taken from the lots of the portfolio in
+// FIFO order, with one posting per lot at the lot's cost and the sale
+// price, and the difference is booked as capital gains. Lots keep their
+// cost when they are transferred to another portfolio.
+//
+// Account transactions linked to a portfolio transaction are left out, as
+// the portfolio transaction books the cash side, and dividends are booked
+// on the Dividends account. Other account transactions, like deposits,
+// are converted by Convert, with the cash account as local account.
+func (r *Rules) ConvertPortfolio(client *importer.PortfolioClient, accounts PortfolioAccounts) ([]goledger.Transaction, error) {
+	c := portfolioConverter{
+		rules:     r,
+		accounts:  accounts,
+		lots:      make(map[lotKey][]lot),
+		transfers: make(map[string][]lot),
+	}
+
+	var entries []portfolioEntry
+	for i := range client.Portfolios {
+		p := &client.Portfolios[i]
+		for j := range p.Transactions {
+			entries = append(entries, portfolioEntry{date: p.Transactions[j].Time(), portfolio: p, t: &p.Transactions[j]})
+		}
+	}
+	for i := range client.Accounts {
+		a := &client.Accounts[i]
+		for j := range a.Transactions {
+			if a.Transactions[j].CrossEntry == nil {
+				entries = append(entries, portfolioEntry{date: a.Transactions[j].Time(), account: a, i: j})
+			}
+		}
+	}
+	// Shares have to be transferred out before they can be transferred in
+	sort.SliceStable(entries, func(i, j int) bool {
+		if !entries[i].date.Equal(entries[j].date) {
+			return entries[i].date.Before(entries[j].date)
+		}
+		return entries[i].t != nil && entries[i].t.Type == "TRANSFER_OUT" && (entries[j].t == nil || entries[j].t.Type != "TRANSFER_OUT")
+	})
+
+	var transactions []goledger.Transaction
+	for _, e := range entries {
+		var t goledger.Transaction
+		var err error
+		switch {
+		case e.account == nil:
+			t, err = c.convert(e.portfolio, e.t)
+		case e.account.Transactions[e.i].Type == "DIVIDENDS":
+			t, err = c.convertDividends(e.account, &e.account.Transactions[e.i])
+		default:
+			t = c.rules.Convert(e.account.Transaction(e.i))
+			t.Postings[0].Account = c.cashAccount(e.account)
+		}
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, t)
+	}
+	return transactions, nil
+}
+
+// cashAccount returns the account the cash of the deposit account a is
+// booked on.
+func (c *portfolioConverter) cashAccount(a *importer.PortfolioAccount) string {
+	if account, ok := c.rules.LocalAccounts[a.Name]; ok {
+		return account
+	}
+	return c.accounts.Cash
+}
+
+// securitiesAccount returns the account holding the securities of p.
+func (c *portfolioConverter) securitiesAccount(p *importer.Portfolio) string {
+	if account, ok := c.rules.LocalAccounts[p.Name]; ok {
+		return account
+	}
+	return c.accounts.Securities + ":" + p.Name
+}
+
+// transaction returns a transaction with the date, description, and
+// ID of the portfolio transaction, and the fees and taxes as postings.
+func (c *portfolioConverter) transaction(date time.Time, typ string, security *importer.PortfolioSecurity, uuid string, note string, units importer.PortfolioUnits, currency string) goledger.Transaction {
+	description := portfolioDescriptions[typ]
+	if description == "" {
+		description = typ
+	}
+	t := goledger.Transaction{
+		Date:        date,
+		Description: description + " " + security.Name,
+		Comment:     note,
+		ID:          uuid,
+	}
+	if fees := units.Sum("FEE"); !fees.IsZero() {
+		t.Postings = append(t.Postings, goledger.Posting{Account: c.accounts.Fees, Value: fees, Currency: currency})
+	}
+	if taxes := units.Sum("TAX"); !taxes.IsZero() {
+		t.Postings = append(t.Postings, goledger.Posting{Account: c.accounts.Taxes, Value: taxes, Currency: currency})
+	}
+	return t
+}
+
+// convert converts a transaction of the portfolio p.
+func (c *portfolioConverter) convert(p *importer.Portfolio, pt *importer.PortfolioTransaction) (goledger.Transaction, error) {
+	if pt.Security == nil || pt.Security.Symbol() == "" {
+		return goledger.Transaction{}, fmt.Errorf("%s: %s transaction %s has no security", p.Name, pt.Type, pt.UUID)
+	}
+	key := lotKey{p.Name, pt.Security.Symbol()}
+	quantity := pt.Quantity()
+	amount := pt.Value()
+	fees, taxes := pt.Units.Sum("FEE"), pt.Units.Sum("TAX")
+	t := c.transaction(pt.Time(), pt.Type, pt.Security, pt.UUID, pt.Note, pt.Units, pt.CurrencyCode)
+	shares := goledger.Posting{Account: c.securitiesAccount(p), Currency: key.security}
+	cash := c.accounts.Cash
+	if pt.CrossEntry != nil {
+		cash = c.cashAccount(pt.CrossEntry.Account)
+	}
+
+	switch pt.Type {
+	case "BUY", "DELIVERY_INBOUND":
+		counter := cash
+		if pt.Type == "DELIVERY_INBOUND" {
+			counter = c.accounts.Transfers
+		}
+		if quantity.IsZero() {
+			return t, fmt.Errorf("%s: %s transaction %s has no shares", p.Name, pt.Type, pt.UUID)
+		}
+		l := lot{quantity: quantity, cost: amount.Sub(fees).Sub(taxes).Div(quantity).Round(portfolioPrecision), currency: pt.CurrencyCode}
+		c.lots[key] = append(c.lots[key], l)
+		shares.Value, shares.Cost, shares.CostCurrency = quantity, l.cost, l.currency
+		t.Postings = append([]goledger.Posting{shares}, t.Postings...)
+		t.Postings = append(t.Postings, goledger.Posting{Account: counter, Value: amount.Neg(), Currency: pt.CurrencyCode})
+	case "SELL", "DELIVERY_OUTBOUND":
+		lots, rest, err := take(c.lots[key], quantity)
+		if err != nil {
+			return t, fmt.Errorf("%s: %s transaction %s: %v", p.Name, pt.Type, pt.UUID, err)
+		}
+		c.lots[key] = rest
+		var postings []goledger.Posting
+		basis := decimal.Zero
+		for _, l := range lots {
+			shares.Value, shares.Cost, shares.CostCurrency = l.quantity.Neg(), l.cost, l.currency
+			if pt.Type == "SELL" {
+				shares.AtValue = amount.Add(fees).Add(taxes).Div(quantity).Round(portfolioPrecision)
+				shares.AtCurrency = pt.CurrencyCode
+			}
+			postings = append(postings, shares)
+			basis = basis.Add(l.quantity.Mul(l.cost))
+		}
+		t.Postings = append(postings, t.Postings...)
+		if pt.Type == "SELL" {
+			gains := amount.Add(fees).Add(taxes).Sub(basis).Round(2)
+			t.Postings = append(t.Postings,
+				goledger.Posting{Account: cash, Value: amount, Currency: pt.CurrencyCode},
+				goledger.Posting{Account: c.accounts.Gains, Value: gains.Neg(), Currency: pt.CurrencyCode})
+		} else {
+			t.Postings = append(t.Postings, goledger.Posting{Account: c.accounts.Transfers, Value: basis.Sub(fees).Sub(taxes).Round(2), Currency: pt.CurrencyCode})
+		}
+	case "TRANSFER_OUT":
+		lots, rest, err := take(c.lots[key], quantity)
+		if err != nil {
+			return t, fmt.Errorf("%s: %s transaction %s: %v", p.Name, pt.Type, pt.UUID, err)
+		}
+		c.lots[key] = rest
+		c.transfers[key.security] = append(c.transfers[key.security], lots...)
+		t.Postings = append(c.transferPostings(shares, lots, true), t.Postings...)
+		t.Postings = append(t.Postings, c.transferCounter(t.Postings, pt.CurrencyCode))
+	case "TRANSFER_IN":
+		lots, rest, err := take(c.transfers[key.security], quantity)
+		if err != nil {
+			return t, fmt.Errorf("%s: %s transaction %s: %v", p.Name, pt.Type, pt.UUID, err)
+		}
+		c.transfers[key.security] = rest
+		c.lots[key] = append(c.lots[key], lots...)
+		t.Postings = append(c.transferPostings(shares, lots, false), t.Postings...)
+		t.Postings = append(t.Postings, c.transferCounter(t.Postings, pt.CurrencyCode))
+	default:
+		return t, fmt.Errorf("%s: transaction %s has unknown type %s", p.Name, pt.UUID, pt.Type)
+	}
+	return t, nil
+}
+
+// transferPostings returns the postings moving the lots to or from the
+// securities account of shares.
+func (c *portfolioConverter) transferPostings(shares goledger.Posting, lots []lot, out bool) []goledger.Posting {
+	var postings []goledger.Posting
+	for _, l := range lots {
+		shares.Value, shares.Cost, shares.CostCurrency = l.quantity, l.cost, l.currency
+		if out {
+			shares.Value = shares.Value.Neg()
+		}
+		postings = append(postings, shares)
+	}
+	return postings
+}
+
+// transferCounter returns the posting to the transfers account that
+// balances the postings of a transfer, which are the shares at their cost
+// and the fees and taxes in currency.
+func (c *portfolioConverter) transferCounter(postings []goledger.Posting, currency string) goledger.Posting {
+	sum := decimal.Zero
+	for _, p := range postings {
+		if !p.Cost.IsZero() {
+			currency = p.CostCurrency
+			sum = sum.Add(p.Value.Mul(p.Cost))
+		} else {
+			sum = sum.Add(p.Value)
+		}
+	}
+	return goledger.Posting{Account: c.accounts.Transfers, Value: sum.Neg().Round(2), Currency: currency}
+}
+
+// take removes the given quantity of shares from the lots in FIFO order.
+// It returns the removed lots and the remaining ones.
+func take(lots []lot, quantity decimal.Decimal) ([]lot, []lot, error) {
+	var taken []lot
+	lots = append([]lot(nil), lots...)
+	for quantity.IsPositive() && len(lots) > 0 {
+		l := lots[0]
+		if l.quantity.GreaterThan(quantity) {
+			lots[0].quantity = l.quantity.Sub(quantity)
+			l.quantity = quantity
+		} else {
+			lots = lots[1:]
+		}
+		taken = append(taken, l)
+		quantity = quantity.Sub(l.quantity)
+	}
+	if quantity.IsPositive() {
+		return nil, nil, fmt.Errorf("%s shares more than held", quantity)
+	}
+	return taken, lots, nil
+}
+
+// convertDividends converts a dividend payment to the account a.
+func (c *portfolioConverter) convertDividends(a *importer.PortfolioAccount, at *importer.PortfolioAccountTransaction) (goledger.Transaction, error) {
+	if at.Security == nil {
+		return goledger.Transaction{}, fmt.Errorf("dividends transaction %s has no security", at.UUID)
+	}
+	amount := at.Value()
+	t := c.transaction(at.Time(), at.Type, at.Security, at.UUID, at.Note, at.Units, at.CurrencyCode)
+	gross := amount.Add(at.Units.Sum("FEE")).Add(at.Units.Sum("TAX"))
+	t.Postings = append([]goledger.Posting{{Account: c.cashAccount(a), Value: amount, Currency: at.CurrencyCode}}, t.Postings...)
+	t.Postings = append(t.Postings, goledger.Posting{Account: c.accounts.Dividends, Value: gross.Neg(), Currency: at.CurrencyCode})
+	return t, nil
+}
+
+// ConvertPortfolioPrices returns the historical prices of the securities
+// in a Portfolio Performance file, including the latest quotes, ordered by
+// date. Securities without a currency are priced in the base currency of
+// the file.
+func ConvertPortfolioPrices(client *importer.PortfolioClient) []goledger.Price {
+	var prices []goledger.Price
+	for _, s := range client.Securities {
+		currency := s.CurrencyCode
+		if currency == "" {
+			currency = client.BaseCurrency
+		}
+		var last time.Time
+		for _, p := range s.Prices {
+			prices = append(prices, goledger.Price{Date: p.Time(), Commodity: s.Symbol(), Value: p.Price(), Currency: currency})
+			if p.Time().After(last) {
+				last = p.Time()
+			}
+		}
+		if s.Latest != nil && s.Latest.Time().After(last) {
+			prices = append(prices, goledger.Price{Date: s.Latest.Time(), Commodity: s.Symbol(), Value: s.Latest.Price(), Currency: currency})
+		}
+	}
+	sort.SliceStable(prices, func(i, j int) bool {
+		return prices[i].Date.Before(prices[j].Date)
+	})
+	return prices
+}
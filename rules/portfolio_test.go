@@ -0,0 +1,189 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package rules
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/julian-klode/goledger"
+	"github.com/julian-klode/goledger/importer"
+	"github.com/shopspring/decimal"
+)
+
+// portfolioUnit returns a unit of the given type with an amount in cents.
+func portfolioUnit(typ string, cents int64) importer.PortfolioUnit {
+	var u importer.PortfolioUnit
+	u.Type = typ
+	u.Amount.Currency = "EUR"
+	u.Amount.Amount = decimal.New(cents, 0)
+	return u
+}
+
+// portfolioTransaction returns a portfolio transaction of shares of the
+// security for an amount in cents.
+func portfolioTransaction(uuid, typ, date string, security *importer.PortfolioSecurity, shares int64, cents int64, units ...importer.PortfolioUnit) importer.PortfolioTransaction {
+	return importer.PortfolioTransaction{
+		UUID:         uuid,
+		Type:         typ,
+		CurrencyCode: "EUR",
+		Amount:       decimal.New(cents, 0),
+		Date:         date,
+		Shares:       decimal.New(shares, 8),
+		Security:     security,
+		Units:        units,
+	}
+}
+
+// testPortfolioClient returns a client with two portfolios and a deposit
+// account.
+func testPortfolioClient() *importer.PortfolioClient {
+	security := &importer.PortfolioSecurity{UUID: "s1", Name: "World", CurrencyCode: "EUR", ISIN: "IE00B4L5Y983"}
+	return &importer.PortfolioClient{
+		BaseCurrency: "EUR",
+		Securities:   []importer.PortfolioSecurity{*security},
+		Accounts: []importer.PortfolioAccount{{
+			UUID: "a1", Name: "Cash", CurrencyCode: "EUR",
+			Transactions: []importer.PortfolioAccountTransaction{
+				{UUID: "at1", Type: "DEPOSIT", CurrencyCode: "EUR", Amount: decimal.New(100000, 0), Date: "2017-01-01T00:00"},
+				{UUID: "at2", Type: "DIVIDENDS", CurrencyCode: "EUR", Amount: decimal.New(1200, 0), Date: "2017-03-15T00:00", Security: security,
+					Units: importer.PortfolioUnits{portfolioUnit("TAX", 300)}},
+			},
+		}},
+		Portfolios: []importer.Portfolio{
+			{Name: "Depot", Transactions: []importer.PortfolioTransaction{
+				portfolioTransaction("pt1", "BUY", "2017-01-02T00:00", security, 10, 40995, portfolioUnit("FEE", 995)),
+				portfolioTransaction("pt2", "BUY", "2017-02-01T00:00", security, 10, 50000),
+				// Takes the first lot and half of the second one
+				portfolioTransaction("pt3", "SELL", "2017-03-01T00:00", security, 15, 90000, portfolioUnit("FEE", 1000), portfolioUnit("TAX", 2000)),
+				portfolioTransaction("pt4", "TRANSFER_OUT", "2017-04-01T00:00", security, 5, 25000, portfolioUnit("FEE", 200)),
+			}},
+			{Name: "Other", Transactions: []importer.PortfolioTransaction{
+				portfolioTransaction("pt5", "TRANSFER_IN", "2017-04-01T00:00", security, 5, 25000, portfolioUnit("TAX", 100)),
+			}},
+		},
+	}
+}
+
+func TestConvertPortfolio(t *testing.T) {
+	r, err := Parse(strings.NewReader("account2 income:deposits\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transactions, err := r.ConvertPortfolio(testPortfolioClient(), DefaultPortfolioAccounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	for i := range transactions {
+		if err := transactions[i].Validate(); err != nil {
+			t.Error(err)
+		}
+		if err := (goledger.LedgerRenderer{}).RenderTransaction(&b, &transactions[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := `2017/01/01 DEPOSIT
+    ; id: at1
+    assets:cash  1000.00 EUR
+    income:deposits  -1000.00 EUR
+
+2017/01/02 Buy World
+    ; id: pt1
+    assets:portfolio:Depot  10.00 "IE00B4L5Y983" {40.00 EUR}
+    expenses:fees  9.95 EUR
+    assets:cash  -409.95 EUR
+
+2017/02/01 Buy World
+    ; id: pt2
+    assets:portfolio:Depot  10.00 "IE00B4L5Y983" {50.00 EUR}
+    assets:cash  -500.00 EUR
+
+2017/03/01 Sell World
+    ; id: pt3
+    assets:portfolio:Depot  -10.00 "IE00B4L5Y983" {40.00 EUR} @ 62.00 EUR
+    assets:portfolio:Depot  -5.00 "IE00B4L5Y983" {50.00 EUR} @ 62.00 EUR
+    expenses:fees  10.00 EUR
+    expenses:taxes  20.00 EUR
+    assets:cash  900.00 EUR
+    income:capital-gains  -280.00 EUR
+
+2017/03/15 Dividends of World
+    ; id: at2
+    assets:cash  12.00 EUR
+    expenses:taxes  3.00 EUR
+    income:dividends  -15.00 EUR
+
+2017/04/01 Transfer of World
+    ; id: pt4
+    assets:portfolio:Depot  -5.00 "IE00B4L5Y983" {50.00 EUR}
+    expenses:fees  2.00 EUR
+    equity:transfers  248.00 EUR
+
+2017/04/01 Transfer of World
+    ; id: pt5
+    assets:portfolio:Other  5.00 "IE00B4L5Y983" {50.00 EUR}
+    expenses:taxes  1.00 EUR
+    equity:transfers  -251.00 EUR
+
+`
+	if b.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestConvertPortfolioErrors(t *testing.T) {
+	client := testPortfolioClient()
+	// Selling more shares than bought
+	client.Portfolios[0].Transactions[2].Shares = decimal.New(25, 8)
+	if _, err := (&Rules{}).ConvertPortfolio(client, DefaultPortfolioAccounts); err == nil {
+		t.Error("expected an error for selling more shares than held")
+	}
+
+	client = testPortfolioClient()
+	client.Portfolios[0].Transactions[0].Security = nil
+	if _, err := (&Rules{}).ConvertPortfolio(client, DefaultPortfolioAccounts); err == nil {
+		t.Error("expected an error for a transaction without a security")
+	}
+}
+
+func TestConvertPortfolioPrices(t *testing.T) {
+	client := &importer.PortfolioClient{
+		BaseCurrency: "EUR",
+		Securities: []importer.PortfolioSecurity{
+			{Name: "World", CurrencyCode: "USD", ISIN: "IE00B4L5Y983",
+				Prices: []importer.PortfolioPrice{{Date: "2017-01-03", Value: decimal.New(41, 8)}, {Date: "2017-01-02", Value: decimal.New(40, 8)}},
+				// The latest quote is left out if it is not newer
+				Latest: &importer.PortfolioPrice{Date: "2017-01-03", Value: decimal.New(45, 8)}},
+			{Name: "Europe", TickerSymbol: "EU",
+				Latest: &importer.PortfolioPrice{Date: "2017-01-04", Value: decimal.New(20, 8)}},
+		},
+	}
+	var got []string
+	for _, p := range ConvertPortfolioPrices(client) {
+		got = append(got, p.Date.Format("2006-01-02")+" "+p.Commodity+" "+p.Value.String()+" "+p.Currency)
+	}
+	want := []string{
+		"2017-01-02 IE00B4L5Y983 40 USD",
+		"2017-01-03 IE00B4L5Y983 41 USD",
+		"2017-01-04 EU 20 EUR",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
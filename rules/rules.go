@@ -0,0 +1,507 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package rules converts importer transactions into ledger transactions.
+//
+// Rules are read from a file similar to hledger's CSV rules:
+//
+//	# Default accounts
+//	account1 assets:unknown
+//	account2 expenses:unknown
+//
+//	# Map local accounts (IBANs, card numbers, ...) to ledger accounts
+//	local-account DE89370400440532013000 assets:bank:giro
+//
+//	# Transfers to and from sub-accounts like N26 Spaces go to account1:NAME,
+//	# unless the ID of the sub-account or space:NAME is mapped
+//	local-account space:Holidays assets:n26:holidays
+//
+//	# Blocks start with one or more if lines, any of which may match
+//	if REWE
+//	if %category food-groceries
+//	    account2 expenses:food
+//
+//	# & combines a matcher with the previous one
+//	if %remote-name amazon
+//	& %amount -100..0
+//	    account2 expenses:shopping
+//	    description Amazon: %reference-text
+//
+// A matcher without a field matches the remote name or the reference text.
+// Text patterns are case-insensitive regular expressions that are tried on
+// the value, and on the value with all spaces removed, with and without the
+// spaces of the pattern. Amount patterns are
+// inclusive ranges MIN..MAX, where either side may be left out, or a single
+// number.
+//
+// All matching blocks are applied in order, so later blocks override the
+// assignments of earlier ones.
+package rules
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/julian-klode/goledger"
+	"github.com/julian-klode/goledger/importer"
+	"github.com/shopspring/decimal"
+)
+
+// Rules describes how to convert transactions.
+type Rules struct {
+	// Account1 is the local account if LocalAccounts has no entry.
+	Account1 string
+	// Account2 is the default account for the other side. If empty,
+	// expenses:unknown or income:unknown is used, depending on the sign.
+	Account2 string
+	// LocalAccounts maps importer.Transaction.LocalAccount() values to
+	// ledger accounts.
+	LocalAccounts map[string]string
+
+	blocks []*block
+}
+
+// block is an if block in the rules file.
+type block struct {
+	// matchers is a disjunction of conjunctions of matchers
+	matchers    [][]matcher
+	assignments []assignment
+}
+
+// matcher matches a field of a transaction.
+type matcher struct {
+	field string
+	re    *regexp.Regexp
+	// compact is re with the spaces removed, matched against the value
+	// with the spaces removed, if the pattern contains spaces
+	compact *regexp.Regexp
+	// min and max are used for amount matchers
+	min, max *decimal.Decimal
+}
+
+// assignment sets a field of the resulting transaction.
+type assignment struct {
+	field string
+	value string
+}
+
+var fields = map[string]func(t importer.Transaction) string{
+	"remote-name":    importer.Transaction.RemoteName,
+	"remote-account": importer.Transaction.RemoteAccount,
+	"reference-text": importer.Transaction.ReferenceText,
+	"local-account":  importer.Transaction.LocalAccount,
+	"currency":       importer.Transaction.Currency,
+	"id":             importer.Transaction.ID,
+	"category":       func(t importer.Transaction) string { return t.Category().String() },
+	"amount":         func(t importer.Transaction) string { return t.Amount().String() },
+}
+
+var assignable = map[string]bool{
+	"account1":    true,
+	"account2":    true,
+	"description": true,
+}
+
+// Parse parses rules from a reader.
+func Parse(r io.Reader) (*Rules, error) {
+	return parse(r, "")
+}
+
+// ParseFile parses the rules file at path.
+func ParseFile(path string) (*Rules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		f.Close()
+	}()
+	return parse(f, path)
+}
+
+func parse(r io.Reader, path string) (*Rules, error) {
+	rules := &Rules{LocalAccounts: make(map[string]string)}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	errorf := func(format string, args ...interface{}) error {
+		return &goledger.ParseError{Path: path, Line: line, Err: fmt.Errorf(format, args...)}
+	}
+
+	var current *block
+	for scanner.Scan() {
+		line++
+		text := strings.TrimRight(scanner.Text(), " \t\r")
+		trimmed := strings.TrimSpace(text)
+		if trimmed == "" || trimmed[0] == '#' || trimmed[0] == ';' {
+			continue
+		}
+		indented := text[0] == ' ' || text[0] == '\t'
+		keyword, value := splitKeyword(trimmed)
+
+		switch {
+		case indented:
+			if current == nil {
+				return nil, errorf("assignment outside of an if block")
+			}
+			if !assignable[keyword] || value == "" {
+				return nil, errorf("invalid assignment %q", trimmed)
+			}
+			current.assignments = append(current.assignments, assignment{keyword, value})
+		case keyword == "if":
+			if current == nil || len(current.assignments) != 0 {
+				current = &block{}
+				rules.blocks = append(rules.blocks, current)
+			}
+			if value == "" {
+				// Matchers follow on the next lines
+				continue
+			}
+			m, err := parseMatcher(value)
+			if err != nil {
+				return nil, errorf("%s", err)
+			}
+			current.matchers = append(current.matchers, []matcher{m})
+		case trimmed[0] == '&':
+			if current == nil || len(current.matchers) == 0 || len(current.assignments) != 0 {
+				return nil, errorf("& without preceding matcher")
+			}
+			m, err := parseMatcher(strings.TrimSpace(trimmed[1:]))
+			if err != nil {
+				return nil, errorf("%s", err)
+			}
+			last := len(current.matchers) - 1
+			current.matchers[last] = append(current.matchers[last], m)
+		case current != nil && len(current.assignments) == 0:
+			m, err := parseMatcher(trimmed)
+			if err != nil {
+				return nil, errorf("%s", err)
+			}
+			current.matchers = append(current.matchers, []matcher{m})
+		case keyword == "account1":
+			rules.Account1 = value
+		case keyword == "account2":
+			rules.Account2 = value
+		case keyword == "local-account":
+			id, account := splitKeyword(value)
+			if id == "" || account == "" {
+				return nil, errorf("expected local-account ID ACCOUNT")
+			}
+			rules.LocalAccounts[id] = account
+		default:
+			return nil, errorf("unknown directive %q", keyword)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, b := range rules.blocks {
+		if len(b.matchers) == 0 {
+			return nil, &goledger.ParseError{Path: path, Line: line, Err: fmt.Errorf("if block without matchers")}
+		}
+	}
+	return rules, nil
+}
+
+// splitKeyword splits a line at the first white space.
+func splitKeyword(s string) (string, string) {
+	i := strings.IndexAny(s, " \t")
+	if i == -1 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
+
+func parseMatcher(s string) (matcher, error) {
+	var m matcher
+	if strings.HasPrefix(s, "%") {
+		m.field, s = splitKeyword(s[1:])
+		if fields[m.field] == nil {
+			return m, fmt.Errorf("unknown field %q", m.field)
+		}
+	}
+	if s == "" {
+		return m, fmt.Errorf("empty pattern")
+	}
+
+	if m.field == "amount" {
+		return m, m.parseRange(s)
+	}
+
+	re, err := regexp.Compile("(?i)" + s)
+	if err != nil {
+		return m, err
+	}
+	m.re = re
+	if compact := strings.Join(strings.Fields(s), ""); compact != s {
+		// Patterns that are not valid without spaces are only matched
+		// with them
+		m.compact, _ = regexp.Compile("(?i)" + compact)
+	}
+	return m, nil
+}
+
+func (m *matcher) parseRange(s string) error {
+	parts := strings.SplitN(s, "..", 2)
+	if len(parts) == 1 {
+		parts = append(parts, parts[0])
+	}
+	for i, part := range parts {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		d, err := decimal.NewFromString(part)
+		if err != nil {
+			return fmt.Errorf("invalid amount range %q", s)
+		}
+		if i == 0 {
+			m.min = &d
+		} else {
+			m.max = &d
+		}
+	}
+	return nil
+}
+
+func (m *matcher) matchText(s string) bool {
+	compact := strings.Join(strings.Fields(s), "")
+	return m.re.MatchString(s) || m.re.MatchString(compact) || (m.compact != nil && m.compact.MatchString(compact))
+}
+
+func (m *matcher) match(t importer.Transaction) bool {
+	switch m.field {
+	case "":
+		return m.matchText(t.RemoteName()) || m.matchText(t.ReferenceText())
+	case "amount":
+		amount := t.Amount()
+		return (m.min == nil || amount.GreaterThanOrEqual(*m.min)) && (m.max == nil || amount.LessThanOrEqual(*m.max))
+	default:
+		return m.matchText(fields[m.field](t))
+	}
+}
+
+func (b *block) match(t importer.Transaction) bool {
+	for _, conjunction := range b.matchers {
+		matched := true
+		for i := range conjunction {
+			if !conjunction[i].match(t) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// interpolate replaces %field references in s by the values of t.
+var interpolation = regexp.MustCompile(`%[a-z][a-z0-9-]*`)
+
+func interpolate(s string, t importer.Transaction) string {
+	return interpolation.ReplaceAllStringFunc(s, func(ref string) string {
+		if f := fields[ref[1:]]; f != nil {
+			return f(t)
+		}
+		return ref
+	})
+}
+
+// spaceAccount returns the ledger account of the sub-account a transfer
+// between account1 and a sub-account, see importer.SpaceTransaction, goes to.
+// It is the account LocalAccounts maps the ID of the sub-account or
+// space:NAME to, or otherwise account1:NAME.
+func (r *Rules) spaceAccount(t importer.Transaction, account1 string) string {
+	st, ok := t.(importer.SpaceTransaction)
+	if !ok {
+		return ""
+	}
+	name, id := st.Space()
+	if name == "" {
+		return ""
+	}
+	if account, ok := r.LocalAccounts[id]; ok && id != "" {
+		return account
+	}
+	if account, ok := r.LocalAccounts["space:"+name]; ok {
+		return account
+	}
+	var b strings.Builder
+	for _, r := range strings.ToLower(strings.Join(strings.Fields(name), " ")) {
+		switch r {
+		case ':', ';', '(', ')', '[', ']':
+			b.WriteRune('-')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return account1 + ":" + b.String()
+}
+
+// localAccount returns the default account1 of transactions of the local
+// account id, before the rule blocks are applied.
+func (r *Rules) localAccount(id string) string {
+	account := r.Account1
+	if a, ok := r.LocalAccounts[id]; ok {
+		account = a
+	}
+	if account == "" {
+		account = "assets:unknown"
+	}
+	return account
+}
+
+// assignments returns the values assigned to account1, account2, and
+// description by the rules for the transaction, with defaults filled in.
+func (r *Rules) assignments(t importer.Transaction) map[string]string {
+	values := map[string]string{
+		"account1":    r.localAccount(t.LocalAccount()),
+		"account2":    r.Account2,
+		"description": t.RemoteName(),
+	}
+	if account := r.spaceAccount(t, values["account1"]); account != "" {
+		values["account2"] = account
+	}
+	if values["account2"] == "" {
+		if t.Amount().IsPositive() {
+			values["account2"] = "income:unknown"
+		} else {
+			values["account2"] = "expenses:unknown"
+		}
+	}
+	if values["description"] == "" {
+		values["description"] = t.ReferenceText()
+	}
+
+	for _, b := range r.blocks {
+		if b.match(t) {
+			for _, a := range b.assignments {
+				values[a.field] = interpolate(a.value, t)
+			}
+		}
+	}
+	return values
+}
+
+// Convert converts an importer transaction into a ledger transaction.
+//
+// The first posting books the amount on the local account, the second
+// one the negated amount on the other account. For foreign transactions,
+// the second posting is in the foreign currency, with the amount as its
+// total price.
+//
+// The ID of t becomes the ID of the transaction, and its category, unless
+// it is CategoryMisc, the tag category. Transactions that know whether they
+// are pending are marked as cleared or pending, and pending ones are also
+// tagged pending.
+func (r *Rules) Convert(t importer.Transaction) goledger.Transaction {
+	values := r.assignments(t)
+	local := goledger.Posting{
+		Account:  values["account1"],
+		Value:    t.Amount(),
+		Currency: t.Currency(),
+	}
+	remote := goledger.Posting{
+		Account:  values["account2"],
+		Value:    t.Amount().Neg(),
+		Currency: t.Currency(),
+	}
+	if ft, ok := t.(importer.ForeignTransaction); ok && !ft.ForeignAmount().IsZero() && ft.ForeignCurrency() != "" && ft.ForeignCurrency() != t.Currency() {
+		remote.Value = ft.ForeignAmount().Abs()
+		if t.Amount().IsPositive() {
+			remote.Value = remote.Value.Neg()
+		}
+		remote.Currency = ft.ForeignCurrency()
+		remote.SetTotalPrice(t.Amount(), t.Currency())
+	}
+
+	date := t.Date()
+	if date.IsZero() {
+		date = t.ValutaDate()
+	}
+	result := goledger.Transaction{
+		Date:        date,
+		ValutaDate:  t.ValutaDate(),
+		Description: values["description"],
+		Postings:    []goledger.Posting{local, remote},
+		ID:          t.ID(),
+	}
+	if t.Category() != importer.CategoryMisc {
+		result.Tags = append(result.Tags, goledger.Tag{Name: "category", Value: t.Category().String()})
+	}
+	if pt, ok := t.(importer.PendingTransaction); ok {
+		result.Status = goledger.Cleared
+		if pt.Pending() {
+			result.Status = goledger.Pending
+			result.Tags = append(result.Tags, goledger.Tag{Name: "pending"})
+		}
+	}
+	return result
+}
+
+// ConvertStatement converts the transactions of a statement like Convert,
+// returning them in the same order.
+//
+// If the statement has a closing balance, it is asserted on the posting to
+// the account of the statement (account1 of its local account, see
+// LocalAccounts) of the transaction with the latest date, so that the
+// journal is checked against the balance reported by the bank. Transactions
+// whose account1 is changed by the rules are not considered. Statements
+// with pending transactions, whose closing balance does not include them
+// yet, are not asserted.
+func (r *Rules) ConvertStatement(s importer.Statement) []goledger.Transaction {
+	var transactions []goledger.Transaction
+	pending := false
+	for _, t := range s.Transactions {
+		if pt, ok := t.(importer.PendingTransaction); ok && pt.Pending() {
+			pending = true
+		}
+		transactions = append(transactions, r.Convert(t))
+	}
+	if s.Closing == nil || pending {
+		return transactions
+	}
+
+	account := r.localAccount(s.LocalAccount)
+	var local *goledger.Posting
+	var date time.Time
+	for i := range transactions {
+		p := &transactions[i].Postings[0]
+		if p.Account != account || (s.Closing.Currency != "" && p.Currency != s.Closing.Currency) {
+			continue
+		}
+		if local == nil || !transactions[i].Date.Before(date) {
+			local, date = p, transactions[i].Date
+		}
+	}
+	if local == nil || (!s.Closing.Date.IsZero() && s.Closing.Date.Before(date)) {
+		return transactions
+	}
+
+	local.Assertion = goledger.AssertBalance
+	local.AssertionValue = s.Closing.Amount
+	local.AssertionCurrency = s.Closing.Currency
+	if local.AssertionCurrency == "" {
+		local.AssertionCurrency = local.Currency
+	}
+	return transactions
+}
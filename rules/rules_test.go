@@ -0,0 +1,257 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package rules
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julian-klode/goledger"
+	"github.com/julian-klode/goledger/importer"
+	"github.com/shopspring/decimal"
+)
+
+// testTransaction is an importer.Transaction with the given values.
+type testTransaction struct {
+	id            string
+	date          time.Time
+	localAccount  string
+	remoteName    string
+	remoteAccount string
+	referenceText string
+	amount        decimal.Decimal
+}
+
+func (t testTransaction) ID() string                  { return t.id }
+func (t testTransaction) Category() importer.Category { return importer.CategoryMisc }
+func (t testTransaction) Date() time.Time             { return t.date }
+func (t testTransaction) ValutaDate() time.Time       { return t.date }
+func (t testTransaction) LocalAccount() string        { return t.localAccount }
+func (t testTransaction) RemoteName() string          { return t.remoteName }
+func (t testTransaction) RemoteAccount() string       { return t.remoteAccount }
+func (t testTransaction) ReferenceText() string       { return t.referenceText }
+func (t testTransaction) Amount() decimal.Decimal     { return t.amount }
+func (t testTransaction) Currency() string            { return "EUR" }
+
+// foreignTransaction is a testTransaction in a foreign currency.
+type foreignTransaction struct {
+	testTransaction
+	foreignAmount   decimal.Decimal
+	foreignCurrency string
+}
+
+func (t foreignTransaction) ForeignAmount() decimal.Decimal { return t.foreignAmount }
+func (t foreignTransaction) ForeignCurrency() string        { return t.foreignCurrency }
+
+const testRules = `account1 assets:unknown
+local-account DE89370400440532013000 assets:bank:giro
+local-account 4111111111111111 liabilities:visa
+
+if %remote-name amazon
+& %amount -100..0
+    account2 expenses:shopping
+    description Amazon: %reference-text
+
+if %local-account ^4111
+& %reference-text fee
+    account2 expenses:fees
+
+if %remote-account DE02
+if PayPal
+    account2 assets:paypal
+`
+
+func TestConvert(t *testing.T) {
+	r, err := Parse(strings.NewReader(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		t           testTransaction
+		account1    string
+		account2    string
+		description string
+	}{
+		{testTransaction{localAccount: "DE89370400440532013000", remoteName: "AMAZON EU", referenceText: "Books", amount: decimal.New(-20, 0)},
+			"assets:bank:giro", "expenses:shopping", "Amazon: Books"},
+		// Both matchers combined by & have to match
+		{testTransaction{localAccount: "DE89370400440532013000", remoteName: "Amazon", amount: decimal.New(-200, 0)},
+			"assets:bank:giro", "expenses:unknown", "Amazon"},
+		{testTransaction{localAccount: "DE89370400440532013000", remoteName: "Amazon", amount: decimal.New(20, 0)},
+			"assets:bank:giro", "income:unknown", "Amazon"},
+		{testTransaction{localAccount: "4111111111111111", remoteName: "Bank", referenceText: "Annual fee", amount: decimal.New(-30, 0)},
+			"liabilities:visa", "expenses:fees", "Bank"},
+		{testTransaction{localAccount: "DE89370400440532013000", remoteName: "Bank", referenceText: "Annual fee", amount: decimal.New(-30, 0)},
+			"assets:bank:giro", "expenses:unknown", "Bank"},
+		// Either of the if lines may match
+		{testTransaction{localAccount: "other", remoteAccount: "DE02120300000000202051", referenceText: "Top up", amount: decimal.New(-10, 0)},
+			"assets:unknown", "assets:paypal", "Top up"},
+		{testTransaction{remoteName: "PayPal Europe", amount: decimal.New(-10, 0)},
+			"assets:unknown", "assets:paypal", "PayPal Europe"},
+	} {
+		got := r.Convert(test.t)
+		if got.Postings[0].Account != test.account1 || got.Postings[1].Account != test.account2 || got.Description != test.description {
+			t.Errorf("%+v: got %s, %s, %q, want %s, %s, %q", test.t, got.Postings[0].Account, got.Postings[1].Account, got.Description,
+				test.account1, test.account2, test.description)
+		}
+		if err := got.Validate(); err != nil {
+			t.Errorf("%+v: %v", test.t, err)
+		}
+	}
+}
+
+func TestConvertForeign(t *testing.T) {
+	r, err := Parse(strings.NewReader(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := r.Convert(foreignTransaction{
+		testTransaction{date: time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC), remoteName: "Cafe", amount: decimal.New(-10, 0)},
+		decimal.RequireFromString("-9.20"), "USD",
+	})
+	if err := got.Validate(); err != nil {
+		t.Error(err)
+	}
+	var b strings.Builder
+	if err := got.Print(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := "2017/01/02 Cafe\n    assets:unknown  -10.00 EUR\n    expenses:unknown  9.20 USD @@ 10.00 EUR\n\n"
+	if b.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", b.String(), want)
+	}
+
+	// The printed total price is parsed back
+	j, err := goledger.ParseJournal(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j[0].Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, rules := range []string{
+		"    account2 expenses:food\n",
+		"if REWE\n    account3 expenses:food\n",
+		"& REWE\n",
+		"if %unknown REWE\n    account2 expenses:food\n",
+		"if %amount 1..x\n    account2 expenses:food\n",
+		"if\n    account2 expenses:food\n",
+		"local-account DE89370400440532013000\n",
+	} {
+		if _, err := Parse(strings.NewReader(rules)); err == nil {
+			t.Errorf("no error for %q", rules)
+		}
+	}
+}
+
+func TestMatchWithoutSpaces(t *testing.T) {
+	r, err := Parse(strings.NewReader("if REWE Markt\n    account2 expenses:food\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"REWE Markt GmbH", "REWEMARKT", "R E W E  M a r k t", "REWE\tMarkt"} {
+		tr := testTransaction{remoteName: name, amount: decimal.New(-5, 0)}
+		if account := r.Convert(tr).Postings[1].Account; account != "expenses:food" {
+			t.Errorf("%q: got account2 %q, want expenses:food", name, account)
+		}
+	}
+	tr := testTransaction{remoteName: "REWE Supermarkt", amount: decimal.New(-5, 0)}
+	if account := r.Convert(tr).Postings[1].Account; account != "expenses:unknown" {
+		t.Errorf("%q: got account2 %q, want expenses:unknown", tr.remoteName, account)
+	}
+}
+
+func TestMatchFieldsWithoutSpaces(t *testing.T) {
+	r, err := Parse(strings.NewReader(`if %reference-text card payment
+& %local-account DE89 3704
+    account2 expenses:card
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := testTransaction{localAccount: "DE89370400440532013000", referenceText: "CARDPAYMENT 123", amount: decimal.New(-5, 0)}
+	if account := r.Convert(tr).Postings[1].Account; account != "expenses:card" {
+		t.Errorf("got account2 %q, want expenses:card", account)
+	}
+	tr.localAccount = "DE02120300000000202051"
+	if account := r.Convert(tr).Postings[1].Account; account != "expenses:unknown" {
+		t.Errorf("got account2 %q, want expenses:unknown", account)
+	}
+}
+
+// pendingTransaction is a testTransaction that is pending.
+type pendingTransaction struct {
+	testTransaction
+}
+
+func (t pendingTransaction) Pending() bool { return true }
+
+func TestConvertStatement(t *testing.T) {
+	r, err := Parse(strings.NewReader(testRules + "\nif Cash\n    account1 assets:cash\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const giro = "DE89370400440532013000"
+	day := func(d int) time.Time { return time.Date(2017, 1, d, 0, 0, 0, 0, time.UTC) }
+	transactions := []importer.Transaction{
+		testTransaction{date: day(3), localAccount: giro, remoteName: "REWE", amount: decimal.New(-5, 0)},
+		testTransaction{date: day(2), localAccount: giro, remoteName: "Salary", amount: decimal.New(100, 0)},
+		// The latest transaction is booked on another account by the rules
+		testTransaction{date: day(4), localAccount: giro, remoteName: "Cash", amount: decimal.New(-20, 0)},
+	}
+	closing := func(date time.Time, currency string) *importer.Balance {
+		return &importer.Balance{Date: date, Amount: decimal.New(75, 0), Currency: currency}
+	}
+
+	for _, test := range []struct {
+		name      string
+		statement importer.Statement
+		asserted  int
+	}{
+		{"latest", importer.Statement{LocalAccount: giro, Closing: closing(day(4), "EUR"), Transactions: transactions}, 0},
+		{"undated", importer.Statement{LocalAccount: giro, Closing: closing(time.Time{}, ""), Transactions: transactions}, 0},
+		{"no closing", importer.Statement{LocalAccount: giro, Transactions: transactions}, -1},
+		{"closing before", importer.Statement{LocalAccount: giro, Closing: closing(day(2), "EUR"), Transactions: transactions}, -1},
+		{"other currency", importer.Statement{LocalAccount: giro, Closing: closing(day(4), "USD"), Transactions: transactions}, -1},
+		{"other account", importer.Statement{LocalAccount: "other", Closing: closing(day(4), "EUR"), Transactions: transactions}, -1},
+		{"pending", importer.Statement{LocalAccount: giro, Closing: closing(day(4), "EUR"),
+			Transactions: append(transactions[:2:2], pendingTransaction{transactions[2].(testTransaction)})}, -1},
+	} {
+		converted := r.ConvertStatement(test.statement)
+		if len(converted) != len(test.statement.Transactions) {
+			t.Fatalf("%s: got %d transactions, want %d", test.name, len(converted), len(test.statement.Transactions))
+		}
+		for i, tr := range converted {
+			for j, p := range tr.Postings {
+				if i != test.asserted || j != 0 {
+					if p.Assertion != goledger.NoAssertion {
+						t.Errorf("%s: unexpected assertion on posting %d of transaction %d", test.name, j, i)
+					}
+					continue
+				}
+				if p.Account != "assets:bank:giro" || p.Assertion != goledger.AssertBalance || !p.AssertionValue.Equal(decimal.New(75, 0)) || p.AssertionCurrency != "EUR" {
+					t.Errorf("%s: got %s %s %s %s, want assets:bank:giro = 75 EUR", test.name, p.Account, p.Assertion, p.AssertionValue, p.AssertionCurrency)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,274 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package rules
+
+import (
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/julian-klode/goledger"
+	"github.com/julian-klode/goledger/importer"
+)
+
+// TransferMatcher finds transfers between local accounts that were
+// imported from several sources, so that each side was imported as a
+// transaction of its own, like a transfer from the giro account to the
+// credit card that shows up in the statements of both.
+//
+// Two transactions are the sides of a transfer if they have opposite
+// amounts in the same currency, are at most Days days apart, belong to
+// different local accounts, and the remote account of one side is the
+// local account of the other. Matching reference texts only decide between
+// several such candidates, as texts like "SEPA Überweisung" are shared by
+// unrelated transactions.
+type TransferMatcher struct {
+	// Rules are used to compare accounts that have different IDs in
+	// different sources, like an IBAN and a card number, by the ledger
+	// accounts they are mapped to by Rules.LocalAccounts. It may be nil.
+	Rules *Rules
+	// Days is the maximum number of days between the two sides.
+	Days int
+}
+
+// TransferSide is the position of one side of a transfer in the lists
+// passed to TransferMatcher.Match.
+type TransferSide struct {
+	List  int
+	Index int
+}
+
+// Transfer is a pair of transactions that are the two sides of a transfer.
+type Transfer struct {
+	// Out is the side the money is sent from, In the receiving side.
+	Out TransferSide
+	In  TransferSide
+}
+
+// transferCandidate is a possible transfer with its score
+type transferCandidate struct {
+	Transfer
+	score int
+}
+
+// Match finds the transfers between the transactions in the lists. Each
+// transaction is part of at most one transfer; if a transaction could be
+// paired with several others, the pair with the most matching accounts and
+// reference texts, and then the one closest in time, wins.
+func (m *TransferMatcher) Match(lists ...[]importer.Transaction) []Transfer {
+	ids := make(map[string]string)
+	if m.Rules != nil {
+		for id, account := range m.Rules.LocalAccounts {
+			ids[normalizeAccountID(id)] = account
+		}
+	}
+
+	// Index the incoming sides by amount and currency
+	incoming := make(map[string][]TransferSide)
+	for i, list := range lists {
+		for j, t := range list {
+			if t.Amount().IsPositive() {
+				key := t.Amount().String() + " " + t.Currency()
+				incoming[key] = append(incoming[key], TransferSide{i, j})
+			}
+		}
+	}
+
+	var candidates []transferCandidate
+	for i, list := range lists {
+		for j, out := range list {
+			if !out.Amount().IsNegative() {
+				continue
+			}
+			for _, side := range incoming[out.Amount().Neg().String()+" "+out.Currency()] {
+				in := lists[side.List][side.Index]
+				if score, ok := m.score(ids, out, in, i != side.List); ok {
+					candidates = append(candidates, transferCandidate{Transfer{TransferSide{i, j}, side}, score})
+				}
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+
+	used := make(map[TransferSide]bool)
+	var transfers []Transfer
+	for _, c := range candidates {
+		if used[c.Out] || used[c.In] {
+			continue
+		}
+		used[c.Out], used[c.In] = true, true
+		transfers = append(transfers, c.Transfer)
+	}
+	sort.Slice(transfers, func(i, j int) bool {
+		if transfers[i].Out.List != transfers[j].Out.List {
+			return transfers[i].Out.List < transfers[j].Out.List
+		}
+		return transfers[i].Out.Index < transfers[j].Out.Index
+	})
+	return transfers
+}
+
+// score checks whether out and in may be the sides of a transfer, and if
+// so, how well they match. ids maps the normalized IDs of local accounts to
+// ledger accounts.
+func (m *TransferMatcher) score(ids map[string]string, out, in importer.Transaction, differentLists bool) (int, bool) {
+	switch {
+	case out.LocalAccount() == in.LocalAccount() && (out.LocalAccount() != "" || !differentLists):
+		return 0, false
+	case sameAccount(ids, out.LocalAccount(), in.LocalAccount()):
+		return 0, false
+	}
+	days := int(transferDate(out).Sub(transferDate(in)).Hours() / 24)
+	if days < 0 {
+		days = -days
+	}
+	if days > m.Days {
+		return 0, false
+	}
+
+	score := 0
+	if sameAccount(ids, out.RemoteAccount(), in.LocalAccount()) {
+		score += 4
+	}
+	if sameAccount(ids, in.RemoteAccount(), out.LocalAccount()) {
+		score += 4
+	}
+	if score == 0 {
+		return 0, false
+	}
+	if transferTextsMatch(out.ReferenceText(), in.ReferenceText()) {
+		score += 2
+	}
+	return score*100 - days, true
+}
+
+// sameAccount checks whether the account IDs a and b, like IBANs, refer to
+// the same account, either directly, or because they are mapped to the
+// same ledger account by ids, see score.
+func sameAccount(ids map[string]string, a, b string) bool {
+	a, b = normalizeAccountID(a), normalizeAccountID(b)
+	if a == "" || b == "" {
+		return false
+	}
+	return a == b || (ids[a] != "" && ids[a] == ids[b])
+}
+
+// normalizeAccountID removes spaces from an account ID and upper-cases it.
+func normalizeAccountID(id string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(id), ""))
+}
+
+// transferDate returns the calendar day of the transaction, or of its
+// valuta date if it has none, as midnight UTC. The day is taken in the
+// location of the date, so that dates of different sources, like midnight
+// in Berlin and midnight UTC, are compared by their days.
+func transferDate(t importer.Transaction) time.Time {
+	date := t.Date()
+	if date.IsZero() {
+		date = t.ValutaDate()
+	}
+	y, m, d := date.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// transferTextsMatch checks whether two reference texts share a word of at
+// least four letters or digits, case-insensitively.
+func transferTextsMatch(a, b string) bool {
+	split := func(s string) []string {
+		return strings.FieldsFunc(strings.ToLower(s), func(c rune) bool {
+			return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+		})
+	}
+	words := make(map[string]bool)
+	for _, word := range split(a) {
+		if len([]rune(word)) >= 4 {
+			words[word] = true
+		}
+	}
+	for _, word := range split(b) {
+		if words[word] {
+			return true
+		}
+	}
+	return false
+}
+
+// MergeTransfers returns the converted transactions of all lists, in order,
+// where the two sides of each transfer are merged into one transaction at
+// the position of the outgoing side. converted are the conversions of the
+// lists passed to TransferMatcher.Match, like the results of
+// Rules.ConvertStatement.
+//
+// The merged transaction is the outgoing side, with the local posting of
+// the incoming side replacing its other posting. The incoming posting
+// keeps its balance assertion, and has its own dates if they differ. The
+// ID of the incoming side is kept as the tag transfer-id.
+func MergeTransfers(transfers []Transfer, converted ...[]goledger.Transaction) []goledger.Transaction {
+	in := make(map[TransferSide]bool)
+	out := make(map[TransferSide]TransferSide)
+	for _, t := range transfers {
+		in[t.In] = true
+		out[t.Out] = t.In
+	}
+	var result []goledger.Transaction
+	for i, list := range converted {
+		for j, t := range list {
+			side := TransferSide{i, j}
+			if in[side] {
+				continue
+			}
+			if other, ok := out[side]; ok {
+				t = mergeTransfer(t, converted[other.List][other.Index])
+			}
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// mergeTransfer merges the converted sides of a transfer, see
+// MergeTransfers.
+func mergeTransfer(out, in goledger.Transaction) goledger.Transaction {
+	posting := in.Postings[0]
+	if !in.Date.Equal(out.Date) || !in.ValutaDate.Equal(out.ValutaDate) {
+		posting.Date = in.Date
+		if !in.ValutaDate.Equal(in.Date) {
+			posting.ValutaDate = in.ValutaDate
+		}
+	}
+	if in.Status == goledger.Pending {
+		out.Status = goledger.Pending
+	}
+	out.Postings = []goledger.Posting{out.Postings[0], posting}
+	out.Tags = append([]goledger.Tag(nil), out.Tags...)
+	for _, tag := range in.Tags {
+		if _, ok := out.Tag(tag.Name); !ok {
+			out.Tags = append(out.Tags, tag)
+		}
+	}
+	if in.ID != "" {
+		out.Tags = append(out.Tags, goledger.Tag{Name: "transfer-id", Value: in.ID})
+	}
+	if in.Comment != "" && in.Comment != out.Comment {
+		out.Comment = strings.TrimPrefix(out.Comment+"\n"+in.Comment, "\n")
+	}
+	return out
+}
@@ -0,0 +1,116 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package rules
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/julian-klode/goledger"
+	"github.com/julian-klode/goledger/importer"
+	"github.com/shopspring/decimal"
+)
+
+func TestTransferMatcher(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2017, 1, d, 0, 0, 0, 0, time.UTC)
+	}
+	giro := []importer.Transaction{
+		// Transfer to the savings account, naming it
+		testTransaction{id: "g1", date: day(2), localAccount: "DE02 1001 0010 0006 8201 01", remoteAccount: "DE89370400440532013000", referenceText: "SEPA Überweisung Sparen", amount: decimal.New(-100, 0)},
+		// Unrelated payment with the same amount and a generic text
+		testTransaction{id: "g2", date: day(3), localAccount: "DE02100100100006820101", remoteAccount: "DE12500105170648489890", referenceText: "SEPA Überweisung Miete", amount: decimal.New(-50, 0)},
+		// Payment of the credit card, mapped to the same ledger account
+		testTransaction{id: "g3", date: day(10), localAccount: "DE02100100100006820101", remoteAccount: "DE75512108001245126199", amount: decimal.New(-20, 0)},
+	}
+	savings := []importer.Transaction{
+		testTransaction{id: "s1", date: day(3), localAccount: "DE89370400440532013000", referenceText: "SEPA Überweisung Sparen", amount: decimal.New(100, 0)},
+		testTransaction{id: "s2", date: day(3), localAccount: "DE89370400440532013000", referenceText: "SEPA Überweisung Gutschrift", amount: decimal.New(50, 0)},
+	}
+	card := []importer.Transaction{
+		testTransaction{id: "c1", date: day(12), localAccount: "4111 XXXX XXXX 1111", amount: decimal.New(20, 0)},
+	}
+	r := &Rules{LocalAccounts: map[string]string{
+		"DE75512108001245126199": "liabilities:card",
+		"4111XXXXXXXX1111":       "liabilities:card",
+	}}
+
+	for _, test := range []struct {
+		days int
+		want []Transfer
+	}{
+		{3, []Transfer{{Out: TransferSide{0, 0}, In: TransferSide{1, 0}}, {Out: TransferSide{0, 2}, In: TransferSide{2, 0}}}},
+		{1, []Transfer{{Out: TransferSide{0, 0}, In: TransferSide{1, 0}}}},
+		{0, nil},
+	} {
+		m := TransferMatcher{Rules: r, Days: test.days}
+		if got := m.Match(giro, savings, card); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%d days: got transfers %v, want %v", test.days, got, test.want)
+		}
+	}
+}
+
+func TestTransferMatcherTimeZones(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	// N26 dates are midnight in Berlin, which is the day before in UTC
+	out := testTransaction{id: "n1", date: time.Date(2017, 1, 2, 0, 0, 0, 0, berlin), localAccount: "DE89370400440532013000", remoteAccount: "DE02100100100006820101", amount: decimal.New(-100, 0)}
+	for _, test := range []struct {
+		in   int
+		days int
+		want bool
+	}{
+		{2, 0, true},
+		{5, 3, true},
+		{6, 3, false},
+	} {
+		in := testTransaction{id: "g1", date: time.Date(2017, 1, test.in, 0, 0, 0, 0, time.UTC), localAccount: "DE02100100100006820101", amount: decimal.New(100, 0)}
+		m := TransferMatcher{Days: test.days}
+		if got := m.Match([]importer.Transaction{out}, []importer.Transaction{in}); (len(got) == 1) != test.want {
+			t.Errorf("January %d, %d days: got transfers %v, want a transfer: %v", test.in, test.days, got, test.want)
+		}
+	}
+}
+
+func TestMergeTransfers(t *testing.T) {
+	out := testTransaction{id: "out", date: time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC), localAccount: "giro", remoteAccount: "savings", amount: decimal.New(-100, 0)}
+	in := testTransaction{id: "in", date: time.Date(2017, 1, 3, 0, 0, 0, 0, time.UTC), localAccount: "savings", amount: decimal.New(100, 0)}
+	r := &Rules{LocalAccounts: map[string]string{"giro": "assets:giro", "savings": "assets:savings"}}
+	m := TransferMatcher{Rules: r, Days: 3}
+	transfers := m.Match([]importer.Transaction{out}, []importer.Transaction{in})
+	merged := MergeTransfers(transfers, []goledger.Transaction{r.Convert(out)}, []goledger.Transaction{r.Convert(in)})
+	if len(merged) != 1 {
+		t.Fatalf("got %d transactions, want 1", len(merged))
+	}
+	l := merged[0]
+	if err := l.Validate(); err != nil {
+		t.Error(err)
+	}
+	if l.ID != "out" || len(l.Postings) != 2 || l.Postings[0].Account != "assets:giro" || l.Postings[1].Account != "assets:savings" {
+		t.Errorf("got %+v", l)
+	}
+	if id, _ := l.Tag("transfer-id"); id != "in" {
+		t.Errorf("got transfer-id %q, want in", id)
+	}
+	if !l.Postings[1].Date.Equal(in.date) {
+		t.Errorf("got posting date %v, want %v", l.Postings[1].Date, in.date)
+	}
+}
@@ -0,0 +1,194 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package goledger
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/shopspring/decimal"
+)
+
+// CommodityStyle describes how amounts of a commodity are written, like
+// hledger's commodity directive.
+type CommodityStyle struct {
+	// Symbol is written instead of the commodity, for example € for EUR.
+	Symbol string
+	// Left places the commodity before the number.
+	Left bool
+	// Space separates the commodity and the number by a space.
+	Space bool
+	// DecimalMark is '.' or ','. If zero, '.' is used.
+	DecimalMark rune
+	// ThousandsSep separates groups of three digits. If zero, digits are
+	// not grouped.
+	ThousandsSep rune
+	// Precision is the minimum number of decimal digits. More digits are
+	// written if needed to represent a value exactly.
+	Precision int32
+}
+
+// DefaultCommodityStyle is the style of commodities without a style, as in
+// 1234.50 EUR.
+var DefaultCommodityStyle = CommodityStyle{Space: true, DecimalMark: '.', Precision: 2}
+
+// CommodityStyles maps commodities to their styles.
+type CommodityStyles map[string]CommodityStyle
+
+// Style returns the style of a commodity, or DefaultCommodityStyle if it
+// has none.
+func (s CommodityStyles) Style(commodity string) CommodityStyle {
+	if style, ok := s[commodity]; ok {
+		return style
+	}
+	return DefaultCommodityStyle
+}
+
+// Format formats an amount of the commodity in its style.
+func (s CommodityStyles) Format(value decimal.Decimal, commodity string) string {
+	style := s.Style(commodity)
+	number := style.formatNumber(value.Abs())
+	if value.IsNegative() {
+		number = "-" + number
+	}
+	if style.Symbol != "" {
+		commodity = style.Symbol
+	}
+	if commodity == "" {
+		return number
+	}
+	commodity = quoteCommodity(commodity)
+	space := ""
+	if style.Space {
+		space = " "
+	}
+	if !style.Left {
+		return number + space + commodity
+	}
+	if value.IsNegative() {
+		return "-" + commodity + space + number[1:]
+	}
+	return commodity + space + number
+}
+
+// formatNumber formats a non-negative number in the style.
+func (style CommodityStyle) formatNumber(value decimal.Decimal) string {
+	precision := style.Precision
+	if i := strings.IndexByte(value.String(), '.'); i != -1 && int32(len(value.String())-i-1) > precision {
+		precision = int32(len(value.String()) - i - 1)
+	}
+	digits := value.StringFixed(precision)
+	integer, fraction := digits, ""
+	if i := strings.IndexByte(digits, '.'); i != -1 {
+		integer, fraction = digits[:i], digits[i+1:]
+	}
+
+	var b strings.Builder
+	for i, c := range integer {
+		if style.ThousandsSep != 0 && i > 0 && (len(integer)-i)%3 == 0 {
+			b.WriteRune(style.ThousandsSep)
+		}
+		b.WriteRune(c)
+	}
+	if fraction != "" {
+		if style.DecimalMark == 0 {
+			b.WriteByte('.')
+		} else {
+			b.WriteRune(style.DecimalMark)
+		}
+		b.WriteString(fraction)
+	}
+	return b.String()
+}
+
+// quoteCommodity quotes a commodity if it contains characters that cannot
+// be part of an unquoted commodity, like digits or spaces.
+func quoteCommodity(commodity string) string {
+	if strings.IndexFunc(commodity, func(c rune) bool { return !isCommodityRune(c) }) != -1 {
+		return `"` + commodity + `"`
+	}
+	return commodity
+}
+
+// ParseCommodityStyle parses a sample amount like "€1.000,00" or
+// "1,000.00000000 BTC" into its commodity and style, as in hledger's
+// commodity directive.
+//
+// If the number contains both '.' and ',', the last one is the decimal
+// mark. If it contains only one of them, it is the decimal mark if it occurs
+// once, and the thousands separator otherwise.
+func ParseCommodityStyle(sample string) (string, CommodityStyle, error) {
+	return parseCommodityStyle(sample, 0)
+}
+
+// parseCommodityStyle is like ParseCommodityStyle, but with a known
+// decimal mark, if mark is not zero.
+func parseCommodityStyle(sample string, mark rune) (string, CommodityStyle, error) {
+	var style CommodityStyle
+	var commodity string
+	var err error
+	p := parser{}
+	s := strings.TrimSpace(sample)
+	if strings.HasPrefix(s, "-") || strings.HasPrefix(s, "+") {
+		s = strings.TrimSpace(s[1:])
+	}
+	if c, _ := utf8.DecodeRuneInString(s); c == '"' || isCommodityRune(c) {
+		before := s
+		if commodity, s, err = p.parseCommodity(s); err != nil {
+			return "", style, err
+		}
+		style.Left = true
+		style.Space = strings.HasSuffix(before[:len(before)-len(s)], " ")
+		s = strings.TrimSpace(strings.TrimLeft(s, "+-"))
+	}
+
+	end := strings.IndexFunc(s, func(c rune) bool { return !unicode.IsDigit(c) && c != '.' && c != ',' })
+	if end == -1 {
+		end = len(s)
+	}
+	number, rest := s[:end], s[end:]
+	if number == "" {
+		return "", style, fmt.Errorf("missing number in %q", sample)
+	}
+	if !style.Left && rest != "" {
+		style.Space = strings.HasPrefix(rest, " ")
+		if commodity, rest, err = p.parseCommodity(strings.TrimSpace(rest)); err != nil {
+			return "", style, err
+		}
+	}
+	if strings.TrimSpace(rest) != "" {
+		return "", style, fmt.Errorf("invalid amount %q", sample)
+	}
+
+	if mark == 0 {
+		mark = rune(guessDecimalMark(number))
+	}
+	style.DecimalMark = mark
+	if i := strings.LastIndexByte(number, byte(mark)); i != -1 {
+		style.Precision = int32(len(number) - i - 1)
+	}
+	for _, c := range number {
+		if !unicode.IsDigit(c) && c != mark {
+			style.ThousandsSep = c
+			break
+		}
+	}
+	return commodity, style, nil
+}
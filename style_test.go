@@ -0,0 +1,108 @@
+/*
+Copyright (C) 2017 Julian Andres Klode <jak@jak-linux.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package goledger
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestParseCommodityStyle(t *testing.T) {
+	for _, test := range []struct {
+		sample    string
+		commodity string
+		style     CommodityStyle
+	}{
+		{"€1.000,00", "€", CommodityStyle{Left: true, DecimalMark: ',', ThousandsSep: '.', Precision: 2}},
+		{"1,000.00000000 BTC", "BTC", CommodityStyle{Space: true, DecimalMark: '.', ThousandsSep: ',', Precision: 8}},
+		{"$ -1,5", "$", CommodityStyle{Left: true, Space: true, DecimalMark: ',', Precision: 1}},
+		{"1.000.000 JPY", "JPY", CommodityStyle{Space: true, DecimalMark: ',', ThousandsSep: '.'}},
+		{`10 "ACME 1"`, "ACME 1", CommodityStyle{Space: true, DecimalMark: '.'}},
+		{"1000.", "", CommodityStyle{DecimalMark: '.'}},
+	} {
+		commodity, style, err := ParseCommodityStyle(test.sample)
+		if err != nil {
+			t.Errorf("%q: %v", test.sample, err)
+			continue
+		}
+		if commodity != test.commodity || style != test.style {
+			t.Errorf("%q: got %q %+v, want %q %+v", test.sample, commodity, style, test.commodity, test.style)
+		}
+	}
+	for _, sample := range []string{"EUR", "1.00 EUR x", ""} {
+		if _, _, err := ParseCommodityStyle(sample); err == nil {
+			t.Errorf("%q: expected an error", sample)
+		}
+	}
+}
+
+func TestCommodityStylesFormat(t *testing.T) {
+	styles := CommodityStyles{
+		"EUR": {Symbol: "€", DecimalMark: ',', ThousandsSep: '.', Precision: 2},
+		"USD": {Symbol: "$", Left: true, DecimalMark: '.', ThousandsSep: ',', Precision: 2},
+		"BTC": {Left: true, Space: true, Precision: 4},
+	}
+	for _, test := range []struct {
+		value     string
+		commodity string
+		want      string
+	}{
+		{"1234567.5", "EUR", "1.234.567,50€"},
+		{"-1234.5", "USD", "-$1,234.50"},
+		{"0.123456", "BTC", "BTC 0.123456"},
+		{"-1", "BTC", "-BTC 1.0000"},
+		{"1.5", "GBP", "1.50 GBP"},
+		{"1.5", "ACME 1", `1.50 "ACME 1"`},
+		{"1.5", "", "1.50"},
+	} {
+		if got := styles.Format(decimal.RequireFromString(test.value), test.commodity); got != test.want {
+			t.Errorf("%s %s: got %q, want %q", test.value, test.commodity, got, test.want)
+		}
+	}
+}
+
+func TestDecimalMarkDirective(t *testing.T) {
+	for _, test := range []struct {
+		journal string
+		want    string
+	}{
+		// Without a directive, a single comma is guessed to be the decimal
+		// mark
+		{"2017/01/02 Test\n    a  1,000 EUR\n    b\n", "1"},
+		{"decimal-mark .\n2017/01/02 Test\n    a  1,000 EUR\n    b\n", "1000"},
+		{"decimal-mark ,\n2017/01/02 Test\n    a  1.000 EUR\n    b\n", "1000"},
+		// Commodity directives declare the decimal mark of their commodity
+		{"commodity 1.000,00 EUR\n2017/01/02 Test\n    a  1.000 EUR\n    b\n", "1000"},
+	} {
+		j, err := ParseJournal(strings.NewReader(test.journal))
+		if err != nil {
+			t.Errorf("%q: %v", test.journal, err)
+			continue
+		}
+		if got := j[0].Postings[0].Value; !got.Equal(decimal.RequireFromString(test.want)) {
+			t.Errorf("%q: got %s, want %s", test.journal, got, test.want)
+		}
+	}
+	for _, journal := range []string{"decimal-mark\n", "decimal-mark x\n", "decimal-mark . ,\n"} {
+		if _, err := ParseJournal(strings.NewReader(journal)); err == nil {
+			t.Errorf("%q: expected an error", journal)
+		}
+	}
+}
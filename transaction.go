@@ -18,60 +18,228 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package goledger
 
 import (
-	"fmt"
 	"io"
-	"strings"
 	"time"
 
 	"github.com/shopspring/decimal"
 )
 
+// AssertionKind is the kind of a balance assertion, following hledger.
+type AssertionKind int
+
+// Kinds of balance assertions
+const (
+	// NoAssertion means the posting has no balance assertion
+	NoAssertion AssertionKind = iota
+	// AssertBalance (=) asserts the balance of the account in the
+	// commodity of the assertion, excluding sub-accounts.
+	AssertBalance
+	// AssertSoleBalance (==) additionally asserts that the account
+	// holds no other commodities.
+	AssertSoleBalance
+	// AssertBalanceInclusive (=*) is like AssertBalance, but includes
+	// sub-accounts.
+	AssertBalanceInclusive
+	// AssertSoleBalanceInclusive (==*) is like AssertSoleBalance, but
+	// includes sub-accounts.
+	AssertSoleBalanceInclusive
+)
+
+// String returns the hledger syntax for the assertion kind.
+func (k AssertionKind) String() string {
+	switch k {
+	case AssertBalance:
+		return "="
+	case AssertSoleBalance:
+		return "=="
+	case AssertBalanceInclusive:
+		return "=*"
+	case AssertSoleBalanceInclusive:
+		return "==*"
+	}
+	return ""
+}
+
+// Status is the clearing status of a transaction or posting.
+type Status int
+
+// Possible statuses
+const (
+	Unmarked Status = iota
+	// Pending (!) transactions are not yet cleared
+	Pending
+	// Cleared (*) transactions have been confirmed, for example by a bank
+	// statement
+	Cleared
+)
+
+// String returns the mark for the status, that is "", "!", or "*".
+func (s Status) String() string {
+	switch s {
+	case Pending:
+		return "!"
+	case Cleared:
+		return "*"
+	}
+	return ""
+}
+
+// Tag is a name: value pair in a comment, also known as metadata. The
+// value may be empty.
+type Tag struct {
+	Name  string
+	Value string
+}
+
+// PostingType is the type of a posting, regular or virtual.
+type PostingType int
+
+// Possible posting types
+const (
+	RegularPosting PostingType = iota
+	// VirtualPosting is a posting to (account), which does not have to
+	// balance
+	VirtualPosting
+	// BalancedVirtualPosting is a posting to [account]. Balanced virtual
+	// postings have to balance among themselves.
+	BalancedVirtualPosting
+)
+
+// String returns a description of the posting type, like "virtual posting".
+func (t PostingType) String() string {
+	switch t {
+	case VirtualPosting:
+		return "virtual posting"
+	case BalancedVirtualPosting:
+		return "balanced virtual posting"
+	}
+	return "posting"
+}
+
+// account returns the account name, with parentheses or brackets for
+// virtual postings.
+func (t PostingType) account(account string) string {
+	switch t {
+	case VirtualPosting:
+		return "(" + account + ")"
+	case BalancedVirtualPosting:
+		return "[" + account + "]"
+	}
+	return account
+}
+
 // Posting describes a part of a ledger transaction
 type Posting struct {
 	Account    string
+	Type       PostingType
 	Value      decimal.Decimal
 	Currency   string
 	AtValue    decimal.Decimal
 	AtCurrency string
+	// Cost is the unit cost of the lot the posting adds to or takes from,
+	// in CostCurrency, written as {cost} by ledger-cli and Beancount. A
+	// posting with a cost balances at its cost, and AtValue is only the
+	// market price.
+	Cost         decimal.Decimal
+	CostCurrency string
+	// Assertion asserts that the balance of the account after the
+	// posting is AssertionValue AssertionCurrency.
+	Assertion         AssertionKind
+	AssertionValue    decimal.Decimal
+	AssertionCurrency string
+	// Elided postings have no amount written, it is inferred by
+	// Transaction.Balance so that the transaction balances.
+	Elided bool
+
+	// atTotal is the total price the unit price AtValue was computed
+	// from, if the posting was parsed with a @@ price.
+	atTotal decimal.Decimal
+
+	// Date and ValutaDate override the dates of the transaction for
+	// this posting, if they are not zero.
+	Date       time.Time
+	ValutaDate time.Time
+
+	Status Status
+	// Comment is the comment of the posting, excluding tags. Multiple
+	// lines are separated by newlines.
+	Comment string
+	Tags    []Tag
 }
 
 // Transaction represents a transaction in a ledger file
 type Transaction struct {
 	Date        time.Time
 	ValutaDate  time.Time
+	Status      Status
+	Code        string
 	Description string
-	Postings    []Posting
+	// Comment is the comment of the transaction, excluding tags. Multiple
+	// lines are separated by newlines.
+	Comment  string
+	Tags     []Tag
+	Postings []Posting
+	// ID identifies the imported transaction this was created from, see
+	// importer.Transaction.ID(). It is rendered as the tag id.
+	ID string
+}
+
+// Tag returns the value of the tag with the given name.
+func (l *Transaction) Tag(name string) (string, bool) {
+	if name == "id" && l.ID != "" {
+		return l.ID, true
+	}
+	for _, tag := range l.Tags {
+		if tag.Name == name {
+			return tag.Value, true
+		}
+	}
+	return "", false
 }
 
-func renderDecimal(d decimal.Decimal) string {
-	value := d.String()
-	if !strings.Contains(value, ".") {
-		value += ".00"
-	} else if len(value) >= 2 && value[len(value)-2] == '.' {
-		value += "0"
+// totalPrice returns the total price the posting was parsed with, if its
+// unit price has not been changed since.
+func (p *Posting) totalPrice() (decimal.Decimal, bool) {
+	if p.atTotal.IsZero() || p.Value.IsZero() || !p.atTotal.Div(p.Value.Abs()).Equal(p.AtValue) {
+		return decimal.Zero, false
 	}
-	return value
+	return p.atTotal, true
 }
 
-// Print prints the ledger transaction to the writer
-func (l *Transaction) Print(w io.Writer) {
+// SetTotalPrice sets the price of the posting to the total price of its
+// amount, which is rendered as @@ total. Unit prices computed from a total
+// price might not be representable exactly.
+func (p *Posting) SetTotalPrice(total decimal.Decimal, currency string) {
+	p.AtCurrency = currency
+	if p.Value.IsZero() {
+		p.AtValue, p.atTotal = decimal.Zero, decimal.Zero
+		return
+	}
+	p.atTotal = total.Abs()
+	p.AtValue = p.atTotal.Div(p.Value.Abs())
+}
+
+// dates returns the date of the transaction and the valuta date, if it
+// differs. Dates before the year 1000 are considered unset.
+func (l *Transaction) dates() (time.Time, time.Time) {
 	switch {
 	case l.ValutaDate.Year() > 1000 && l.Date.Year() > 1000 && l.ValutaDate != l.Date:
-		fmt.Printf("%d/%02d/%02d=%d/%02d/%02d", l.Date.Year(), l.Date.Month(), l.Date.Day(), l.ValutaDate.Year(), l.ValutaDate.Month(), l.ValutaDate.Day())
+		return l.Date, l.ValutaDate
 	case l.Date.Year() > 1000:
-		fmt.Printf("%d/%02d/%02d", l.Date.Year(), l.Date.Month(), l.Date.Day())
+		return l.Date, time.Time{}
 	case l.ValutaDate.Year() > 1000:
-		fmt.Printf("%d/%02d/%02d", l.ValutaDate.Year(), l.ValutaDate.Month(), l.ValutaDate.Day())
+		return l.ValutaDate, time.Time{}
 	default:
-		fmt.Printf("1970/01/01")
-	}
-	fmt.Printf(" %s\n", l.Description)
-	for _, p := range l.Postings {
-		if !p.AtValue.IsZero() {
-			fmt.Printf("    %s  %v %s @ %v %s\n", p.Account, renderDecimal(p.Value), p.Currency, renderDecimal(p.AtValue), p.AtCurrency)
-		} else {
-			fmt.Printf("    %s  %v %s\n", p.Account, renderDecimal(p.Value), p.Currency)
-		}
+		return time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC), time.Time{}
 	}
-	fmt.Println()
+}
+
+// Print prints the ledger transaction to the writer, in hledger syntax
+func (l *Transaction) Print(w io.Writer) error {
+	return l.Render(w, HledgerRenderer{})
+}
+
+// Render renders the ledger transaction to the writer
+func (l *Transaction) Render(w io.Writer, r Renderer) error {
+	return r.RenderTransaction(w, l)
 }